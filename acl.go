@@ -0,0 +1,352 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/polevpn/anyvalue"
+	"github.com/polevpn/netstack/tcpip/header"
+)
+
+const (
+	ACL_ACTION_ALLOW   = "allow"
+	ACL_ACTION_DENY    = "deny"
+	ACL_DIRECTION_IN   = "in"
+	ACL_DIRECTION_OUT  = "out"
+	IP_PROTOCOL_ICMP   = 1
+	IP_PROTOCOL_TCP    = 6
+	IP_PROTOCOL_UDP    = 17
+	IP_PROTOCOL_ICMPV6 = 58
+)
+
+type portRange struct {
+	from uint16
+	to   uint16
+}
+
+// ACLRule match packets of users or groups,src and dst are from the view of the client,
+// that is src is the client side and dst is the remote side,whichever direction the packet goes
+type ACLRule struct {
+	allow     bool
+	direction string
+	users     []string
+	groups    []string
+	src       []*net.IPNet
+	dst       []*net.IPNet
+	protocol  uint8
+	ports     []portRange
+}
+
+type aclPacket struct {
+	src      net.IP
+	dst      net.IP
+	protocol uint8
+	srcPort  uint16
+	dstPort  uint16
+	hasPorts bool
+}
+
+// ACL is a list of rules evaluated in order,the first matched rule decides,
+// the default action is used if no rule matches
+type ACL struct {
+	rules        []*ACLRule
+	defaultAllow bool
+	userGroups   map[string][]string
+	mutex        *sync.RWMutex
+}
+
+// NewACL create an acl allowing everything,call Load to apply rules
+func NewACL() *ACL {
+	return &ACL{defaultAllow: true, userGroups: make(map[string][]string), mutex: &sync.RWMutex{}}
+}
+
+// Load parse acl config,the rules in use are kept if config is invalid
+func (acl *ACL) Load(av *anyvalue.AnyValue) error {
+
+	defaultAllow := true
+	switch av.Get("default").AsStr() {
+	case "", ACL_ACTION_ALLOW:
+	case ACL_ACTION_DENY:
+		defaultAllow = false
+	default:
+		return errors.New("acl default should be allow or deny")
+	}
+
+	userGroups := make(map[string][]string)
+	for group, users := range av.Get("groups").AsMap() {
+		for _, user := range anyvalue.NewFromInf(users).AsStrArr() {
+			userGroups[user] = append(userGroups[user], group)
+		}
+	}
+
+	rules := make([]*ACLRule, 0)
+	for i := range av.Get("rules").AsArray() {
+		rule, err := parseACLRule(av.Get("rules").GetIndex(i))
+		if err != nil {
+			return fmt.Errorf("acl rule %v,%v", i, err)
+		}
+		rules = append(rules, rule)
+	}
+
+	acl.mutex.Lock()
+	defer acl.mutex.Unlock()
+	acl.rules = rules
+	acl.defaultAllow = defaultAllow
+	acl.userGroups = userGroups
+	return nil
+}
+
+func parseACLRule(av *anyvalue.AnyValue) (*ACLRule, error) {
+
+	rule := &ACLRule{
+		users:     av.Get("users").AsStrArr(),
+		groups:    av.Get("groups").AsStrArr(),
+		direction: av.Get("direction").AsStr(),
+	}
+
+	switch av.Get("action").AsStr() {
+	case ACL_ACTION_ALLOW:
+		rule.allow = true
+	case ACL_ACTION_DENY:
+	default:
+		return nil, errors.New("action should be allow or deny")
+	}
+
+	if rule.direction != "" && rule.direction != ACL_DIRECTION_IN && rule.direction != ACL_DIRECTION_OUT {
+		return nil, errors.New("direction should be in or out")
+	}
+
+	var err error
+
+	rule.src, err = parseCIDRs(av.Get("src").AsStrArr())
+	if err != nil {
+		return nil, err
+	}
+
+	rule.dst, err = parseCIDRs(av.Get("dst").AsStrArr())
+	if err != nil {
+		return nil, err
+	}
+
+	rule.protocol, err = parseProtocol(av.Get("protocol").AsStr())
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ports := range av.Get("ports").AsStrArr() {
+		pr, err := parsePortRange(ports)
+		if err != nil {
+			return nil, err
+		}
+		rule.ports = append(rule.ports, pr)
+	}
+
+	if len(rule.ports) > 0 && rule.protocol != IP_PROTOCOL_TCP && rule.protocol != IP_PROTOCOL_UDP {
+		return nil, errors.New("ports need protocol tcp or udp")
+	}
+
+	return rule, nil
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	subnets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, subnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		subnets = append(subnets, subnet)
+	}
+	return subnets, nil
+}
+
+func parseProtocol(protocol string) (uint8, error) {
+	switch strings.ToLower(protocol) {
+	case "", "any":
+		return 0, nil
+	case "tcp":
+		return IP_PROTOCOL_TCP, nil
+	case "udp":
+		return IP_PROTOCOL_UDP, nil
+	case "icmp":
+		return IP_PROTOCOL_ICMP, nil
+	case "icmpv6":
+		return IP_PROTOCOL_ICMPV6, nil
+	}
+	n, err := strconv.ParseUint(protocol, 10, 8)
+	if err != nil {
+		return 0, errors.New("invalid protocol " + protocol)
+	}
+	return uint8(n), nil
+}
+
+// parsePortRange parse "80" or "8000-8080"
+func parsePortRange(ports string) (portRange, error) {
+
+	from, to, found := strings.Cut(ports, "-")
+	if !found {
+		to = from
+	}
+
+	start, err := strconv.ParseUint(strings.TrimSpace(from), 10, 16)
+	if err != nil {
+		return portRange{}, errors.New("invalid ports " + ports)
+	}
+	end, err := strconv.ParseUint(strings.TrimSpace(to), 10, 16)
+	if err != nil || end < start {
+		return portRange{}, errors.New("invalid ports " + ports)
+	}
+	return portRange{from: uint16(start), to: uint16(end)}, nil
+}
+
+func parseACLPacket(pkt []byte) (*aclPacket, bool) {
+
+	protocol, payload, ok := ParseIPTransport(pkt)
+	if !ok {
+		return nil, false
+	}
+
+	ap := &aclPacket{protocol: protocol}
+
+	if pkt[0]>>4 == IPV4_PROTOCOL {
+		ap.src = net.IP(header.IPv4(pkt).SourceAddress())
+		ap.dst = net.IP(header.IPv4(pkt).DestinationAddress())
+	} else {
+		ap.src = net.IP(header.IPv6(pkt).SourceAddress())
+		ap.dst = net.IP(header.IPv6(pkt).DestinationAddress())
+	}
+
+	//non-first fragments have no ports,so only rules without ports match them,
+	//a first fragment too short to hold the ports is denied
+	if (protocol == IP_PROTOCOL_TCP || protocol == IP_PROTOCOL_UDP) && payload != nil {
+		if len(payload) < 4 {
+			return nil, false
+		}
+		ap.srcPort = uint16(payload[0])<<8 | uint16(payload[1])
+		ap.dstPort = uint16(payload[2])<<8 | uint16(payload[3])
+		ap.hasPorts = true
+	}
+	return ap, true
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func matchCIDRs(subnets []*net.IPNet, ip net.IP) bool {
+	if len(subnets) == 0 {
+		return true
+	}
+	for _, subnet := range subnets {
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// match check the packet against rule,packets to the client are matched with src and dst swapped
+func (rule *ACLRule) match(user string, groups []string, ap *aclPacket, inbound bool) bool {
+
+	if rule.direction == ACL_DIRECTION_IN && !inbound || rule.direction == ACL_DIRECTION_OUT && inbound {
+		return false
+	}
+
+	if len(rule.users) > 0 && !containsString(rule.users, user) {
+		return false
+	}
+
+	if len(rule.groups) > 0 {
+		found := false
+		for _, group := range groups {
+			if containsString(rule.groups, group) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	local, remote, remotePort := ap.src, ap.dst, ap.dstPort
+	if inbound {
+		local, remote, remotePort = ap.dst, ap.src, ap.srcPort
+	}
+
+	if !matchCIDRs(rule.src, local) || !matchCIDRs(rule.dst, remote) {
+		return false
+	}
+
+	if rule.protocol != 0 && rule.protocol != ap.protocol {
+		return false
+	}
+
+	if len(rule.ports) > 0 {
+		if !ap.hasPorts {
+			return false
+		}
+		found := false
+		for _, pr := range rule.ports {
+			if remotePort >= pr.from && remotePort <= pr.to {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// getUserGroups merge groups of user in acl config with groups,caller must hold the mutex
+func (acl *ACL) getUserGroups(user string, groups []string) []string {
+	if cgroups, ok := acl.userGroups[user]; ok {
+		return append(cgroups[:len(cgroups):len(cgroups)], groups...)
+	}
+	return groups
+}
+
+// GetUserGroups return groups of user in acl config merged with groups from auth backend
+func (acl *ACL) GetUserGroups(user string, groups []string) []string {
+	acl.mutex.RLock()
+	defer acl.mutex.RUnlock()
+	return acl.getUserGroups(user, groups)
+}
+
+// Check return whether the packet is allowed for the client of user,inbound means the packet goes to the client,
+// groups from auth backend are merged with groups in acl config
+func (acl *ACL) Check(user string, groups []string, pkt []byte, inbound bool) bool {
+
+	acl.mutex.RLock()
+	defer acl.mutex.RUnlock()
+
+	if len(acl.rules) == 0 {
+		return acl.defaultAllow
+	}
+
+	ap, ok := parseACLPacket(pkt)
+	if !ok {
+		return false
+	}
+
+	groups = acl.getUserGroups(user, groups)
+
+	for _, rule := range acl.rules {
+		if rule.match(user, groups, ap, inbound) {
+			return rule.allow
+		}
+	}
+	return acl.defaultAllow
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/polevpn/anyvalue"
+	"github.com/polevpn/netstack/tcpip/header"
+)
+
+func buildIPv4Packet(src string, dst string, protocol uint8, srcPort uint16, dstPort uint16) []byte {
+	pkt := make([]byte, 40)
+	pkt[0] = 0x45
+	binary.BigEndian.PutUint16(pkt[2:], uint16(len(pkt)))
+	pkt[8] = 64
+	pkt[9] = protocol
+	copy(pkt[12:16], net.ParseIP(src).To4())
+	copy(pkt[16:20], net.ParseIP(dst).To4())
+	binary.BigEndian.PutUint16(pkt[20:], srcPort)
+	binary.BigEndian.PutUint16(pkt[22:], dstPort)
+	return pkt
+}
+
+// buildIPv6Packet build a packet with 8 bytes extension headers of exts before the transport header,
+// fragment headers carry fragOffset
+func buildIPv6Packet(src string, dst string, protocol uint8, srcPort uint16, dstPort uint16, fragOffset uint16, exts ...uint8) []byte {
+	pkt := make([]byte, 40)
+	pkt[0] = 0x60
+	pkt[7] = 64
+	copy(pkt[8:24], net.ParseIP(src).To16())
+	copy(pkt[24:40], net.ParseIP(dst).To16())
+	next := 6
+	for _, ext := range exts {
+		pkt[next] = ext
+		hdr := make([]byte, 8)
+		if ext == header.IPv6FragmentHeader {
+			binary.BigEndian.PutUint16(hdr[2:], fragOffset<<3)
+		}
+		pkt = append(pkt, hdr...)
+		next = len(pkt) - 8
+	}
+	pkt[next] = protocol
+	transport := make([]byte, 20)
+	binary.BigEndian.PutUint16(transport, srcPort)
+	binary.BigEndian.PutUint16(transport[2:], dstPort)
+	pkt = append(pkt, transport...)
+	binary.BigEndian.PutUint16(pkt[4:], uint16(len(pkt)-40))
+	return pkt
+}
+
+func TestACLCheck(t *testing.T) {
+
+	av, err := anyvalue.NewFromJson([]byte(`{
+		"default":"allow",
+		"groups":{"contractors":["bob"]},
+		"rules":[
+			{"action":"allow","groups":["contractors"],"dst":["10.20.0.0/16"],"protocol":"tcp","ports":["22","8000-8080"]},
+			{"action":"deny","groups":["contractors"]},
+			{"action":"deny","users":["alice"],"dst":["192.168.0.0/16"],"direction":"out"}
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	acl := NewACL()
+	err = acl.Load(av)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		user    string
+		groups  []string
+		pkt     []byte
+		inbound bool
+		allow   bool
+	}{
+		{"bob", nil, buildIPv4Packet("10.8.0.2", "10.20.1.1", IP_PROTOCOL_TCP, 40000, 22), false, true},
+		{"bob", nil, buildIPv4Packet("10.20.1.1", "10.8.0.2", IP_PROTOCOL_TCP, 8080, 40000), true, true},
+		{"bob", nil, buildIPv4Packet("10.8.0.2", "10.20.1.1", IP_PROTOCOL_TCP, 40000, 443), false, false},
+		{"bob", nil, buildIPv4Packet("10.8.0.2", "10.30.1.1", IP_PROTOCOL_TCP, 40000, 22), false, false},
+		{"bob", nil, buildIPv4Packet("10.8.0.2", "10.20.1.1", IP_PROTOCOL_UDP, 40000, 22), false, false},
+		{"carol", []string{"contractors"}, buildIPv4Packet("10.8.0.3", "10.30.1.1", IP_PROTOCOL_UDP, 40000, 53), false, false},
+		{"carol", nil, buildIPv4Packet("10.8.0.3", "10.30.1.1", IP_PROTOCOL_UDP, 40000, 53), false, true},
+		{"alice", nil, buildIPv4Packet("10.8.0.4", "192.168.1.1", IP_PROTOCOL_TCP, 40000, 80), false, false},
+		{"alice", nil, buildIPv4Packet("192.168.1.1", "10.8.0.4", IP_PROTOCOL_TCP, 80, 40000), true, true},
+	}
+
+	for i, test := range tests {
+		if acl.Check(test.user, test.groups, test.pkt, test.inbound) != test.allow {
+			t.Fatalf("case %v,expect allow %v", i, test.allow)
+		}
+	}
+
+	av, _ = anyvalue.NewFromJson([]byte(`{"default":"deny","rules":[{"action":"allow","src":["bad"]}]}`))
+	err = acl.Load(av)
+	if err == nil {
+		t.Fatal("invalid rule should fail")
+	}
+	if !acl.Check("carol", nil, buildIPv4Packet("10.8.0.3", "10.30.1.1", IP_PROTOCOL_UDP, 40000, 53), false) {
+		t.Fatal("rules should be kept when load fail")
+	}
+}
+
+func TestACLCheckFragment(t *testing.T) {
+
+	av, _ := anyvalue.NewFromJson([]byte(`{
+		"default":"deny",
+		"rules":[
+			{"action":"deny","dst":["fd00:20::/32"],"protocol":"tcp","ports":["22"]},
+			{"action":"allow","protocol":"tcp","ports":["80"]},
+			{"action":"allow","dst":["10.30.0.0/16","fd00:30::/32"]}
+		]
+	}`))
+	acl := NewACL()
+	err := acl.Load(av)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fragment := func(pkt []byte, offset uint16) []byte {
+		binary.BigEndian.PutUint16(pkt[6:], offset)
+		return pkt
+	}
+	short := buildIPv4Packet("10.8.0.2", "10.40.1.1", IP_PROTOCOL_TCP, 40000, 80)
+	binary.BigEndian.PutUint16(short[2:], 22)
+
+	tests := []struct {
+		pkt   []byte
+		allow bool
+	}{
+		//extension headers are skipped to reach the tcp header
+		{buildIPv6Packet("fd00::2", "fd00:40::1", IP_PROTOCOL_TCP, 40000, 80, 0, IPV6_EXT_HOP_BY_HOP, header.IPv6FragmentHeader), true},
+		{buildIPv6Packet("fd00::2", "fd00:20::1", IP_PROTOCOL_TCP, 40000, 22, 0, IPV6_EXT_DEST_OPTS), false},
+		{buildIPv6Packet("fd00::2", "fd00:20::1", IP_PROTOCOL_TCP, 40000, 22, 0, IPV6_EXT_ROUTING, IPV6_EXT_AUTH), false},
+		//non-first fragments have no ports,only rules without ports match
+		{buildIPv6Packet("fd00::2", "fd00:40::1", IP_PROTOCOL_TCP, 40000, 80, 10, header.IPv6FragmentHeader), false},
+		{buildIPv6Packet("fd00::2", "fd00:30::1", IP_PROTOCOL_TCP, 40000, 80, 10, header.IPv6FragmentHeader), true},
+		{fragment(buildIPv4Packet("10.8.0.2", "10.40.1.1", IP_PROTOCOL_TCP, 40000, 80), 10), false},
+		{fragment(buildIPv4Packet("10.8.0.2", "10.30.1.1", IP_PROTOCOL_TCP, 40000, 80), 10), true},
+		{fragment(buildIPv4Packet("10.8.0.2", "10.40.1.1", IP_PROTOCOL_TCP, 40000, 80), 0x2000), true},
+		//first fragment too short to hold the ports
+		{short, false},
+	}
+
+	for i, test := range tests {
+		if acl.Check("alice", nil, test.pkt, false) != test.allow {
+			t.Fatalf("case %v,expect allow %v", i, test.allow)
+		}
+	}
+}
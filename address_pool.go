@@ -1,6 +1,9 @@
 package main
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"net"
 	"sync"
 )
@@ -12,6 +15,7 @@ type AddressPool struct {
 	mutex    *sync.Mutex
 	gw       string
 	network  *net.IPNet
+	network6 *net.IPNet
 }
 
 func NewAddressPool(cidr string, bindips map[string]string) (*AddressPool, error) {
@@ -90,6 +94,32 @@ func (ap *AddressPool) Release(ip string) {
 	}
 }
 
+// SetBindIPs replace the bind ips,bound ips are reserved from dynamic alloc,
+// return the ips no longer bound which caller should release if they are not in use
+func (ap *AddressPool) SetBindIPs(bindips map[string]string) []string {
+
+	rbindips := make(map[string]string)
+	for user, ip := range bindips {
+		rbindips[ip] = user
+		_, ok := ap.pool[ip]
+		if ok {
+			ap.pool[ip] = true
+		}
+	}
+
+	unbound := make([]string, 0)
+	for ip := range ap.rbindips {
+		_, ok := rbindips[ip]
+		if !ok {
+			unbound = append(unbound, ip)
+		}
+	}
+
+	ap.bindips = bindips
+	ap.rbindips = rbindips
+	return unbound
+}
+
 func (ap *AddressPool) GetBindIP(user string) string {
 	return ap.bindips[user]
 }
@@ -106,3 +136,108 @@ func (ap *AddressPool) IsAlloc(ip string) bool {
 	}
 	return ok
 }
+
+func (ap *AddressPool) Size() int {
+	return len(ap.pool)
+}
+
+func (ap *AddressPool) Used() int {
+	used := 0
+	for _, v := range ap.pool {
+		if v {
+			used++
+		}
+	}
+	return used
+}
+
+// SetNetwork6 enables the ipv6 pool,every ipv4 address of the pool is mapped to the
+// ipv6 address with the same host offset,so the ipv6 network must have enough host bits
+func (ap *AddressPool) SetNetwork6(cidr string) error {
+
+	_, network6, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+
+	if network6.IP.To4() != nil {
+		return errors.New("network " + cidr + " is not ipv6 network")
+	}
+
+	n4, c4 := ap.network.Mask.Size()
+	n6, c6 := network6.Mask.Size()
+
+	if c6-n6 < c4-n4 {
+		return errors.New("ipv6 network " + cidr + " is smaller than ipv4 network " + ap.network.String())
+	}
+
+	ap.network6 = network6
+	return nil
+}
+
+func (ap *AddressPool) HasNetwork6() bool {
+	return ap.network6 != nil
+}
+
+func (ap *AddressPool) GetNetwork6() string {
+	if ap.network6 == nil {
+		return ""
+	}
+	return ap.network6.String()
+}
+
+func (ap *AddressPool) GatewayIP6() string {
+	return ap.GetIPv6(ap.gw)
+}
+
+// GetIPv6 return the ipv6 address mapped from ipv4 address ip
+func (ap *AddressPool) GetIPv6(ip string) string {
+
+	if ap.network6 == nil {
+		return ""
+	}
+
+	ipv4 := net.ParseIP(ip).To4()
+	if ipv4 == nil || !ap.network.Contains(ipv4) {
+		return ""
+	}
+
+	offset := binary.BigEndian.Uint32(ipv4) - binary.BigEndian.Uint32(ap.network.IP.To4())
+
+	ipv6 := make(net.IP, net.IPv6len)
+	copy(ipv6, ap.network6.IP)
+	binary.BigEndian.PutUint32(ipv6[12:], binary.BigEndian.Uint32(ipv6[12:])|offset)
+
+	return ipv6.String()
+}
+
+// GetIPv4 return the ipv4 address which ipv6 address ip6 mapped from
+func (ap *AddressPool) GetIPv4(ip6 string) string {
+
+	if ap.network6 == nil {
+		return ""
+	}
+
+	ipv6 := net.ParseIP(ip6)
+	if ipv6 == nil || ipv6.To4() != nil || !ap.network6.Contains(ipv6) {
+		return ""
+	}
+
+	n4, c4 := ap.network.Mask.Size()
+	hostmask := uint32(1<<(c4-n4)) - 1
+
+	hostpart := make(net.IP, net.IPv6len)
+	for i := range ipv6 {
+		hostpart[i] = ipv6[i] &^ ap.network6.Mask[i]
+	}
+
+	offset := binary.BigEndian.Uint32(hostpart[12:])
+	if !bytes.Equal(hostpart[:12], make([]byte, 12)) || offset&^hostmask != 0 {
+		return ""
+	}
+
+	ipv4 := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ipv4, binary.BigEndian.Uint32(ap.network.IP.To4())+offset)
+
+	return ipv4.String()
+}
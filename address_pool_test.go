@@ -17,16 +17,16 @@ func TestCIDRAdress(t *testing.T) {
 	a := 1 << (c - n)
 	for i := 1; i < a-1; i++ {
 
-		if i%2 == 0 {
+		if i%256 == 0 {
 			net.IP.To4()[2] += 1
 		}
-		if i%655 == 0 {
-			net.IP.To4()[1+= 1
+		if i%65536 == 0 {
+			net.IP.To4()[1] += 1
 		}
-		net.IP.To4()[ += 1
+		net.IP.To4()[3] += 1
 		if net.IP.To4()[3] == 0 {
 			continue
-}
+		}
 
 		t.Log(net.IP.To4())
 	}
@@ -49,11 +49,50 @@ func TestCIDRAdressPool(t *testing.T) {
 
 func TestCIDR(t *testing.T) {
 	ip, network, err := net.ParseCIDR("10.9.3.255/31")
-	if ip.Strg() == network.IP.String() {	gw := network.IP.To4()
+	if ip.String() == network.IP.String() {
+		gw := network.IP.To4()
 		gw[3] = gw[3] + 1
 		t.Log("gw=", gw)
 	} else {
-		t.Lo"gw=", network.IP)
+		t.Log("gw=", network.IP)
 	}
 	t.Log(ip, network, err)
 }
+
+func TestCIDRAdressPool6(t *testing.T) {
+	pool, err := NewAddressPool("10.8.0.0/16", map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = pool.SetNetwork6("fd00:10:8::/120")
+	if err == nil {
+		t.Fatal("ipv6 network smaller than ipv4 network should fail")
+	}
+
+	err = pool.SetNetwork6("fd00:10:8::/64")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pool.GatewayIP6() != "fd00:10:8::1" {
+		t.Fatal("invalid ipv6 gateway ", pool.GatewayIP6())
+	}
+
+	ip6 := pool.GetIPv6("10.8.3.4")
+	if ip6 != "fd00:10:8::304" {
+		t.Fatal("invalid ipv6 address ", ip6)
+	}
+
+	if pool.GetIPv4(ip6) != "10.8.3.4" {
+		t.Fatal("invalid ipv4 address ", pool.GetIPv4(ip6))
+	}
+
+	if pool.GetIPv4("fd00:10:8::1:0:304") != "" {
+		t.Fatal("ipv6 address out of ipv4 pool should not be mapped")
+	}
+
+	if pool.GetIPv6("10.9.0.1") != "" {
+		t.Fatal("ipv4 address out of pool should not be mapped")
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/polevpn/anyvalue"
+	"github.com/polevpn/elog"
+)
+
+// AdminServer expose sessions,address pool and routes through a REST api,
+// it is protected by a bearer token or client certificate
+type AdminServer struct {
+	connmgr   *ConnMgr
+	routermgr *RouterMgr
+	token     string
+	server    *http.Server
+}
+
+func NewAdminServer(connmgr *ConnMgr, routermgr *RouterMgr, token string) *AdminServer {
+	as := &AdminServer{connmgr: connmgr, routermgr: routermgr, token: token}
+	as.server = &http.Server{Handler: as.handler()}
+	return as
+}
+
+func (as *AdminServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/sessions", as.listSessions)
+	mux.HandleFunc("DELETE /api/sessions", as.kickSessions)
+	mux.HandleFunc("GET /api/pool", as.getAddressPool)
+	mux.HandleFunc("GET /api/routes", as.listRoutes)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer PanicHandler()
+		if !as.authorized(r) {
+			as.respJson(w, http.StatusUnauthorized, as.errorBody("unauthorized"))
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func (as *AdminServer) authorized(r *http.Request) bool {
+
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return true
+	}
+
+	if as.token == "" {
+		return false
+	}
+
+	auth := r.Header.Get("Authorization")
+	if len(auth) <= len(BEARER_AUTH_PREFIX) || !strings.EqualFold(auth[:len(BEARER_AUTH_PREFIX)], BEARER_AUTH_PREFIX) {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(auth[len(BEARER_AUTH_PREFIX):]), []byte(as.token)) == 1
+}
+
+// isLoopbackAddr return whether the listen addr only accepts connections from local host
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// Listen serve admin api at addr,it serves https if certFile is set,and verifies client
+// certificates against clientCA if it is set,plain http is only allowed on loopback addr
+func (as *AdminServer) Listen(wg *sync.WaitGroup, addr string, certFile string, keyFile string, clientCA string) {
+
+	defer wg.Done()
+
+	if certFile == "" && !isLoopbackAddr(addr) {
+		elog.Error("admin api listen on non loopback addr need cert_file and key_file")
+		return
+	}
+
+	if clientCA != "" {
+		if certFile == "" {
+			elog.Error("admin client ca need cert_file and key_file")
+			return
+		}
+		pem, err := os.ReadFile(clientCA)
+		if err != nil {
+			elog.Error("read admin client ca fail,", err)
+			return
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			elog.Error("admin client ca has no certificate")
+			return
+		}
+		as.server.TLSConfig = &tls.Config{ClientCAs: pool, ClientAuth: tls.RequireAndVerifyClientCert}
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		elog.Error("admin server listen fail,", err)
+		return
+	}
+
+	if certFile != "" {
+		err = as.server.ServeTLS(listener, certFile, keyFile)
+	} else {
+		err = as.server.Serve(listener)
+	}
+
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		elog.Error("admin server listen fail,", err)
+	}
+}
+
+// Shutdown stop serving admin api,it waits active requests until ctx done
+func (as *AdminServer) Shutdown(ctx context.Context) error {
+	return as.server.Shutdown(ctx)
+}
+
+func (as *AdminServer) errorBody(msg string) *anyvalue.AnyValue {
+	return anyvalue.New().Set("error", msg)
+}
+
+func (as *AdminServer) respJson(w http.ResponseWriter, status int, av *anyvalue.AnyValue) {
+	body, _ := av.EncodeJson()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+func (as *AdminServer) sessionInfo(conn Conn) map[string]interface{} {
+	ip := as.connmgr.GeIPByConn(conn)
+	info := map[string]interface{}{
+		"id":           conn.String(),
+		"user":         as.connmgr.GetConnAttachUser(conn),
+		"ip":           ip,
+		"ip6":          as.connmgr.GetIPv6Address(ip),
+		"transport":    conn.Transport(),
+		"remote_addr":  conn.RemoteAddr(),
+		"connect_time": conn.ConnectTime().Unix(),
+		"up_bytes":     conn.UpStreamBytes(),
+		"down_bytes":   conn.DownStreamBytes(),
+	}
+	policy := as.connmgr.GetConnPolicy(conn)
+	if policy != nil {
+		info["policy"] = map[string]interface{}{
+			"up_limit":     policy.UpLimit,
+			"down_limit":   policy.DownLimit,
+			"quota":        policy.Quota,
+			"max_sessions": policy.MaxSessions,
+		}
+	}
+	return info
+}
+
+func (as *AdminServer) listSessions(w http.ResponseWriter, r *http.Request) {
+
+	user := r.URL.Query().Get("user")
+
+	conns := as.connmgr.GetConns()
+	sort.Slice(conns, func(i, j int) bool {
+		return conns[i].ConnectTime().Before(conns[j].ConnectTime())
+	})
+
+	sessions := make([]interface{}, 0)
+	for _, conn := range conns {
+		if user != "" && as.connmgr.GetConnAttachUser(conn) != user {
+			continue
+		}
+		sessions = append(sessions, as.sessionInfo(conn))
+	}
+
+	as.respJson(w, http.StatusOK, anyvalue.New().Set("sessions", sessions))
+}
+
+// kickSessions kick out the session with id,or all sessions of user
+func (as *AdminServer) kickSessions(w http.ResponseWriter, r *http.Request) {
+
+	id := r.URL.Query().Get("id")
+	user := r.URL.Query().Get("user")
+
+	if id == "" && user == "" {
+		as.respJson(w, http.StatusBadRequest, as.errorBody("id or user required"))
+		return
+	}
+
+	kicked := make([]interface{}, 0)
+	for _, conn := range as.connmgr.GetConns() {
+		if id != "" && conn.String() != id {
+			continue
+		}
+		if user != "" && as.connmgr.GetConnAttachUser(conn) != user {
+			continue
+		}
+		kicked = append(kicked, as.sessionInfo(conn))
+		elog.Infof("admin kick out %v,user:%v", conn.String(), as.connmgr.GetConnAttachUser(conn))
+		as.connmgr.KickOut(conn)
+	}
+
+	if len(kicked) == 0 {
+		as.respJson(w, http.StatusNotFound, as.errorBody("session not found"))
+		return
+	}
+
+	as.respJson(w, http.StatusOK, anyvalue.New().Set("kicked", kicked))
+}
+
+func (as *AdminServer) getAddressPool(w http.ResponseWriter, r *http.Request) {
+
+	total, used := as.connmgr.GetAddressPoolStats()
+
+	av := anyvalue.New()
+	av.Set("total", total)
+	av.Set("used", used)
+	av.Set("free", total-used)
+
+	addresspool := as.connmgr.GetAddressPool()
+	if addresspool != nil {
+		av.Set("network", addresspool.GetNetwork())
+		av.Set("network6", addresspool.GetNetwork6())
+		av.Set("gateway", addresspool.GatewayIP())
+	}
+
+	as.respJson(w, http.StatusOK, av)
+}
+
+func (as *AdminServer) listRoutes(w http.ResponseWriter, r *http.Request) {
+
+	routes := as.routermgr.GetRoutes()
+
+	cidrs := make([]string, 0, len(routes))
+	for cidr := range routes {
+		cidrs = append(cidrs, cidr)
+	}
+	sort.Strings(cidrs)
+
+	list := make([]interface{}, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		list = append(list, map[string]interface{}{"cidr": cidr, "gw": routes[cidr]})
+	}
+
+	as.respJson(w, http.StatusOK, anyvalue.New().Set("routes", list))
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/polevpn/anyvalue"
+)
+
+func TestIsLoopbackAddr(t *testing.T) {
+
+	tests := []struct {
+		addr     string
+		loopback bool
+	}{
+		{"127.0.0.1:8443", true},
+		{"[::1]:8443", true},
+		{"localhost:8443", true},
+		{":8443", false},
+		{"0.0.0.0:8443", false},
+		{"192.168.1.1:8443", false},
+		{"127.0.0.1", false},
+	}
+
+	for _, test := range tests {
+		if isLoopbackAddr(test.addr) != test.loopback {
+			t.Fatalf("%v expect loopback %v", test.addr, test.loopback)
+		}
+	}
+}
+
+func TestAdminServerListen(t *testing.T) {
+
+	as := NewAdminServer(NewConnMgr(), NewRouterMgr(), "secret")
+
+	//plain http on non loopback addr is refused
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	done := make(chan struct{})
+	go func() {
+		as.Listen(wg, "0.0.0.0:0", "", "", "")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		as.Shutdown(context.Background())
+		t.Fatal("admin api shouldn't serve plain http on non loopback addr")
+	}
+
+	addr := freeAddr(t, "tcp")
+	wg.Add(1)
+	go as.Listen(wg, addr, "", "", "")
+
+	var resp *http.Response
+	var err error
+	for i := 0; i < 50; i++ {
+		resp, err = http.Get("http://" + addr + "/api/pool")
+		if err == nil {
+			break
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expect 401,got %v", resp.StatusCode)
+	}
+
+	err = as.Shutdown(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+}
+
+type kickConn struct {
+	testConn
+	sent chan []byte
+}
+
+func newKickConn(id string) *kickConn {
+	return &kickConn{testConn: testConn{id: id}, sent: make(chan []byte, 10)}
+}
+
+func (kc *kickConn) Send(pkt []byte) { kc.sent <- pkt }
+
+func (kc *kickConn) kicked() bool {
+	select {
+	case pkt := <-kc.sent:
+		return PolePacket(pkt).Cmd() == CMD_KICK_OUT
+	case <-time.After(time.Millisecond * 100):
+		return false
+	}
+}
+
+func adminRequest(t *testing.T, url string, method string, auth string) (int, *anyvalue.AnyValue) {
+
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Header.Get("Content-Type") != "application/json" {
+		return resp.StatusCode, anyvalue.New()
+	}
+	av, err := anyvalue.NewFromJson(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, av
+}
+
+func TestAdminServerAuth(t *testing.T) {
+
+	connmgr := NewConnMgr()
+	conn := newKickConn("conn1")
+	connmgr.AttachUserToConn("alice", conn)
+
+	server := httptest.NewServer(NewAdminServer(connmgr, NewRouterMgr(), "secret").handler())
+	defer server.Close()
+
+	tests := []struct {
+		auth   string
+		status int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Bearer", http.StatusUnauthorized},
+		{"Bearer ", http.StatusUnauthorized},
+		{"Bearer wrong", http.StatusUnauthorized},
+		{"Bearer secret2", http.StatusUnauthorized},
+		{"Basic secret", http.StatusUnauthorized},
+		{"Token secret", http.StatusUnauthorized},
+		{"secret", http.StatusUnauthorized},
+		{"Bearer secret", http.StatusOK},
+		{"bearer secret", http.StatusOK},
+	}
+
+	for _, test := range tests {
+		status, _ := adminRequest(t, server.URL+"/api/sessions", http.MethodGet, test.auth)
+		if status != test.status {
+			t.Fatalf("auth %q expect %v,got %v", test.auth, test.status, status)
+		}
+	}
+
+	//unauthorized kick must not reach the session
+	for _, test := range tests[:len(tests)-2] {
+		status, _ := adminRequest(t, server.URL+"/api/sessions?user=alice", http.MethodDelete, test.auth)
+		if status != http.StatusUnauthorized {
+			t.Fatalf("kick with auth %q expect 401,got %v", test.auth, status)
+		}
+	}
+	if conn.kicked() {
+		t.Fatal("unauthorized request shouldn't kick out session")
+	}
+
+	//admin api without token only accepts client certificates
+	noToken := httptest.NewServer(NewAdminServer(connmgr, NewRouterMgr(), "").handler())
+	defer noToken.Close()
+
+	for _, auth := range []string{"", "Bearer ", "Bearer secret"} {
+		status, _ := adminRequest(t, noToken.URL+"/api/sessions", http.MethodGet, auth)
+		if status != http.StatusUnauthorized {
+			t.Fatalf("auth %q expect 401 without token,got %v", auth, status)
+		}
+	}
+}
+
+func TestAdminServerKickSessions(t *testing.T) {
+
+	connmgr := NewConnMgr()
+
+	conns := []*kickConn{newKickConn("conn1"), newKickConn("conn2"), newKickConn("conn3")}
+	connmgr.AttachUserToConn("alice", conns[0])
+	connmgr.AttachUserToConn("alice", conns[1])
+	connmgr.AttachUserToConn("bob", conns[2])
+
+	server := httptest.NewServer(NewAdminServer(connmgr, NewRouterMgr(), "secret").handler())
+	defer server.Close()
+
+	auth := "Bearer secret"
+	status, _ := adminRequest(t, server.URL+"/api/sessions", http.MethodDelete, auth)
+	if status != http.StatusBadRequest {
+		t.Fatalf("kick without id or user expect 400,got %v", status)
+	}
+
+	status, _ = adminRequest(t, server.URL+"/api/sessions?id=unknown", http.MethodDelete, auth)
+	if status != http.StatusNotFound {
+		t.Fatalf("kick unknown session expect 404,got %v", status)
+	}
+
+	status, _ = adminRequest(t, server.URL+"/api/sessions?user=carol", http.MethodDelete, auth)
+	if status != http.StatusNotFound {
+		t.Fatalf("kick unknown user expect 404,got %v", status)
+	}
+
+	status, _ = adminRequest(t, server.URL+"/api/sessions", http.MethodPost, auth)
+	if status != http.StatusMethodNotAllowed {
+		t.Fatalf("post sessions expect 405,got %v", status)
+	}
+
+	//id and user must both match
+	status, _ = adminRequest(t, server.URL+"/api/sessions?id="+conns[2].String()+"&user=alice", http.MethodDelete, auth)
+	if status != http.StatusNotFound || conns[2].kicked() {
+		t.Fatalf("kick id of another user expect 404,got %v", status)
+	}
+
+	status, av := adminRequest(t, server.URL+"/api/sessions?id="+conns[2].String(), http.MethodDelete, auth)
+	if status != http.StatusOK || len(av.Get("kicked").AsArray()) != 1 {
+		t.Fatalf("kick by id expect 1 session,got %v %v", status, av.Get("kicked").AsArray())
+	}
+	if conns[0].kicked() || conns[1].kicked() || !conns[2].kicked() {
+		t.Fatal("only the session with id should be kicked out")
+	}
+
+	status, av = adminRequest(t, server.URL+"/api/sessions?user=alice", http.MethodDelete, auth)
+	if status != http.StatusOK || len(av.Get("kicked").AsArray()) != 2 {
+		t.Fatalf("kick by user expect 2 sessions,got %v %v", status, av.Get("kicked").AsArray())
+	}
+	if !conns[0].kicked() || !conns[1].kicked() {
+		t.Fatal("sessions of alice should be kicked out")
+	}
+}
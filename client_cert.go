@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/polevpn/elog"
+	"golang.org/x/crypto/ocsp"
+)
+
+const (
+	CLIENT_CERT_MODE_CERT              = "cert"
+	CLIENT_CERT_MODE_CERT_AND_PASSWORD = "cert_and_password"
+	CLIENT_CERT_USER_CN                = "cn"
+	CLIENT_CERT_USER_EMAIL             = "email"
+	CLIENT_CERT_USER_DNS               = "dns"
+	OCSP_MODE_OFF                      = "off"
+	OCSP_MODE_SOFT                     = "soft"
+	OCSP_MODE_HARD                     = "hard"
+	DEFAULT_OCSP_CACHE_TTL             = 3600
+	DEFAULT_OCSP_TIMEOUT               = 2
+	OCSP_ERROR_CACHE_TTL               = 60
+	OCSP_MAX_RESPONSE_SIZE             = 1 << 20
+)
+
+type crlFile struct {
+	modTime time.Time
+	crl     *x509.RevocationList
+}
+
+type ocspEntry struct {
+	err    error
+	expire time.Time
+}
+
+// ClientCertVerifier verify client certificates against a ca bundle in tls handshake,
+// and reject revoked ones by crl files,which are reloaded when they change,or by ocsp responders of the certificates,
+// ocsp soft mode accepts certificates whose responder is unreachable,
+// go tls server doesn't expose ocsp responses stapled by clients,so the responders are asked online during the handshake
+// instead of checking a staple,answers and failures are cached to keep the handshake fast
+type ClientCertVerifier struct {
+	pool     *x509.CertPool
+	crlFiles map[string]*crlFile
+	ocspMode string
+	ocsp     map[string]*ocspEntry
+	timeout  time.Duration
+	now      func() time.Time
+	mutex    *sync.Mutex
+}
+
+func NewClientCertVerifier(caFile string, crlFiles []string, ocspMode string) (*ClientCertVerifier, error) {
+
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New("client ca has no certificate")
+	}
+
+	if ocspMode == "" {
+		ocspMode = OCSP_MODE_OFF
+	}
+	if ocspMode != OCSP_MODE_OFF && ocspMode != OCSP_MODE_SOFT && ocspMode != OCSP_MODE_HARD {
+		return nil, errors.New("client cert ocsp should be off,soft or hard")
+	}
+
+	cv := &ClientCertVerifier{
+		pool:     pool,
+		crlFiles: make(map[string]*crlFile),
+		ocspMode: ocspMode,
+		ocsp:     make(map[string]*ocspEntry),
+		timeout:  time.Second * DEFAULT_OCSP_TIMEOUT,
+		now:      time.Now,
+		mutex:    &sync.Mutex{},
+	}
+
+	for _, path := range crlFiles {
+		cv.crlFiles[path] = &crlFile{}
+		_, err = cv.getCRL(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return cv, nil
+}
+
+// TLSConfig add client certificate verification to config,require means handshakes without certificate fail
+func (cv *ClientCertVerifier) TLSConfig(config *tls.Config, require bool) *tls.Config {
+	config.ClientCAs = cv.pool
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+	if require {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	config.VerifyConnection = cv.VerifyConnection
+	return config
+}
+
+// getCRL return crl of path,it is parsed again if the file changed,caller must not hold the mutex
+func (cv *ClientCertVerifier) getCRL(path string) (*x509.RevocationList, error) {
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cv.mutex.Lock()
+	cf := cv.crlFiles[path]
+	if cf.crl != nil && cf.modTime.Equal(info.ModTime()) {
+		cv.mutex.Unlock()
+		return cf.crl, nil
+	}
+	cv.mutex.Unlock()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if block, _ := pem.Decode(data); block != nil {
+		data = block.Bytes
+	}
+
+	crl, err := x509.ParseRevocationList(data)
+	if err != nil {
+		return nil, err
+	}
+
+	cv.mutex.Lock()
+	cf.crl = crl
+	cf.modTime = info.ModTime()
+	cv.mutex.Unlock()
+	return crl, nil
+}
+
+func (cv *ClientCertVerifier) checkCRL(cert *x509.Certificate, issuer *x509.Certificate) error {
+
+	for path := range cv.crlFiles {
+
+		crl, err := cv.getCRL(path)
+		if err != nil {
+			//keep using the crl loaded before
+			elog.Error("load crl ", path, " fail,", err)
+			cv.mutex.Lock()
+			crl = cv.crlFiles[path].crl
+			cv.mutex.Unlock()
+		}
+
+		if crl == nil || !bytes.Equal(crl.RawIssuer, cert.RawIssuer) {
+			continue
+		}
+
+		if err = crl.CheckSignatureFrom(issuer); err != nil {
+			return errors.New("invalid crl signature of " + path)
+		}
+
+		for _, entry := range crl.RevokedCertificateEntries {
+			if entry.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+				return errors.New("client certificate " + cert.SerialNumber.String() + " is revoked")
+			}
+		}
+	}
+	return nil
+}
+
+func (cv *ClientCertVerifier) queryOCSP(cert *x509.Certificate, issuer *x509.Certificate) (*ocsp.Response, error) {
+
+	if len(cert.OCSPServer) == 0 {
+		return nil, errors.New("client certificate has no ocsp server")
+	}
+
+	req, err := ocsp.CreateRequest(cert, issuer, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cv.timeout)
+	defer cancel()
+
+	hreq, err := http.NewRequestWithContext(ctx, http.MethodPost, cert.OCSPServer[0], bytes.NewReader(req))
+	if err != nil {
+		return nil, err
+	}
+	hreq.Header.Set("Content-Type", "application/ocsp-request")
+
+	resp, err := http.DefaultClient.Do(hreq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("ocsp responder return status " + resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, OCSP_MAX_RESPONSE_SIZE))
+	if err != nil {
+		return nil, err
+	}
+
+	return ocsp.ParseResponseForCert(data, cert, issuer)
+}
+
+// checkOCSP ask ocsp responder of cert,answers are cached until their next update,failures for OCSP_ERROR_CACHE_TTL,
+// so an unreachable responder delays a handshake of the certificate once in a while instead of every one
+func (cv *ClientCertVerifier) checkOCSP(cert *x509.Certificate, issuer *x509.Certificate) error {
+
+	key := string(cert.RawIssuer) + cert.SerialNumber.String()
+	now := cv.now()
+
+	cv.mutex.Lock()
+	entry, ok := cv.ocsp[key]
+	cv.mutex.Unlock()
+
+	if !ok || now.After(entry.expire) {
+		entry = cv.newOCSPEntry(cert, issuer, now)
+		cv.mutex.Lock()
+		cv.ocsp[key] = entry
+		cv.mutex.Unlock()
+	}
+	return entry.err
+}
+
+func (cv *ClientCertVerifier) newOCSPEntry(cert *x509.Certificate, issuer *x509.Certificate, now time.Time) *ocspEntry {
+
+	resp, err := cv.queryOCSP(cert, issuer)
+	if err != nil {
+		elog.Error("query ocsp of client certificate ", cert.SerialNumber.String(), " fail,", err)
+		entry := &ocspEntry{expire: now.Add(time.Second * OCSP_ERROR_CACHE_TTL)}
+		if cv.ocspMode == OCSP_MODE_HARD {
+			entry.err = err
+		}
+		return entry
+	}
+
+	entry := &ocspEntry{expire: resp.NextUpdate}
+	if resp.NextUpdate.IsZero() {
+		entry.expire = now.Add(time.Second * DEFAULT_OCSP_CACHE_TTL)
+	}
+	if resp.Status == ocsp.Revoked {
+		entry.err = errors.New("client certificate " + cert.SerialNumber.String() + " is revoked")
+	} else if resp.Status != ocsp.Good {
+		entry.err = errors.New("client certificate " + cert.SerialNumber.String() + " status unknown")
+	}
+	return entry
+}
+
+// VerifyConnection check revocation of the verified client certificate chain
+func (cv *ClientCertVerifier) VerifyConnection(cs tls.ConnectionState) error {
+
+	if len(cs.VerifiedChains) == 0 || len(cs.VerifiedChains[0]) < 2 {
+		return nil
+	}
+
+	chain := cs.VerifiedChains[0]
+	for i := 0; i < len(chain)-1; i++ {
+
+		err := cv.checkCRL(chain[i], chain[i+1])
+		if err != nil {
+			return err
+		}
+
+		if cv.ocspMode != OCSP_MODE_OFF {
+			err = cv.checkOCSP(chain[i], chain[i+1])
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ClientCertUser map certificate to user name by the common name,the first email or the first dns name,
+// organizational units of the subject are its groups
+func ClientCertUser(cert *x509.Certificate, from string) (string, *UserPolicy) {
+
+	var user string
+	switch from {
+	case "", CLIENT_CERT_USER_CN:
+		user = cert.Subject.CommonName
+	case CLIENT_CERT_USER_EMAIL:
+		if len(cert.EmailAddresses) > 0 {
+			user = cert.EmailAddresses[0]
+		}
+	case CLIENT_CERT_USER_DNS:
+		if len(cert.DNSNames) > 0 {
+			user = cert.DNSNames[0]
+		}
+	}
+
+	groups := make([]string, 0, len(cert.Subject.OrganizationalUnit))
+	for _, ou := range cert.Subject.OrganizationalUnit {
+		if ou = strings.TrimSpace(ou); ou != "" {
+			groups = append(groups, ou)
+		}
+	}
+
+	return user, &UserPolicy{Groups: groups}
+}
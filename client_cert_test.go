@@ -0,0 +1,386 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/quic-go/quic-go"
+	"golang.org/x/crypto/ocsp"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "polevpn test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key}
+}
+
+// issue sign a client certificate of cn with serial
+func (ca *testCA) issue(t *testing.T, serial int64, cn string, ou string) tls.Certificate {
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:   big.NewInt(serial),
+		Subject:        pkix.Name{CommonName: cn, OrganizationalUnit: []string{ou}},
+		EmailAddresses: []string{cn + "@example.com"},
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(time.Hour),
+		KeyUsage:       x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func (ca *testCA) writeFile(t *testing.T) string {
+	caFile := filepath.Join(t.TempDir(), "ca.crt")
+	os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0600)
+	return caFile
+}
+
+func TestClientCertUser(t *testing.T) {
+
+	ca := newTestCA(t)
+	cert := ca.issue(t, 2, "sensor1", "iot").Leaf
+
+	user, policy := ClientCertUser(cert, CLIENT_CERT_USER_CN)
+	if user != "sensor1" || len(policy.Groups) != 1 || policy.Groups[0] != "iot" {
+		t.Fatalf("unexpected user %v,policy %+v", user, policy)
+	}
+	if user, _ = ClientCertUser(cert, CLIENT_CERT_USER_EMAIL); user != "sensor1@example.com" {
+		t.Fatalf("unexpected user %v", user)
+	}
+	if user, _ = ClientCertUser(cert, CLIENT_CERT_USER_DNS); user != "" {
+		t.Fatalf("unexpected user %v", user)
+	}
+}
+
+func TestClientCertLogin(t *testing.T) {
+
+	hs, connmgr, certFile, keyFile := newTestHttpServer(t)
+	dir := t.TempDir()
+
+	ca := newTestCA(t)
+	sensor := ca.issue(t, 2, "sensor1", "iot")
+	revoked := ca.issue(t, 3, "sensor2", "iot")
+	alice := ca.issue(t, 4, "alice", "dev")
+
+	caFile := ca.writeFile(t)
+
+	crl, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    big.NewInt(1),
+		ThisUpdate:                time.Now(),
+		NextUpdate:                time.Now().Add(time.Hour),
+		RevokedCertificateEntries: []x509.RevocationListEntry{{SerialNumber: big.NewInt(3), RevocationTime: time.Now()}},
+	}, ca.cert, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crlFile := filepath.Join(dir, "ca.crl")
+	os.WriteFile(crlFile, crl, 0600)
+
+	cv, err := NewClientCertVerifier(caFile, []string{crlFile}, OCSP_MODE_OFF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs.SetClientCertVerifier(cv)
+	Config().Set("auth.client_cert.mode", CLIENT_CERT_MODE_CERT)
+
+	addr := freeAddr(t, "tcp")
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go hs.ListenTLS(wg, addr, certFile, keyFile)
+	defer func() {
+		hs.Shutdown(context.Background())
+		hs.Close()
+		wg.Wait()
+	}()
+
+	dial := func(cert tls.Certificate, header http.Header) (*websocket.Conn, *http.Response, error) {
+		dialer := &websocket.Dialer{TLSClientConfig: &tls.Config{InsecureSkipVerify: true, Certificates: []tls.Certificate{cert}}}
+		return dialer.Dial("wss://"+addr+"/?deviceId=device1", header)
+	}
+
+	for i := 0; i < 50; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+
+	//certificate alone logs in the user of its common name
+	conn, _, err := dial(sensor, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	connOfUser := func(user string) Conn {
+		for i := 0; i < 50; i++ {
+			for _, c := range connmgr.GetConns() {
+				if connmgr.GetConnAttachUser(c) == user {
+					return c
+				}
+			}
+			time.Sleep(time.Millisecond * 20)
+		}
+		t.Fatalf("conn of %v not found", user)
+		return nil
+	}
+
+	if groups := connmgr.GetConnGroups(connOfUser("sensor1")); len(groups) != 1 || groups[0] != "iot" {
+		t.Fatalf("unexpected groups %v", groups)
+	}
+
+	//revoked certificate fails handshake
+	if conn, _, err := dial(revoked, nil); err == nil {
+		conn.Close()
+		t.Fatal("revoked certificate should be rejected")
+	}
+
+	//password login must be of the certificate user in cert_and_password mode
+	Config().Set("auth.client_cert.mode", CLIENT_CERT_MODE_CERT_AND_PASSWORD)
+	header := http.Header{"Authorization": []string{"Basic " + base64.StdEncoding.EncodeToString([]byte("alice:123456"))}}
+
+	if _, resp, _ := dial(sensor, header); resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatal("password of other user should be rejected")
+	}
+
+	conn, _, err = dial(alice, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	if hs.quicServer.TLSConfig.ClientCAs == nil {
+		t.Fatal("h3 should verify client certificates too")
+	}
+}
+
+func TestClientCertTunnel(t *testing.T) {
+
+	hs, connmgr, certFile, keyFile := newTestHttpServer(t)
+
+	ca := newTestCA(t)
+	sensor := ca.issue(t, 2, "sensor1", "iot")
+
+	cv, err := NewClientCertVerifier(ca.writeFile(t), nil, OCSP_MODE_OFF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs.SetClientCertVerifier(cv)
+	Config().Set("auth.client_cert.required", true)
+
+	tlsAddr := freeAddr(t, "tcp")
+	quicAddr := freeAddr(t, "udp")
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+	go hs.ListenRawTLS(wg, tlsAddr, certFile, keyFile)
+	go hs.ListenQuic(wg, quicAddr, certFile, keyFile)
+	defer func() {
+		hs.Shutdown(context.Background())
+		hs.Close()
+		wg.Wait()
+	}()
+
+	for i := 0; i < 50; i++ {
+		conn, err := net.Dial("tcp", tlsAddr)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+
+	//password alone can't skip the required certificate on raw tls
+	conn, err := tls.Dial("tcp", tlsAddr, &tls.Config{InsecureSkipVerify: true})
+	if err == nil {
+		conn.Write(authPacket("alice", "123456"))
+		if _, err = ReadPacket(conn); err == nil {
+			t.Fatal("raw tls without client certificate should be rejected")
+		}
+		conn.Close()
+	}
+
+	//certificate alone logs in on raw tls
+	conn, err = tls.Dial("tcp", tlsAddr, &tls.Config{InsecureSkipVerify: true, Certificates: []tls.Certificate{sensor}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write(authPacket("", ""))
+	pkt, err := ReadPacket(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkAuthResp(t, pkt, 200)
+
+	conns := connmgr.GetConns()
+	if len(conns) != 1 || connmgr.GetConnAttachUser(conns[0]) != "sensor1" {
+		t.Fatalf("unexpected conns %v", conns)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	dialQuic := func(certs []tls.Certificate) (quic.Connection, error) {
+		qconn, err := quic.DialAddr(ctx, quicAddr,
+			&tls.Config{InsecureSkipVerify: true, NextProtos: []string{QUIC_ALPN}, Certificates: certs},
+			&quic.Config{EnableDatagrams: true},
+		)
+		if err != nil {
+			return nil, err
+		}
+		//server rejects the certificate after the client finished its handshake
+		stream, err := qconn.OpenStreamSync(ctx)
+		if err == nil {
+			stream.Write(authPacket("alice", "123456"))
+			_, err = ReadPacket(stream)
+		}
+		if err != nil {
+			qconn.CloseWithError(0, "")
+			return nil, err
+		}
+		return qconn, nil
+	}
+
+	if qconn, err := dialQuic(nil); err == nil {
+		qconn.CloseWithError(0, "")
+		t.Fatal("quic without client certificate should be rejected")
+	}
+
+	qconn, err := dialQuic([]tls.Certificate{sensor})
+	if err != nil {
+		t.Fatal(err)
+	}
+	qconn.CloseWithError(0, "")
+}
+
+func TestClientCertOCSP(t *testing.T) {
+
+	ca := newTestCA(t)
+	leaf := ca.issue(t, 5, "alice", "dev").Leaf
+
+	const (
+		good = iota
+		revoked
+		fail
+		slow
+	)
+	behavior := &atomic.Int32{}
+	hits := &atomic.Int32{}
+
+	responder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		status := ocsp.Good
+		switch behavior.Load() {
+		case revoked:
+			status = ocsp.Revoked
+		case fail:
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		case slow:
+			time.Sleep(time.Second)
+			return
+		}
+		resp, _ := ocsp.CreateResponse(ca.cert, ca.cert, ocsp.Response{
+			Status:       status,
+			SerialNumber: leaf.SerialNumber,
+			ThisUpdate:   time.Now(),
+			NextUpdate:   time.Now().Add(time.Hour),
+			RevokedAt:    time.Now(),
+		}, ca.key)
+		w.Write(resp)
+	}))
+	defer responder.Close()
+	leaf.OCSPServer = []string{responder.URL}
+
+	newVerifier := func(mode string) *ClientCertVerifier {
+		cv, err := NewClientCertVerifier(ca.writeFile(t), nil, mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cv.timeout = time.Millisecond * 200
+		return cv
+	}
+
+	check := func(cv *ClientCertVerifier, ok bool, queries int32) {
+		t.Helper()
+		err := cv.checkOCSP(leaf, ca.cert)
+		if (err == nil) != ok || hits.Load() != queries {
+			t.Fatalf("expect ok %v after %v queries,got %v after %v", ok, queries, err, hits.Load())
+		}
+	}
+
+	//answers are cached until next update
+	cv := newVerifier(OCSP_MODE_HARD)
+	check(cv, true, 1)
+	check(cv, true, 1)
+
+	//failures are cached too,so a bad responder doesn't stall every handshake
+	later := time.Now().Add(time.Hour * 2)
+	cv.now = func() time.Time { return later }
+	behavior.Store(fail)
+	check(cv, false, 2)
+	check(cv, false, 2)
+
+	later = later.Add(time.Second * (OCSP_ERROR_CACHE_TTL + 1))
+	behavior.Store(slow)
+	start := time.Now()
+	check(cv, false, 3)
+	if time.Since(start) > time.Second {
+		t.Fatalf("slow responder should time out,took %v", time.Since(start))
+	}
+
+	//soft mode accepts certificates whose responder fails
+	check(newVerifier(OCSP_MODE_SOFT), true, 4)
+
+	behavior.Store(revoked)
+	cv = newVerifier(OCSP_MODE_HARD)
+	check(cv, false, 5)
+	check(cv, false, 5)
+}
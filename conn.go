@@ -1,10 +1,18 @@
 package main
 
+import "time"
+
 type Conn interface {
 	Read()
 	Write()
 	Send([]byte)
 	Close(bool) error
+	Shutdown(time.Duration) error
 	IsClosed() bool
 	String() string
+	Transport() string
+	RemoteAddr() string
+	ConnectTime() time.Time
+	UpStreamBytes() uint64
+	DownStreamBytes() uint64
 }
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -10,6 +12,7 @@ import (
 const (
 	CONNECTION_TIMEOUT    = 1
 	CHECK_TIMEOUT_INTEVAL = 5
+	KICK_OUT_CLOSE_DELAY  = 1
 )
 
 type ConnMgr struct {
@@ -18,6 +21,9 @@ type ConnMgr struct {
 	ip2actives  map[string]time.Time
 	ip2users    map[string]string
 	conn2users  map[string]string
+	policies    map[string]*UserPolicy
+	devices     map[string]string
+	conns       map[string]Conn
 	mutex       *sync.RWMutex
 	addresspool *AddressPool
 }
@@ -30,6 +36,9 @@ func NewConnMgr() *ConnMgr {
 		ip2actives: make(map[string]time.Time),
 		ip2users:   make(map[string]string),
 		conn2users: make(map[string]string),
+		policies:   make(map[string]*UserPolicy),
+		devices:    make(map[string]string),
+		conns:      make(map[string]Conn),
 	}
 	go cm.CheckTimeout()
 	return cm
@@ -37,27 +46,30 @@ func NewConnMgr() *ConnMgr {
 
 func (cm *ConnMgr) CheckTimeout() {
 	for range time.NewTicker(time.Second * CHECK_TIMEOUT_INTEVAL).C {
-		timeNow := time.Now()
-		iplist := make([]string, 0)
-		cm.mutex.RLock()
-		for ip, lastActive := range cm.ip2actives {
-			if timeNow.Sub(lastActive) > time.Minute*CONNECTION_TIMEOUT {
-				iplist = append(iplist, ip)
-
-			}
-		}
-		cm.mutex.RUnlock()
+		cm.checkTimeout(time.Now())
+	}
+}
+
+// checkTimeout release addresses inactive for CONNECTION_TIMEOUT,conns still holding them are closed
+// by the close event of the session,so they are accounted like other closed ones
+func (cm *ConnMgr) checkTimeout(timeNow time.Time) {
+
+	iplist := make([]string, 0)
+	cm.mutex.RLock()
+	for ip, lastActive := range cm.ip2actives {
+		if timeNow.Sub(lastActive) > time.Minute*CONNECTION_TIMEOUT {
+			iplist = append(iplist, ip)
 
-		for _, ip := range iplist {
-			cm.RelelaseAddress(ip)
-			conn := cm.GetConnByIP(ip)
-			if conn != nil {
-				cm.DetachIPAddressFromConn(conn)
-				cm.DetachUserFromConn(conn)
-				conn.Close(false)
-			}
 		}
+	}
+	cm.mutex.RUnlock()
 
+	for _, ip := range iplist {
+		conn := cm.GetConnByIP(ip)
+		if conn != nil {
+			conn.Close(true)
+		}
+		cm.RelelaseAddress(ip)
 	}
 }
 
@@ -182,6 +194,23 @@ func (cm *ConnMgr) GetBindIP(user string) string {
 	return cm.addresspool.GetBindIP(user)
 }
 
+func (cm *ConnMgr) SetBindIPs(bindips map[string]string) {
+
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	if cm.addresspool == nil {
+		return
+	}
+
+	for _, ip := range cm.addresspool.SetBindIPs(bindips) {
+		_, active := cm.ip2actives[ip]
+		if !active {
+			cm.addresspool.Release(ip)
+		}
+	}
+}
+
 func (cm *ConnMgr) UpdateConnActiveTime(conn Conn) {
 
 	cm.mutex.Lock()
@@ -227,12 +256,16 @@ func (cm *ConnMgr) AttachUserToConn(user string, conn Conn) {
 	cm.mutex.Lock()
 	defer cm.mutex.Unlock()
 	cm.conn2users[conn.String()] = user
+	cm.conns[conn.String()] = conn
 }
 
 func (cm *ConnMgr) DetachUserFromConn(conn Conn) {
 	cm.mutex.Lock()
 	defer cm.mutex.Unlock()
 	delete(cm.conn2users, conn.String())
+	delete(cm.policies, conn.String())
+	delete(cm.devices, conn.String())
+	delete(cm.conns, conn.String())
 }
 
 func (cm *ConnMgr) GetConnAttachUser(conn Conn) string {
@@ -241,6 +274,77 @@ func (cm *ConnMgr) GetConnAttachUser(conn Conn) string {
 	return cm.conn2users[conn.String()]
 }
 
+func (cm *ConnMgr) AttachPolicyToConn(policy *UserPolicy, conn Conn) {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+	cm.policies[conn.String()] = policy
+}
+
+func (cm *ConnMgr) GetConnPolicy(conn Conn) *UserPolicy {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+	return cm.policies[conn.String()]
+}
+
+func (cm *ConnMgr) AttachDeviceToConn(deviceId string, conn Conn) {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+	cm.devices[conn.String()] = deviceId
+}
+
+func (cm *ConnMgr) GetConnDevice(conn Conn) string {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+	return cm.devices[conn.String()]
+}
+
+// GetConnsByName return conns whose user or device id equals name,case insensitive,sorted by address
+func (cm *ConnMgr) GetConnsByName(name string) []Conn {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+
+	conns := make([]Conn, 0)
+	for _, conn := range cm.ip2conns {
+		if strings.EqualFold(cm.conn2users[conn.String()], name) || strings.EqualFold(cm.devices[conn.String()], name) {
+			conns = append(conns, conn)
+		}
+	}
+	sort.Slice(conns, func(i, j int) bool {
+		return cm.conn2ips[conns[i].String()] < cm.conn2ips[conns[j].String()]
+	})
+	return conns
+}
+
+// GetConnGroups return the groups auth backend assigned to the user of conn
+func (cm *ConnMgr) GetConnGroups(conn Conn) []string {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+	policy := cm.policies[conn.String()]
+	if policy == nil {
+		return nil
+	}
+	return policy.Groups
+}
+
+// GetUserConnCount return how many sessions user have,the conn attached to excludeIP is not counted
+// because it will be replaced by the reconnecting one
+func (cm *ConnMgr) GetUserConnCount(user string, excludeIP string) int {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+
+	count := 0
+	for id, u := range cm.conn2users {
+		if u != user {
+			continue
+		}
+		if excludeIP != "" && cm.conn2ips[id] == excludeIP {
+			continue
+		}
+		count++
+	}
+	return count
+}
+
 func (cm *ConnMgr) AttachUserToIP(user string, ip string) {
 	cm.mutex.Lock()
 	defer cm.mutex.Unlock()
@@ -265,8 +369,89 @@ func (cm *ConnMgr) GetConnByIP(ip string) Conn {
 	return cm.ip2conns[ip]
 }
 
+func (cm *ConnMgr) GetConnByIP6(ip6 string) Conn {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+
+	if cm.addresspool == nil {
+		return nil
+	}
+
+	ip := cm.addresspool.GetIPv4(ip6)
+	if ip == "" {
+		return nil
+	}
+	return cm.ip2conns[ip]
+}
+
+func (cm *ConnMgr) GetIPv6Address(ip string) string {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+
+	if cm.addresspool == nil {
+		return ""
+	}
+	return cm.addresspool.GetIPv6(ip)
+}
+
 func (cm *ConnMgr) GeIPByConn(conn Conn) string {
 	cm.mutex.RLock()
 	defer cm.mutex.RUnlock()
 	return cm.conn2ips[conn.String()]
 }
+
+func (cm *ConnMgr) GetConns() []Conn {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+	conns := make([]Conn, 0, len(cm.conns))
+	for _, conn := range cm.conns {
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+func (cm *ConnMgr) GetConnByString(id string) Conn {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+	return cm.conns[id]
+}
+
+// GetAddressPoolStats return total and used address count of address pool
+func (cm *ConnMgr) GetAddressPoolStats() (int, int) {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+
+	if cm.addresspool == nil {
+		return 0, 0
+	}
+	return cm.addresspool.Size(), cm.addresspool.Used()
+}
+
+func (cm *ConnMgr) GetAddressPool() *AddressPool {
+	return cm.addresspool
+}
+
+// KickOut notify the client with CMD_KICK_OUT,close the connection and release its address,
+// the conn is detached by the close event of the session,so it is accounted like other closed ones
+func (cm *ConnMgr) KickOut(conn Conn) {
+
+	buf := make([]byte, POLE_PACKET_HEADER_LEN)
+	pkt := PolePacket(buf)
+	pkt.SetLen(POLE_PACKET_HEADER_LEN)
+	pkt.SetCmd(CMD_KICK_OUT)
+	conn.Send(pkt)
+
+	ip := cm.GeIPByConn(conn)
+
+	//give the write process a chance to flush kick out packet
+	time.AfterFunc(time.Second*KICK_OUT_CLOSE_DELAY, func() {
+		conn.Close(true)
+		if ip == "" {
+			return
+		}
+		//the address may have been taken by another conn during the delay
+		if sconn := cm.GetConnByIP(ip); sconn == nil || sconn.String() == conn.String() {
+			cm.RelelaseAddress(ip)
+		}
+	})
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestKickOut(t *testing.T) {
+
+	addresspool, _ := NewAddressPool("10.8.0.0/24", map[string]string{})
+	connmgr := NewConnMgr()
+	connmgr.SetAddressPool(addresspool)
+
+	s, mt, rh := newTestSession(0, 0)
+	go s.Read()
+	go s.Write()
+
+	connmgr.AttachUserToConn("alice", s)
+	ip := connmgr.AllocAddress(s)
+	connmgr.AttachIPAddressToConn(ip, s)
+
+	connmgr.KickOut(s)
+
+	if PolePacket(receive(t, mt.out)).Cmd() != CMD_KICK_OUT {
+		t.Fatal("client should be told kick out")
+	}
+
+	//kicked session goes through the same close event as a disconnect
+	select {
+	case conn := <-rh.closed:
+		if conn != s {
+			t.Fatal("unexpected closed conn")
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatal("close event of kicked session missing")
+	}
+
+	for i := 0; connmgr.IsAllocedAddress(ip); i++ {
+		if i == 50 {
+			t.Fatal("address of kicked session should be released")
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+
+	select {
+	case <-rh.closed:
+		t.Fatal("close event should be sent once")
+	case <-time.After(time.Millisecond * 100):
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/polevpn/elog"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	CREDENTIAL_CHECK_INTERVAL = 5
+	ARGON2_TIME               = 3
+	ARGON2_MEMORY             = 64 * 1024
+	ARGON2_THREADS            = 4
+	ARGON2_KEY_LEN            = 32
+	ARGON2_SALT_LEN           = 16
+)
+
+// dummyPasswordHash is compared for unknown users,so they take as long as wrong passwords of known ones,
+// it uses the default algorithm of passwd command
+var dummyPasswordHash = sync.OnceValue(func() string {
+	hash, err := HashPassword("bcrypt", "dummy")
+	if err != nil {
+		elog.Error("hash dummy password fail,", err)
+	}
+	return hash
+})
+
+// CredentialFile keep the parsed credential file in memory and reload it when it changes
+type CredentialFile struct {
+	path    string
+	hashed  bool
+	users   map[string][]string
+	modTime time.Time
+	size    int64
+	mutex   *sync.RWMutex
+	done    chan struct{}
+}
+
+func NewCredentialFile(path string) (*CredentialFile, error) {
+	return newCredentialFile(path, true)
+}
+
+// NewSecretFile load lines of user,secret whose secrets are plaintext,like totp secrets
+func NewSecretFile(path string) (*CredentialFile, error) {
+	return newCredentialFile(path, false)
+}
+
+func newCredentialFile(path string, hashed bool) (*CredentialFile, error) {
+
+	cf := &CredentialFile{
+		path:   path,
+		hashed: hashed,
+		users:  make(map[string][]string),
+		mutex:  &sync.RWMutex{},
+		done:   make(chan struct{}),
+	}
+
+	err := cf.load()
+	if err != nil {
+		return nil, err
+	}
+
+	go cf.watch()
+	return cf, nil
+}
+
+func (cf *CredentialFile) Path() string {
+	return cf.path
+}
+
+func (cf *CredentialFile) Close() {
+	close(cf.done)
+}
+
+func (cf *CredentialFile) load() error {
+
+	f, err := os.Open(cf.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	users, err := ReadCredentials(f)
+	if err != nil {
+		return err
+	}
+
+	for user, fields := range users {
+		if cf.hashed && !IsPasswordHash(fields[1]) {
+			elog.Infof("user %v password in %v is not hashed", user, cf.path)
+		}
+	}
+
+	cf.mutex.Lock()
+	defer cf.mutex.Unlock()
+	cf.users = users
+	cf.modTime = fi.ModTime()
+	cf.size = fi.Size()
+	return nil
+}
+
+func (cf *CredentialFile) watch() {
+
+	ticker := time.NewTicker(time.Second * CREDENTIAL_CHECK_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-cf.done:
+			return
+		case <-ticker.C:
+		}
+
+		fi, err := os.Stat(cf.path)
+		if err != nil {
+			elog.Error("stat credential file fail,", err)
+			continue
+		}
+
+		cf.mutex.RLock()
+		changed := !fi.ModTime().Equal(cf.modTime) || fi.Size() != cf.size
+		cf.mutex.RUnlock()
+
+		if !changed {
+			continue
+		}
+
+		err = cf.load()
+		if err != nil {
+			elog.Error("reload credential file fail,", err)
+			continue
+		}
+		elog.Infof("credential file %v reloaded", cf.path)
+	}
+}
+
+// Verify check password of user,return the policy in the columns after password
+func (cf *CredentialFile) Verify(user string, pwd string) (*UserPolicy, error) {
+
+	cf.mutex.RLock()
+	fields, ok := cf.users[user]
+	cf.mutex.RUnlock()
+
+	if !ok {
+		ComparePassword(dummyPasswordHash(), pwd)
+		return nil, errors.New("user or password incorrect")
+	}
+
+	if !ComparePassword(fields[1], pwd) {
+		return nil, errors.New("user or password incorrect")
+	}
+	return NewUserPolicyFromFields(fields[2:]), nil
+}
+
+// Lookup return the second column of user,empty if user not exist
+func (cf *CredentialFile) Lookup(user string) string {
+
+	cf.mutex.RLock()
+	defer cf.mutex.RUnlock()
+
+	fields, ok := cf.users[user]
+	if !ok {
+		return ""
+	}
+	return fields[1]
+}
+
+// ReadCredentials parse lines of user,password[,extra columns],the password may be plaintext,bcrypt or argon2id hash
+func ReadCredentials(r io.Reader) (map[string][]string, error) {
+
+	users := make(map[string][]string)
+
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		fields := SplitCredentialLine(strings.Trim(line, "\n\r"))
+		if len(fields) >= 2 && fields[0] != "" {
+			users[fields[0]] = fields
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	return users, nil
+}
+
+// SplitCredentialLine split line by comma,commas inside argon2 parameters(m=65536,t=3,p=4) don't split
+func SplitCredentialLine(line string) []string {
+
+	fields := make([]string, 0)
+	start := 0
+	segment := 0
+
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case '$':
+			segment = i + 1
+		case ',':
+			if segment > start && strings.HasPrefix(line[start:], "$argon2") && strings.HasPrefix(line[segment:], "m=") {
+				continue
+			}
+			fields = append(fields, line[start:i])
+			start = i + 1
+			segment = start
+		}
+	}
+	return append(fields, line[start:])
+}
+
+func IsPasswordHash(hash string) bool {
+	return strings.HasPrefix(hash, "$2") || strings.HasPrefix(hash, "$argon2id$")
+}
+
+func HashPassword(algo string, pwd string) (string, error) {
+
+	switch algo {
+	case "bcrypt":
+		hash, err := bcrypt.GenerateFromPassword([]byte(pwd), bcrypt.DefaultCost)
+		if err != nil {
+			return "", err
+		}
+		return string(hash), nil
+	case "argon2id":
+		salt := make([]byte, ARGON2_SALT_LEN)
+		_, err := rand.Read(salt)
+		if err != nil {
+			return "", err
+		}
+		key := argon2.IDKey([]byte(pwd), salt, ARGON2_TIME, ARGON2_MEMORY, ARGON2_THREADS, ARGON2_KEY_LEN)
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, ARGON2_MEMORY, ARGON2_TIME, ARGON2_THREADS,
+			base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+	default:
+		return "", errors.New("unsupported hash algorithm " + algo)
+	}
+}
+
+func ComparePassword(hash string, pwd string) bool {
+
+	if strings.HasPrefix(hash, "$2") {
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(pwd)) == nil
+	}
+
+	if strings.HasPrefix(hash, "$argon2id$") {
+		return compareArgon2id(hash, pwd)
+	}
+
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(pwd)) == 1
+}
+
+// $argon2id$v=19$m=65536,t=3,p=4$salt$key
+func compareArgon2id(hash string, pwd string) bool {
+
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return false
+	}
+
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return false
+	}
+
+	var memory, time uint32
+	var threads uint8
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads)
+	if err != nil || time == 0 || threads == 0 {
+		return false
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return false
+	}
+
+	pkey := argon2.IDKey([]byte(pwd), salt, time, memory, threads, uint32(len(key)))
+
+	return subtle.ConstantTimeCompare(key, pkey) == 1
+}
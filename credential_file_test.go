@@ -0,0 +1,56 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReadCredentials(t *testing.T) {
+
+	bcryptHash, err := HashPassword("bcrypt", "test12345")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	argon2Hash, err := HashPassword("argon2id", "test12345")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := "test,test12345\n" + "test2," + bcryptHash + "\r\n" + "test3," + argon2Hash + ",extra\n" + "invalid\n"
+
+	users, err := ReadCredentials(strings.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(users) != 3 {
+		t.Fatal("expect 3 users,got ", len(users))
+	}
+
+	if len(users["test3"]) != 3 || users["test3"][1] != argon2Hash {
+		t.Fatal("argon2id hash split fail,", users["test3"])
+	}
+
+	for _, user := range []string{"test", "test2", "test3"} {
+		if !ComparePassword(users[user][1], "test12345") {
+			t.Fatal(user, " compare password fail")
+		}
+		if ComparePassword(users[user][1], "test123456") {
+			t.Fatal(user, " compare wrong password success")
+		}
+	}
+}
+
+func TestCompareArgon2idInvalidParams(t *testing.T) {
+
+	//argon2 panics with zero time or threads,such hashes never match
+	for _, hash := range []string{
+		"$argon2id$v=19$m=65536,t=0,p=4$c2FsdHNhbHRzYWx0c2FsdA$a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2U",
+		"$argon2id$v=19$m=65536,t=3,p=0$c2FsdHNhbHRzYWx0c2FsdA$a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2U",
+	} {
+		if ComparePassword(hash, "test12345") {
+			t.Fatal("hash with invalid params should not match,", hash)
+		}
+	}
+}
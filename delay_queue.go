@@ -0,0 +1,90 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DelayQueue forward packets to out in the order they are pushed,packets which have to wait for rate limit tokens
+// are held by the queue's own goroutine,so the goroutine pushing them never blocks
+type DelayQueue struct {
+	ch      chan delayedPacket
+	out     func(pkt []byte)
+	pending atomic.Int32
+	closed  bool
+	done    chan struct{}
+	mutex   *sync.Mutex
+}
+
+type delayedPacket struct {
+	pkt []byte
+	due time.Time
+}
+
+// NewDelayQueue create a queue holding at most size delayed packets,Run must be called to forward them
+func NewDelayQueue(size int, out func(pkt []byte)) *DelayQueue {
+	return &DelayQueue{
+		ch:    make(chan delayedPacket, size),
+		out:   out,
+		done:  make(chan struct{}),
+		mutex: &sync.Mutex{},
+	}
+}
+
+// Push forward pkt at once if nothing is held,else queue it to be forwarded after wait,
+// false means the queue is full or closed and pkt is dropped,it is called from a single goroutine
+func (dq *DelayQueue) Push(pkt []byte, wait time.Duration) bool {
+
+	if wait <= 0 && dq.pending.Load() == 0 {
+		dq.out(pkt)
+		return true
+	}
+
+	dq.mutex.Lock()
+	defer dq.mutex.Unlock()
+
+	if dq.closed {
+		return false
+	}
+
+	dq.pending.Add(1)
+	select {
+	case dq.ch <- delayedPacket{pkt: pkt, due: time.Now().Add(wait)}:
+		return true
+	default:
+		dq.pending.Add(-1)
+		return false
+	}
+}
+
+// Run forward queued packets at their due time until the queue is closed and drained
+func (dq *DelayQueue) Run() {
+
+	defer close(dq.done)
+
+	for dp := range dq.ch {
+		wait := time.Until(dp.due)
+		if wait > 0 {
+			time.Sleep(wait)
+		}
+		dq.out(dp.pkt)
+		dq.pending.Add(-1)
+	}
+}
+
+// Close stop accepting packets,packets already queued are still forwarded
+func (dq *DelayQueue) Close() {
+	dq.mutex.Lock()
+	defer dq.mutex.Unlock()
+	if dq.closed {
+		return
+	}
+	dq.closed = true
+	close(dq.ch)
+}
+
+// Done is closed when Run has forwarded all queued packets after Close
+func (dq *DelayQueue) Done() <-chan struct{} {
+	return dq.done
+}
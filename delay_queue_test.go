@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDelayQueue(t *testing.T) {
+
+	out := make(chan []byte, 10)
+	dq := NewDelayQueue(2, func(pkt []byte) { out <- pkt })
+	go dq.Run()
+
+	//nothing held,forwarded at once
+	if !dq.Push([]byte{1}, 0) || len(out) != 1 {
+		t.Fatal("packet should be forwarded at once")
+	}
+	<-out
+
+	//push doesn't wait for the delay
+	start := time.Now()
+	if !dq.Push([]byte{2}, time.Millisecond*200) {
+		t.Fatal("push delayed packet fail")
+	}
+	//packets without delay queue behind the held one to keep order
+	if !dq.Push([]byte{3}, 0) {
+		t.Fatal("push packet fail")
+	}
+	if time.Since(start) > time.Millisecond*50 {
+		t.Fatalf("push blocked %v", time.Since(start))
+	}
+	if dq.Push([]byte{4}, 0) {
+		t.Fatal("push to a full queue should fail")
+	}
+
+	for _, b := range []byte{2, 3} {
+		pkt := receive(t, out)
+		if pkt[0] != b {
+			t.Fatalf("expected packet %v,got %v", b, pkt[0])
+		}
+	}
+	if time.Since(start) < time.Millisecond*200 {
+		t.Fatalf("packet isn't delayed,took %v", time.Since(start))
+	}
+
+	dq.Close()
+	select {
+	case <-dq.Done():
+	case <-time.After(time.Second):
+		t.Fatal("queue doesn't stop")
+	}
+	if dq.Push([]byte{5}, time.Millisecond) {
+		t.Fatal("push to a closed queue should fail")
+	}
+}
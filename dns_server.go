@@ -0,0 +1,280 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/polevpn/anyvalue"
+	"github.com/polevpn/elog"
+)
+
+const (
+	DEFAULT_DNS_PORT      = 53
+	DEFAULT_DNS_DOMAIN    = "vpn.internal"
+	DEFAULT_DNS_TIMEOUT   = 5
+	DNS_CLIENT_RECORD_TTL = 60
+)
+
+type dnsUpstream struct {
+	suffix  string
+	servers []string
+}
+
+// DNSServer listen on the gateway ip,answer <user>.<domain> and <deviceId>.<domain> with addresses of clients,
+// and forward other queries to upstreams chosen by the longest matched domain suffix
+type DNSServer struct {
+	connmgr   *ConnMgr
+	allow     func(from Conn, to Conn) bool
+	domain    string
+	upstreams []dnsUpstream
+	timeout   time.Duration
+	servers   []*dns.Server
+	mutex     *sync.RWMutex
+}
+
+func NewDNSServer(connmgr *ConnMgr) *DNSServer {
+	return &DNSServer{connmgr: connmgr, domain: dns.Fqdn(DEFAULT_DNS_DOMAIN), mutex: &sync.RWMutex{}}
+}
+
+// SetClientFilter set the check whether client from can reach client to,names of clients a querier can't reach
+// are answered as nonexistent,so client isolation doesn't leak who is online
+func (ds *DNSServer) SetClientFilter(allow func(from Conn, to Conn) bool) {
+	ds.allow = allow
+}
+
+func normalizeDNSServer(server string) string {
+	if _, _, err := net.SplitHostPort(server); err == nil {
+		return server
+	}
+	return net.JoinHostPort(server, strconv.Itoa(DEFAULT_DNS_PORT))
+}
+
+// Load apply domain,upstreams and split upstreams of dns_server config,
+// upstreams default to the dns config value
+func (ds *DNSServer) Load(config *anyvalue.AnyValue) error {
+
+	av := config.Get("dns_server")
+
+	upstreams := make([]dnsUpstream, 0)
+
+	//suffixes contain dots,so they can't be used in config path
+	for suffix, value := range av.Get("split").AsMap() {
+		servers := anyvalue.NewFromInf(value).AsStrArr()
+		if len(servers) == 0 {
+			return errors.New("split dns " + suffix + " has no upstream")
+		}
+		for i := range servers {
+			servers[i] = normalizeDNSServer(servers[i])
+		}
+		upstreams = append(upstreams, dnsUpstream{suffix: dns.Fqdn(strings.ToLower(suffix)), servers: servers})
+	}
+
+	sort.Slice(upstreams, func(i, j int) bool {
+		return dns.CountLabel(upstreams[i].suffix) > dns.CountLabel(upstreams[j].suffix)
+	})
+
+	servers := av.Get("upstreams").AsStrArr()
+	if len(servers) == 0 && config.Get("dns").AsStr() != "" {
+		servers = []string{config.Get("dns").AsStr()}
+	}
+	if len(servers) == 0 {
+		return errors.New("dns server has no upstream")
+	}
+	for i := range servers {
+		servers[i] = normalizeDNSServer(servers[i])
+	}
+	upstreams = append(upstreams, dnsUpstream{suffix: ".", servers: servers})
+
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+	ds.domain = dns.Fqdn(strings.ToLower(av.Get("domain").AsStr(DEFAULT_DNS_DOMAIN)))
+	ds.upstreams = upstreams
+	ds.timeout = time.Duration(av.Get("timeout").AsInt(DEFAULT_DNS_TIMEOUT)) * time.Second
+	return nil
+}
+
+// Listen serve dns on udp and tcp at addr,it returns when both servers are started
+func (ds *DNSServer) Listen(addr string) error {
+	return ds.start([]*dns.Server{
+		{Addr: addr, Net: "udp", Handler: ds},
+		{Addr: addr, Net: "tcp", Handler: ds},
+	})
+}
+
+// Serve serve dns on the given udp and tcp sockets,it is used when the gateway ip only exists in userspace netstack
+func (ds *DNSServer) Serve(pc net.PacketConn, listener net.Listener) error {
+	return ds.start([]*dns.Server{
+		{PacketConn: pc, Handler: ds},
+		{Listener: listener, Handler: ds},
+	})
+}
+
+func (ds *DNSServer) start(servers []*dns.Server) error {
+
+	for _, server := range servers {
+		started := make(chan error, 1)
+		server.NotifyStartedFunc = func() { started <- nil }
+
+		go func(server *dns.Server) {
+			var err error
+			if server.PacketConn != nil || server.Listener != nil {
+				err = server.ActivateAndServe()
+			} else {
+				err = server.ListenAndServe()
+			}
+			if err != nil {
+				started <- err
+				elog.Error("dns server listen fail,", err)
+			}
+		}(server)
+
+		err := <-started
+		if err != nil {
+			ds.Close()
+			return err
+		}
+		ds.servers = append(ds.servers, server)
+	}
+	return nil
+}
+
+func (ds *DNSServer) Close() {
+	for _, server := range ds.servers {
+		server.Shutdown()
+	}
+	ds.servers = nil
+}
+
+func (ds *DNSServer) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+
+	defer PanicHandler()
+
+	if len(req.Question) != 1 {
+		resp := &dns.Msg{}
+		resp.SetRcode(req, dns.RcodeFormatError)
+		w.WriteMsg(resp)
+		return
+	}
+
+	ds.mutex.RLock()
+	domain := ds.domain
+	ds.mutex.RUnlock()
+
+	q := req.Question[0]
+	name := strings.ToLower(q.Name)
+
+	//the zone apex has no records
+	if name == domain {
+		resp := &dns.Msg{}
+		resp.SetReply(req)
+		resp.Authoritative = true
+		w.WriteMsg(resp)
+		return
+	}
+
+	if dns.IsSubDomain(domain, name) {
+		w.WriteMsg(ds.answerClient(req, strings.TrimSuffix(name, "."+domain), ds.clientConn(w.RemoteAddr())))
+		return
+	}
+
+	resp, err := ds.forward(req, name, w.LocalAddr().Network())
+	if err != nil {
+		elog.Debug("forward dns query ", name, " fail,", err)
+		resp = &dns.Msg{}
+		resp.SetRcode(req, dns.RcodeServerFailure)
+	}
+	w.WriteMsg(resp)
+}
+
+// clientConn return the conn of the client which sent the query,nil if it doesn't come from a client
+func (ds *DNSServer) clientConn(addr net.Addr) Conn {
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil
+	}
+	if ip.To4() != nil {
+		return ds.connmgr.GetConnByIP(ip.To4().String())
+	}
+	return ds.connmgr.GetConnByIP6(ip.String())
+}
+
+// answerClient answer A and AAAA of clients whose user or device id is name,a client always gets its own address,
+// other clients are answered only if the filter allows from to reach them
+func (ds *DNSServer) answerClient(req *dns.Msg, name string, from Conn) *dns.Msg {
+
+	resp := &dns.Msg{}
+	resp.SetReply(req)
+	resp.Authoritative = true
+
+	ips := make([]string, 0)
+	for _, conn := range ds.connmgr.GetConnsByName(name) {
+		if conn == from || ds.allow == nil || ds.allow(from, conn) {
+			ips = append(ips, ds.connmgr.GeIPByConn(conn))
+		}
+	}
+	if len(ips) == 0 {
+		resp.SetRcode(req, dns.RcodeNameError)
+		return resp
+	}
+
+	q := req.Question[0]
+	hdr := dns.RR_Header{Name: q.Name, Class: dns.ClassINET, Ttl: DNS_CLIENT_RECORD_TTL}
+
+	for _, ip := range ips {
+		switch q.Qtype {
+		case dns.TypeA:
+			hdr.Rrtype = dns.TypeA
+			resp.Answer = append(resp.Answer, &dns.A{Hdr: hdr, A: net.ParseIP(ip)})
+		case dns.TypeAAAA:
+			ip6 := ds.connmgr.GetIPv6Address(ip)
+			if ip6 != "" {
+				hdr.Rrtype = dns.TypeAAAA
+				resp.Answer = append(resp.Answer, &dns.AAAA{Hdr: hdr, AAAA: net.ParseIP(ip6)})
+			}
+		}
+	}
+	return resp
+}
+
+func (ds *DNSServer) getUpstreams(name string) []string {
+
+	ds.mutex.RLock()
+	defer ds.mutex.RUnlock()
+
+	for _, upstream := range ds.upstreams {
+		if dns.IsSubDomain(upstream.suffix, name) {
+			return upstream.servers
+		}
+	}
+	return nil
+}
+
+// forward try upstreams of name in order,network is the network the query came from
+func (ds *DNSServer) forward(req *dns.Msg, name string, network string) (*dns.Msg, error) {
+
+	ds.mutex.RLock()
+	client := &dns.Client{Net: network, Timeout: ds.timeout}
+	ds.mutex.RUnlock()
+
+	err := errors.New("no upstream for " + name)
+	for _, server := range ds.getUpstreams(name) {
+		var resp *dns.Msg
+		resp, _, err = client.Exchange(req, server)
+		if err == nil {
+			return resp, nil
+		}
+	}
+	return nil, err
+}
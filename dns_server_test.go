@@ -0,0 +1,152 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/polevpn/anyvalue"
+)
+
+func TestDNSServerAnswerClient(t *testing.T) {
+
+	connmgr := NewConnMgr()
+	conn := &testConn{id: "alice"}
+	connmgr.AttachIPAddressToConn("10.8.0.2", conn)
+	connmgr.AttachUserToConn("alice", conn)
+	connmgr.AttachDeviceToConn("laptop-01", conn)
+
+	ds := NewDNSServer(connmgr)
+	config, _ := anyvalue.NewFromJson([]byte(`{"dns":"8.8.8.8","dns_server":{"split":{"corp.internal":["10.0.0.53"],"a.corp.internal":["10.0.1.53:5353"]}}}`))
+	err := ds.Load(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"alice", "Laptop-01"} {
+		req := &dns.Msg{}
+		req.SetQuestion(name+".vpn.internal.", dns.TypeA)
+		resp := ds.answerClient(req, name, nil)
+		if len(resp.Answer) != 1 || !resp.Answer[0].(*dns.A).A.Equal(net.ParseIP("10.8.0.2")) {
+			t.Fatal("unexpected answer of ", name, resp.Answer)
+		}
+	}
+
+	req := &dns.Msg{}
+	req.SetQuestion("bob.vpn.internal.", dns.TypeA)
+	if ds.answerClient(req, "bob", nil).Rcode != dns.RcodeNameError {
+		t.Fatal("unknown client should be nxdomain")
+	}
+
+	tests := map[string]string{
+		"www.example.com.":   "8.8.8.8:53",
+		"git.corp.internal.": "10.0.0.53:53",
+		"x.a.corp.internal.": "10.0.1.53:5353",
+		"notcorp.internal.":  "8.8.8.8:53",
+	}
+	for name, upstream := range tests {
+		upstreams := ds.getUpstreams(name)
+		if len(upstreams) != 1 || upstreams[0] != upstream {
+			t.Fatalf("expect upstream %v for %v,got %v", upstream, name, upstreams)
+		}
+	}
+}
+
+func TestDNSServerForward(t *testing.T) {
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := &dns.Msg{}
+		resp.SetReply(req)
+		resp.Answer = append(resp.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.ParseIP("1.2.3.4"),
+		})
+		w.WriteMsg(resp)
+	})}
+	go upstream.ActivateAndServe()
+	defer upstream.Shutdown()
+
+	ds := NewDNSServer(NewConnMgr())
+	config := anyvalue.New().Set("dns", pc.LocalAddr().String())
+	err = ds.Load(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := &dns.Msg{}
+	req.SetQuestion("www.example.com.", dns.TypeA)
+	resp, err := ds.forward(req, "www.example.com.", "udp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answer) != 1 || !resp.Answer[0].(*dns.A).A.Equal(net.ParseIP("1.2.3.4")) {
+		t.Fatal("unexpected forward answer", resp.Answer)
+	}
+}
+
+// msgWriter record the reply of ServeDNS to a query from addr
+type msgWriter struct {
+	dns.ResponseWriter
+	addr net.Addr
+	msg  *dns.Msg
+}
+
+func (mw *msgWriter) RemoteAddr() net.Addr {
+	return mw.addr
+}
+
+func (mw *msgWriter) WriteMsg(msg *dns.Msg) error {
+	mw.msg = msg
+	return nil
+}
+
+func TestDNSServerClientIsolation(t *testing.T) {
+
+	connmgr := NewConnMgr()
+	for user, ip := range map[string]string{"alice": "10.8.0.2", "bob": "10.8.0.3"} {
+		conn := &testConn{id: user}
+		connmgr.AttachIPAddressToConn(ip, conn)
+		connmgr.AttachUserToConn(user, conn)
+	}
+
+	handler := NewRequestHandler()
+	handler.SetConnMgr(connmgr)
+	handler.SetRouterMgr(NewRouterMgr())
+
+	ds := NewDNSServer(connmgr)
+	ds.SetClientFilter(handler.allowClientToClient)
+
+	query := func(from string, name string) *dns.Msg {
+		req := &dns.Msg{}
+		req.SetQuestion(name, dns.TypeA)
+		mw := &msgWriter{addr: &net.UDPAddr{IP: net.ParseIP(from), Port: 5353}}
+		ds.ServeDNS(mw, req)
+		return mw.msg
+	}
+
+	handler.SetClientIsolation(CLIENT_ISOLATION_ALL)
+	if resp := query("10.8.0.2", "alice.vpn.internal."); len(resp.Answer) != 1 {
+		t.Fatal("client should resolve its own name,", resp)
+	}
+	if resp := query("10.8.0.2", "bob.vpn.internal."); resp.Rcode != dns.RcodeNameError {
+		t.Fatal("isolated client shouldn't be resolved,", resp)
+	}
+	if resp := query("127.0.0.1", "bob.vpn.internal."); resp.Rcode != dns.RcodeNameError {
+		t.Fatal("query not from a client shouldn't resolve clients,", resp)
+	}
+
+	handler.SetClientIsolation(CLIENT_ISOLATION_NONE)
+	if resp := query("10.8.0.2", "bob.vpn.internal."); len(resp.Answer) != 1 {
+		t.Fatal("client should be resolved without isolation,", resp)
+	}
+
+	//the apex isn't a client name
+	connmgr.AttachUserToConn("vpn.internal.", &testConn{id: "bob"})
+	if resp := query("10.8.0.2", "vpn.internal."); resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 0 || !resp.Authoritative {
+		t.Fatal("unexpected answer of apex,", resp)
+	}
+}
@@ -7,12 +7,18 @@ toolchain go1.23.1
 require (
 	github.com/go-ldap/ldap/v3 v3.4.4
 	github.com/gorilla/websocket v1.5.0
+	github.com/miekg/dns v1.1.62
 	github.com/polevpn/anyvalue v1.0.6
 	github.com/polevpn/elog v1.1.1
 	github.com/polevpn/h3conn v1.0.20
 	github.com/polevpn/netstack v1.10.12
 	github.com/polevpn/water v1.0.4
 	github.com/quic-go/quic-go v0.47.0
+	github.com/vishvananda/netlink v1.3.1
+	golang.org/x/crypto v0.26.0
+	golang.org/x/net v0.28.0
+	golang.org/x/sys v0.23.0
+	golang.org/x/term v0.23.0
 )
 
 require (
@@ -25,17 +31,16 @@ require (
 	github.com/onsi/ginkgo/v2 v2.9.5 // indirect
 	github.com/quic-go/qpack v0.5.1 // indirect
 	github.com/rogpeppe/go-internal v1.10.0 // indirect
+	github.com/vishvananda/netns v0.0.5 // indirect
 	github.com/vmihailenco/msgpack/v5 v5.0.0 // indirect
 	github.com/vmihailenco/tagparser v0.1.2 // indirect
 	go.uber.org/mock v0.4.0 // indirect
-	golang.org/x/crypto v0.26.0 // indirect
 	golang.org/x/exp v0.0.0-20240506185415-9bf2ced13842 // indirect
-	golang.org/x/mod v0.17.0 // indirect
-	golang.org/x/net v0.28.0 // indirect
-	golang.org/x/sys v0.23.0 // indirect
+	golang.org/x/mod v0.18.0 // indirect
+	golang.org/x/sync v0.8.0 // indirect
 	golang.org/x/text v0.17.0 // indirect
 	golang.org/x/time v0.5.0 // indirect
-	golang.org/x/tools v0.21.1-0.20240508182429-e35e4ccd0d2d // indirect
+	golang.org/x/tools v0.22.0 // indirect
 	gopkg.in/check.v1 v1.0.0-20201130134442-10cb98267c6c // indirect
 	gopkg.in/yaml.v2 v2.4.0 // indirect
 )
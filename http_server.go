@@ -1,27 +1,51 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/polevpn/anyvalue"
 	"github.com/polevpn/elog"
 	"github.com/polevpn/h3conn"
+	"github.com/quic-go/quic-go"
 	"github.com/quic-go/quic-go/http3"
 )
 
 const (
 	TCP_WRITE_BUFFER_SIZE = 524288
 	TCP_READ_BUFFER_SIZE  = 524288
+	USER_AUTH_TIMEOUT     = 10
+	BEARER_AUTH_PREFIX    = "Bearer "
+	SESSION_TOKEN_HEADER  = "X-Session-Token"
+	OTP_HEADER            = "X-OTP"
 )
 
 type HttpServer struct {
 	requestHandler *RequestHandler
 	loginchecker   LoginChecker
+	accounting     *TrafficAccounting
+	tokenSigner    *SessionTokenSigner
+	totp           *TOTPVerifier
+	clientCert     *ClientCertVerifier
 	upgrader       *websocket.Upgrader
-	uplimit        uint64
-	downlimit      uint64
+	uplimit        atomic.Uint64
+	downlimit      atomic.Uint64
+	httpServer     *http.Server
+	quicServer     *http3.Server
+	listeners      []io.Closer
+	transports     []io.Closer
+	draining       atomic.Bool
+	mutex          *sync.Mutex
 }
 
 func NewHttpServer(uplimit uint64, downlimit uint64, requestHandler *RequestHandler) *HttpServer {
@@ -33,23 +57,83 @@ func NewHttpServer(uplimit uint64, downlimit uint64, requestHandler *RequestHand
 		EnableCompression: false,
 	}
 
-	return &HttpServer{requestHandler: requestHandler, upgrader: upgrader, uplimit: uplimit, downlimit: downlimit}
+	hs := &HttpServer{requestHandler: requestHandler, upgrader: upgrader, mutex: &sync.Mutex{}}
+	hs.SetTrafficLimit(uplimit, downlimit)
+	return hs
 }
 
 func (hs *HttpServer) SetLoginCheckHandler(loginchecker LoginChecker) {
 	hs.loginchecker = loginchecker
 }
 
+func (hs *HttpServer) SetTrafficAccounting(accounting *TrafficAccounting) {
+	hs.accounting = accounting
+}
+
+func (hs *HttpServer) SetSessionTokenSigner(tokenSigner *SessionTokenSigner) {
+	hs.tokenSigner = tokenSigner
+}
+
+func (hs *HttpServer) SetTOTPVerifier(totp *TOTPVerifier) {
+	hs.totp = totp
+}
+
+// SetClientCertVerifier make all listeners verify client certificates,ws and h3 as well as raw tls and quic
+func (hs *HttpServer) SetClientCertVerifier(clientCert *ClientCertVerifier) {
+	hs.clientCert = clientCert
+}
+
+func (hs *HttpServer) SetTrafficLimit(uplimit uint64, downlimit uint64) {
+	hs.uplimit.Store(uplimit)
+	hs.downlimit.Store(downlimit)
+}
+
+// newRateLimiter create limiter of the user limit,or the server limit if user has none
+func (hs *HttpServer) newRateLimiter(limit uint64, userLimit uint64) *RateLimiter {
+	if userLimit > 0 {
+		limit = userLimit
+	}
+	maxDelay := time.Duration(Config().Get("traffic_max_delay").AsInt(DEFAULT_TRAFFIC_MAX_DELAY)) * time.Millisecond
+	return NewRateLimiter(limit, Config().Get("traffic_burst").AsUint64(), maxDelay)
+}
+
 func (hs *HttpServer) defaultHandler(w http.ResponseWriter, r *http.Request) {
 	hs.respError(http.StatusForbidden, w)
 }
 
+// serverTLSConfig return tls config with cert,client certificates are verified if client cert verifier is set,
+// and required in cert_and_password mode or when auth.client_cert.required is set
+func (hs *HttpServer) serverTLSConfig(cert tls.Certificate) *tls.Config {
+
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if hs.clientCert == nil {
+		return config
+	}
+
+	require := Config().Get("auth.client_cert.required").AsBool() || Config().Get("auth.client_cert.mode").AsStr() == CLIENT_CERT_MODE_CERT_AND_PASSWORD
+	return hs.clientCert.TLSConfig(config, require)
+}
+
+// getClientCertUser return user and policy mapped from the verified client certificate,empty user if there is none
+func (hs *HttpServer) getClientCertUser(state *tls.ConnectionState) (string, *UserPolicy) {
+
+	if hs.clientCert == nil || state == nil || len(state.VerifiedChains) == 0 {
+		return "", nil
+	}
+	return ClientCertUser(state.VerifiedChains[0][0], Config().Get("auth.client_cert.user_from").AsStr())
+}
+
 func (hs *HttpServer) ListenTLS(wg *sync.WaitGroup, addr string, certFile string, keyFile string) {
 
 	defer wg.Done()
 
 	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
+		if hs.draining.Load() {
+			hs.respError(http.StatusServiceUnavailable, w)
+			return
+		}
+
 		if r.URL.Path == "/" {
 			if r.ProtoAtLeast(3, 0) {
 				hs.h3Handler(w, r)
@@ -60,7 +144,107 @@ func (hs *HttpServer) ListenTLS(wg *sync.WaitGroup, addr string, certFile string
 			hs.defaultHandler(w, r)
 		}
 	})
-	elog.Error(http3.ListenAndServeTLS(addr, certFile, keyFile, handler))
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		elog.Error("load tls key pair fail,", err)
+		return
+	}
+
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		elog.Error("resolve udp addr fail,", err)
+		return
+	}
+
+	udpConn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		elog.Error("listen udp fail,", err)
+		return
+	}
+	defer udpConn.Close()
+
+	quicServer := &http3.Server{
+		TLSConfig: hs.serverTLSConfig(cert),
+		Handler:   handler,
+	}
+
+	httpServer := &http.Server{
+		Addr:      addr,
+		TLSConfig: hs.serverTLSConfig(cert),
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			quicServer.SetQUICHeaders(w.Header())
+			handler.ServeHTTP(w, r)
+		}),
+	}
+
+	hs.mutex.Lock()
+	hs.quicServer = quicServer
+	hs.httpServer = httpServer
+	hs.mutex.Unlock()
+
+	hErr := make(chan error, 1)
+	qErr := make(chan error, 1)
+	go func() {
+		hErr <- httpServer.ListenAndServeTLS("", "")
+	}()
+	go func() {
+		qErr <- quicServer.Serve(udpConn)
+	}()
+
+	select {
+	case err = <-hErr:
+		if errors.Is(err, http.ErrServerClosed) {
+			err = <-qErr
+		} else {
+			quicServer.Close()
+		}
+	case err = <-qErr:
+	}
+
+	if err != nil && !errors.Is(err, http.ErrServerClosed) && !errors.Is(err, quic.ErrServerClosed) {
+		elog.Error(err)
+	}
+}
+
+// Shutdown stop accepting new connections,established connections are kept
+func (hs *HttpServer) Shutdown(ctx context.Context) error {
+
+	hs.draining.Store(true)
+
+	hs.mutex.Lock()
+	httpServer := hs.httpServer
+	listeners := hs.listeners
+	hs.listeners = nil
+	hs.mutex.Unlock()
+
+	for _, listener := range listeners {
+		listener.Close()
+	}
+
+	if httpServer == nil {
+		return nil
+	}
+	return httpServer.Shutdown(ctx)
+}
+
+// Close close the quic server and quic transports,all h3 and quic connections are aborted
+func (hs *HttpServer) Close() error {
+
+	hs.mutex.Lock()
+	quicServer := hs.quicServer
+	transports := hs.transports
+	hs.transports = nil
+	hs.mutex.Unlock()
+
+	for _, transport := range transports {
+		transport.Close()
+	}
+
+	if quicServer == nil {
+		return nil
+	}
+	return quicServer.Close()
 }
 
 func (hs *HttpServer) respError(status int, w http.ResponseWriter) {
@@ -73,130 +257,445 @@ func (hs *HttpServer) respError(status int, w http.ResponseWriter) {
 		w.WriteHeader(http.StatusForbidden)
 		w.Write([]byte("<html>\n<head><title>403 Forbidden</title></head>\n<body bgcolor=\"white\">\n<center><h1>403 Forbidden</h1></center>\n<hr><center>nginx/1.10.3</center>\n</body>\n</html>"))
 
+	} else if status == http.StatusUnauthorized {
+		w.Header().Add("Server", "nginx/1.10.3")
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("<html>\n<head><title>401 Authorization Required</title></head>\n<body bgcolor=\"white\">\n<center><h1>401 Authorization Required</h1></center>\n<hr><center>nginx/1.10.3</center>\n</body>\n</html>"))
+	} else if status == http.StatusServiceUnavailable {
+		w.Header().Add("Server", "nginx/1.10.3")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("<html>\n<head><title>503 Service Temporarily Unavailable</title></head>\n<body bgcolor=\"white\">\n<center><h1>503 Service Temporarily Unavailable</h1></center>\n<hr><center>nginx/1.10.3</center>\n</body>\n</html>"))
 	}
 }
 
-func (hs *HttpServer) h3Handler(w http.ResponseWriter, r *http.Request) {
+// getCredential get user and password from Authorization header,or from query string in legacy mode,
+// a bearer token is used as password of the user in query string,only a jwt carries its own user
+func (hs *HttpServer) getCredential(r *http.Request) (string, string, bool) {
 
-	defer PanicHandler()
+	user, pwd, ok := r.BasicAuth()
+	if ok {
+		return user, pwd, true
+	}
 
-	user := r.URL.Query().Get("user")
-	pwd := r.URL.Query().Get("pwd")
-	ip := r.URL.Query().Get("ip")
-	deviceType := r.URL.Query().Get("deviceType")
-	deviceId := r.URL.Query().Get("deviceId")
+	auth := r.Header.Get("Authorization")
+	if len(auth) > len(BEARER_AUTH_PREFIX) && strings.EqualFold(auth[:len(BEARER_AUTH_PREFIX)], BEARER_AUTH_PREFIX) {
+		user, token := r.URL.Query().Get("user"), auth[len(BEARER_AUTH_PREFIX):]
+		if user == "" && !isJWT(token) {
+			return "", "", false
+		}
+		return user, token, true
+	}
 
-	if user == "" || pwd == "" {
-		hs.respError(http.StatusForbidden, w)
-		return
+	if Config().Get("endpoint.allow_query_auth").AsBool() && r.URL.Query().Get("pwd") != "" {
+		return r.URL.Query().Get("user"), r.URL.Query().Get("pwd"), true
 	}
 
-	elog.Infof("user:%v,ip:%v,deviceType:%v,deviceId:%v,remoteip:%v connect,xff:%v", user, ip, deviceType, deviceId, r.RemoteAddr, r.Header.Get("X-Forwarded-For"))
+	return "", "", false
+}
+
+// getAuthParam get a credential besides password from header,or from query string in legacy mode,
+// credentials in query string leak to proxy and access logs
+func (hs *HttpServer) getAuthParam(r *http.Request, header string, key string) string {
+
+	value := r.Header.Get(header)
+	if value != "" {
+		return value
+	}
 
-	err := hs.loginchecker.CheckLogin(user, pwd, strings.Split(r.RemoteAddr, ":")[0], deviceType, deviceId)
+	if Config().Get("endpoint.allow_query_auth").AsBool() {
+		return r.URL.Query().Get(key)
+	}
+	return ""
+}
+
+// LoginRequest carry credentials and client info of a login,credentials a client doesn't send are empty,
+// CertUser and CertPolicy are mapped from the verified client certificate,IPVerified is set once a session token
+// proves the client held IP
+type LoginRequest struct {
+	User       string
+	Pwd        string
+	OTP        string
+	Token      string
+	CertUser   string
+	CertPolicy *UserPolicy
+	IP         string
+	IPVerified bool
+	RemoteIp   string
+	DeviceType string
+	DeviceId   string
+}
+
+// setCredential set credentials from CMD_USER_AUTH packet
+func (req *LoginRequest) setCredential(auth *anyvalue.AnyValue) {
+	req.User = auth.Get("user").AsStr()
+	req.Pwd = auth.Get("pwd").AsStr()
+	req.OTP = auth.Get("otp").AsStr()
+	req.Token = auth.Get("token").AsStr()
+}
+
+// certLogin check whether the client certificate alone is the credential,it is unless password is also required
+func (req *LoginRequest) certLogin() bool {
+	return req.CertUser != "" && Config().Get("auth.client_cert.mode").AsStr() != CLIENT_CERT_MODE_CERT_AND_PASSWORD
+}
+
+// verifySessionToken check token is signed by us and bound to the user,ip and device id
+func (hs *HttpServer) verifySessionToken(user string, token string, ip string, deviceId string) (*SessionToken, error) {
+
+	st, err := hs.tokenSigner.Verify(token)
 	if err != nil {
-		elog.Errorf("user:%v,pwd:%v,ip:%v verify fail,%v", user, pwd, ip, err)
-		hs.respError(http.StatusForbidden, w)
-		return
+		return nil, err
 	}
 
-	if ip != "" {
+	if user != "" && user != st.User {
+		return nil, errors.New("session token isn't issued to " + user)
+	}
 
-		if !hs.requestHandler.connmgr.CheckAndAllocAddress(user, ip) {
-			elog.Errorf("user:%v,pwd:%v,ip:%v reconnect fail,ip address not alloc to it", user, pwd, ip)
-			hs.respError(http.StatusBadRequest, w)
-			return
-		}
+	if st.IP != ip || st.DeviceId != deviceId {
+		return nil, errors.New("session token isn't bound to the ip and device")
+	}
+	return st, nil
+}
 
-		if hs.requestHandler.connmgr.GetIPAttachUser(ip) != "" && hs.requestHandler.connmgr.GetIPAttachUser(ip) != user {
-			elog.Errorf("user:%v,pwd:%v,ip:%v reconnect fail,ip address not belong to the user", user, pwd, ip)
-			hs.respError(http.StatusBadRequest, w)
-			return
+// verifyUser verify user by session token,or password and totp code,return http status code,the user and the user policy,
+// http.StatusUnauthorized means totp code is needed
+func (hs *HttpServer) verifyUser(req *LoginRequest) (int, string, *UserPolicy) {
+
+	user := req.User
+	ip := req.IP
+
+	if req.Token != "" && hs.tokenSigner != nil {
+		st, err := hs.verifySessionToken(user, req.Token, ip, req.DeviceId)
+		if err == nil {
+			policy := st.Policy
+			if policy == nil {
+				policy = &UserPolicy{}
+			}
+			req.IPVerified = ip != ""
+			return http.StatusOK, st.User, policy
 		}
+		elog.Errorf("user:%v,ip:%v verify session token fail,%v", user, ip, err)
+	}
+
+	//user of a jwt comes from its claims
+	if (user == "" && !isJWT(req.Pwd)) || req.Pwd == "" {
+		return http.StatusForbidden, "", nil
 	}
 
-	conn, err := h3conn.Accept(w, r)
+	if ip != "" && hs.tokenSigner != nil && Config().Get("session_token.required").AsBool() {
+		elog.Errorf("user:%v,ip:%v reconnect fail,session token required", user, ip)
+		return http.StatusBadRequest, "", nil
+	}
+
+	policy, err := hs.loginchecker.CheckLogin(user, req.Pwd, req.RemoteIp, req.DeviceType, req.DeviceId)
 	if err != nil {
-		elog.Error("upgrade http request to h3 fail", err)
-		return
+		elog.Errorf("user:%v,ip:%v verify fail,%v", user, ip, err)
+		return http.StatusForbidden, "", nil
 	}
 
-	elog.Info("accpet new h3 conn from ", user, " ", conn.RemoteAddr().String())
-	if hs.requestHandler == nil {
-		elog.Error("request dispatcher haven't set")
-		return
+	if policy == nil {
+		policy = &UserPolicy{}
 	}
 
-	if hs.requestHandler != nil {
-		h3conn := NewHttp3Conn(conn, hs.downlimit, hs.uplimit, hs.requestHandler)
-		hs.requestHandler.OnConnection(h3conn, user, ip)
-		go h3conn.Read()
-		go h3conn.Write()
-	} else {
-		elog.Error("h3 conn handler haven't set")
-		conn.Close()
+	if policy.User != "" {
+		user = policy.User
 	}
 
+	return hs.checkUserOTP(user, policy, req.OTP), user, policy
 }
 
-func (hs *HttpServer) wsHandler(w http.ResponseWriter, r *http.Request) {
+// checkUserOTP verify totp code if user has enrolled,or totp is required for all users
+func (hs *HttpServer) checkUserOTP(user string, policy *UserPolicy, otp string) int {
 
-	defer PanicHandler()
+	if hs.totp == nil || !Config().Get("auth.totp.enable").AsBool() {
+		return http.StatusOK
+	}
 
-	user := r.URL.Query().Get("user")
-	pwd := r.URL.Query().Get("pwd")
-	ip := r.URL.Query().Get("ip")
-	deviceType := r.URL.Query().Get("deviceType")
-	deviceId := r.URL.Query().Get("deviceId")
+	secret, err := hs.totp.GetSecret(user, policy)
+	if err != nil {
+		elog.Errorf("user:%v get totp secret fail,%v", user, err)
+		return http.StatusForbidden
+	}
 
-	if user == "" || pwd == "" {
-		hs.respError(http.StatusForbidden, w)
-		return
+	if secret == "" {
+		if Config().Get("auth.totp.required").AsBool() {
+			elog.Errorf("user:%v login fail,totp not enrolled", user)
+			return http.StatusForbidden
+		}
+		return http.StatusOK
 	}
 
-	elog.Infof("user:%v,ip:%v,deviceType:%v,deviceId:%v,remoteip:%v connect,xff:%v", user, ip, deviceType, deviceId, r.RemoteAddr, r.Header.Get("X-Forwarded-For"))
+	if otp == "" {
+		return http.StatusUnauthorized
+	}
 
-	err := hs.loginchecker.CheckLogin(user, pwd, strings.Split(r.RemoteAddr, ":")[0], deviceType, deviceId)
+	err = hs.totp.Verify(user, secret, otp)
 	if err != nil {
-		elog.Errorf("user:%v,pwd:%v,ip:%v verify fail,%v", user, pwd, ip, err)
-		hs.respError(http.StatusForbidden, w)
-		return
+		elog.Errorf("user:%v verify totp fail,%v", user, err)
+		return http.StatusForbidden
+	}
+	return http.StatusOK
+}
+
+// checkUserSession check session limit and traffic quota of user,and the ip it reconnect with,
+// without a session token only an ip the user held before or is bound to can be reclaimed
+func (hs *HttpServer) checkUserSession(user string, ip string, ipVerified bool, policy *UserPolicy) int {
+
+	if policy.MaxSessions > 0 && hs.requestHandler.connmgr.GetUserConnCount(user, ip) >= policy.MaxSessions {
+		elog.Errorf("user:%v,ip:%v login fail,reach max sessions %v", user, ip, policy.MaxSessions)
+		return http.StatusForbidden
+	}
+
+	if hs.accounting != nil && hs.accounting.Exceeded(user, hs.accounting.Quota(policy)) {
+		elog.Errorf("user:%v,ip:%v login fail,traffic quota used up", user, ip)
+		return http.StatusForbidden
 	}
 
 	if ip != "" {
-		if !hs.requestHandler.connmgr.CheckAndAllocAddress(user, ip) {
-			elog.Errorf("user:%v,pwd:%v,ip:%v reconnect fail,ip address not alloc to it", user, pwd, ip)
-			hs.respError(http.StatusBadRequest, w)
-			return
+
+		connmgr := hs.requestHandler.connmgr
+
+		owner := connmgr.GetBindUser(ip)
+		if owner == "" {
+			owner = connmgr.GetIPAttachUser(ip)
 		}
 
-		if hs.requestHandler.connmgr.GetIPAttachUser(ip) != "" && hs.requestHandler.connmgr.GetIPAttachUser(ip) != user {
-			elog.Errorf("user:%v,pwd:%v,ip:%v reconnect fail,ip address not belong to the user", user, pwd, ip)
-			hs.respError(http.StatusBadRequest, w)
-			return
+		if owner != user && (owner != "" || !ipVerified) {
+			elog.Errorf("user:%v,ip:%v reconnect fail,ip address not belong to the user", user, ip)
+			return http.StatusBadRequest
+		}
+
+		if !connmgr.CheckAndAllocAddress(user, ip) {
+			elog.Errorf("user:%v,ip:%v reconnect fail,ip address not alloc to it", user, ip)
+			return http.StatusBadRequest
 		}
 	}
+	return http.StatusOK
+}
 
-	conn, err := hs.upgrader.Upgrade(w, r, nil)
+// checkCertUser check user logged in is the one of client certificate,if client sent one
+func (hs *HttpServer) checkCertUser(certUser string, user string) int {
+	if certUser != "" && certUser != user {
+		elog.Errorf("user:%v login fail,client certificate is issued to %v", user, certUser)
+		return http.StatusForbidden
+	}
+	return http.StatusOK
+}
+
+// checkUserLogin verify user and the ip it reconnect with,return http status code,the user and the user policy,
+// user of the client certificate must match if client sent one
+func (hs *HttpServer) checkUserLogin(req *LoginRequest) (int, string, *UserPolicy) {
+
+	status, user, policy := http.StatusOK, req.CertUser, req.CertPolicy
+
+	if !req.certLogin() {
+		status, user, policy = hs.verifyUser(req)
+		if status == http.StatusOK {
+			status = hs.checkCertUser(req.CertUser, user)
+		}
+	} else {
+		//certificate replaces the password,not the second factor
+		status = hs.checkUserOTP(user, policy, req.OTP)
+	}
+	if status != http.StatusOK {
+		return status, "", nil
+	}
+
+	status = hs.checkUserSession(user, req.IP, req.IPVerified, policy)
+	if status != http.StatusOK {
+		return status, "", nil
+	}
+	return http.StatusOK, user, policy
+}
+
+// readPacketTimeout read a packet of cmd,transport is closed if it doesn't come in time
+func (hs *HttpServer) readPacketTimeout(transport PacketTransport, cmd uint16) (*anyvalue.AnyValue, error) {
+
+	timer := time.AfterFunc(time.Second*USER_AUTH_TIMEOUT, func() {
+		transport.Close()
+	})
+	defer timer.Stop()
+
+	pkt, err := transport.ReadPacket()
 	if err != nil {
-		elog.Error("upgrade http request to ws fail,", err)
-		return
+		return nil, err
+	}
+
+	if len(pkt) < POLE_PACKET_HEADER_LEN || PolePacket(pkt).Cmd() != cmd {
+		return nil, fmt.Errorf("expect packet cmd %v", cmd)
+	}
+
+	return anyvalue.NewFromJson(PolePacket(pkt).Payload())
+}
+
+// readUserAuth read the first CMD_USER_AUTH packet after upgrade
+func (hs *HttpServer) readUserAuth(transport PacketTransport) (*anyvalue.AnyValue, error) {
+	return hs.readPacketTimeout(transport, CMD_USER_AUTH)
+}
+
+// checkInBandLogin check credential of CMD_USER_AUTH,challenge client with CMD_USER_OTP if totp code is needed,
+// and answer the result with CMD_USER_AUTH,user of the client certificate must match if client sent one
+func (hs *HttpServer) checkInBandLogin(transport PacketTransport, req *LoginRequest) (string, *UserPolicy, error) {
+
+	status, user, policy := http.StatusOK, req.CertUser, req.CertPolicy
+
+	if !req.certLogin() {
+		status, user, policy = hs.verifyUser(req)
+	} else {
+		//certificate replaces the password,not the second factor
+		status = hs.checkUserOTP(user, policy, req.OTP)
+	}
+
+	if status == http.StatusUnauthorized {
+		err := transport.WritePacket(hs.userOTPReq())
+		if err != nil {
+			return "", nil, err
+		}
+		resp, err := hs.readPacketTimeout(transport, CMD_USER_OTP)
+		if err != nil {
+			return "", nil, err
+		}
+		status = hs.checkUserOTP(user, policy, resp.Get("otp").AsStr())
+	}
+
+	if status == http.StatusOK && !req.certLogin() {
+		status = hs.checkCertUser(req.CertUser, user)
 	}
 
-	elog.Info("accpet new ws conn from ", user, " ", conn.RemoteAddr().String())
+	if status == http.StatusOK {
+		status = hs.checkUserSession(user, req.IP, req.IPVerified, policy)
+	}
+
+	err := transport.WritePacket(hs.userAuthResp(status))
+	if err != nil {
+		return "", nil, err
+	}
+	if status != http.StatusOK {
+		return "", nil, fmt.Errorf("user %v auth fail,status %v", req.User, status)
+	}
+	return user, policy, nil
+}
+
+func (hs *HttpServer) cmdPacket(cmd uint16, av *anyvalue.AnyValue) []byte {
+	body, _ := av.MarshalJSON()
+	buf := make([]byte, POLE_PACKET_HEADER_LEN+len(body))
+	copy(buf[POLE_PACKET_HEADER_LEN:], body)
+	pkt := PolePacket(buf)
+	pkt.SetLen(uint16(len(buf)))
+	pkt.SetCmd(cmd)
+	return pkt
+}
+
+func (hs *HttpServer) userAuthResp(status int) []byte {
+	av := anyvalue.New()
+	av.Set("ret", status)
+	return hs.cmdPacket(CMD_USER_AUTH, av)
+}
+
+// userOTPReq ask client for the totp code,client answer CMD_USER_OTP with {"otp":"123456"}
+func (hs *HttpServer) userOTPReq() []byte {
+	av := anyvalue.New()
+	av.Set("type", "totp")
+	return hs.cmdPacket(CMD_USER_OTP, av)
+}
+
+// newLoginRequest build login request from query string,auth headers and client certificate of r,
+// return false if r carries no credential,it then comes in band after upgrade
+func (hs *HttpServer) newLoginRequest(r *http.Request) (*LoginRequest, bool) {
+
+	req := &LoginRequest{
+		Token:      hs.getAuthParam(r, SESSION_TOKEN_HEADER, "token"),
+		OTP:        hs.getAuthParam(r, OTP_HEADER, "otp"),
+		IP:         r.URL.Query().Get("ip"),
+		DeviceType: r.URL.Query().Get("deviceType"),
+		DeviceId:   r.URL.Query().Get("deviceId"),
+	}
+	req.RemoteIp, _, _ = net.SplitHostPort(r.RemoteAddr)
+	req.CertUser, req.CertPolicy = hs.getClientCertUser(r.TLS)
+
+	var hasCredential bool
+	req.User, req.Pwd, hasCredential = hs.getCredential(r)
+	return req, hasCredential || req.Token != "" || req.certLogin()
+}
+
+// acceptSession login client of r,and start a session on the transport upgrade turns r into,
+// credential in r is checked before upgrade,otherwise it is read from the transport
+func (hs *HttpServer) acceptSession(w http.ResponseWriter, r *http.Request, upgrade func() (PacketTransport, error)) {
+
 	if hs.requestHandler == nil {
-		elog.Error("request dispatcher haven't set")
+		elog.Error("request handler haven't set")
+		hs.respError(http.StatusServiceUnavailable, w)
 		return
 	}
 
-	if hs.requestHandler != nil {
-		wsconn := NewWebSocketConn(conn, hs.downlimit, hs.uplimit, hs.requestHandler)
-		hs.requestHandler.OnConnection(wsconn, user, ip)
-		go wsconn.Read()
-		go wsconn.Write()
-	} else {
-		elog.Error("ws conn handler haven't set")
-		conn.Close()
+	req, hasCredential := hs.newLoginRequest(r)
+
+	elog.Infof("user:%v,ip:%v,deviceType:%v,deviceId:%v,remoteip:%v connect,xff:%v", req.User, req.IP, req.DeviceType, req.DeviceId, r.RemoteAddr, r.Header.Get("X-Forwarded-For"))
+
+	var user string
+	var policy *UserPolicy
+
+	if hasCredential {
+		var status int
+		status, user, policy = hs.checkUserLogin(req)
+		if status != http.StatusOK {
+			hs.respError(status, w)
+			return
+		}
+	}
+
+	transport, err := upgrade()
+	if err != nil {
+		elog.Error("upgrade http request fail,", err)
+		return
 	}
 
+	if !hasCredential {
+		var auth *anyvalue.AnyValue
+		auth, err = hs.readUserAuth(transport)
+		if err != nil {
+			elog.Error(transport.RemoteAddr().String(), " read user auth fail,", err)
+			transport.Close()
+			return
+		}
+		req.setCredential(auth)
+		user, policy, err = hs.checkInBandLogin(transport, req)
+		if err != nil {
+			elog.Error(transport.RemoteAddr().String(), " user auth fail,", err)
+			transport.Close()
+			return
+		}
+	}
+
+	elog.Info("accpet new ", transport.Name(), " conn from ", user, " ", transport.RemoteAddr().String())
+
+	session := NewSession(transport, hs.newRateLimiter(hs.downlimit.Load(), policy.DownLimit), hs.newRateLimiter(hs.uplimit.Load(), policy.UpLimit), hs.requestHandler)
+	hs.requestHandler.OnConnection(session, user, req.IP, req.DeviceId, policy)
+	go session.Read()
+	go session.Write()
+}
+
+func (hs *HttpServer) h3Handler(w http.ResponseWriter, r *http.Request) {
+
+	defer PanicHandler()
+
+	hs.acceptSession(w, r, func() (PacketTransport, error) {
+		conn, err := h3conn.Accept(w, r)
+		if err != nil {
+			return nil, err
+		}
+		return NewHttp3Conn(conn), nil
+	})
+}
+
+func (hs *HttpServer) wsHandler(w http.ResponseWriter, r *http.Request) {
+
+	defer PanicHandler()
+
+	hs.acceptSession(w, r, func() (PacketTransport, error) {
+		conn, err := hs.upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return nil, err
+		}
+		return NewWebSocketConn(conn), nil
+	})
 }
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestGetCredential(t *testing.T) {
+
+	hs, _, _, _ := newTestHttpServer(t)
+
+	jwt := "eyJhbGciOiJSUzI1NiJ9.eyJzdWIiOiJhbGljZSJ9.sig"
+
+	newRequest := func(url string, auth string) *http.Request {
+		r := httptest.NewRequest("GET", url, nil)
+		if auth != "" {
+			r.Header.Set("Authorization", auth)
+		}
+		return r
+	}
+
+	tests := []struct {
+		r    *http.Request
+		user string
+		pwd  string
+		ok   bool
+	}{
+		{newRequest("/", "Basic "+base64.StdEncoding.EncodeToString([]byte("alice:123456"))), "alice", "123456", true},
+		{newRequest("/?user=alice", "Bearer token1"), "alice", "token1", true},
+		{newRequest("/?user=alice", "bearer token1"), "alice", "token1", true},
+		//a bearer token without user is only accepted as jwt
+		{newRequest("/", "Bearer token1"), "", "", false},
+		{newRequest("/", "Bearer "+jwt), "", jwt, true},
+		{newRequest("/?user=alice", "Digest token1"), "", "", false},
+		//password in query string needs allow_query_auth
+		{newRequest("/?user=alice&pwd=123456", ""), "", "", false},
+		{newRequest("/", ""), "", "", false},
+	}
+
+	for i, test := range tests {
+		user, pwd, ok := hs.getCredential(test.r)
+		if user != test.user || pwd != test.pwd || ok != test.ok {
+			t.Fatalf("case %v,unexpected credential %v,%v,%v", i, user, pwd, ok)
+		}
+	}
+
+	Config().Set("endpoint.allow_query_auth", true)
+	user, pwd, ok := hs.getCredential(newRequest("/?user=alice&pwd=123456", ""))
+	if user != "alice" || pwd != "123456" || !ok {
+		t.Fatalf("query auth fail,%v,%v,%v", user, pwd, ok)
+	}
+}
+
+func TestWsLogin(t *testing.T) {
+
+	hs, _, _, _ := newTestHttpServer(t)
+
+	server := httptest.NewServer(http.HandlerFunc(hs.wsHandler))
+	defer server.Close()
+
+	url := "ws://" + strings.TrimPrefix(server.URL, "http://") + "/?deviceId=device1"
+
+	dial := func(query string, auth string) (*websocket.Conn, int) {
+		header := http.Header{}
+		if auth != "" {
+			header.Set("Authorization", auth)
+		}
+		conn, resp, err := websocket.DefaultDialer.Dial(url+query, header)
+		if err != nil {
+			if resp == nil {
+				t.Fatal(err)
+			}
+			return nil, resp.StatusCode
+		}
+		return conn, http.StatusSwitchingProtocols
+	}
+
+	inBand := func(conn *websocket.Conn, pwd string, ret int) {
+		defer conn.Close()
+		conn.WriteMessage(websocket.BinaryMessage, authPacket("alice", pwd))
+		_, pkt, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkAuthResp(t, pkt, ret)
+	}
+
+	//credential in header is checked before upgrade
+	if _, status := dial("", "Basic "+base64.StdEncoding.EncodeToString([]byte("alice:bad"))); status != http.StatusForbidden {
+		t.Fatalf("wrong password should be rejected before upgrade,status:%v", status)
+	}
+	conn, status := dial("", "Basic "+base64.StdEncoding.EncodeToString([]byte("alice:123456")))
+	if status != http.StatusSwitchingProtocols {
+		t.Fatalf("login with header fail,status:%v", status)
+	}
+	conn.Close()
+
+	//without credential in request it comes in band
+	conn, _ = dial("", "")
+	inBand(conn, "bad", http.StatusForbidden)
+	conn, _ = dial("", "Bearer 123456")
+	inBand(conn, "123456", http.StatusOK)
+
+	//password in query string is ignored unless allowed
+	conn, _ = dial("&user=alice&pwd=123456", "")
+	inBand(conn, "123456", http.StatusOK)
+	Config().Set("endpoint.allow_query_auth", true)
+	if _, status := dial("&user=alice&pwd=bad", ""); status != http.StatusForbidden {
+		t.Fatalf("wrong query password should be rejected,status:%v", status)
+	}
+	conn, status = dial("&user=alice&pwd=123456", "")
+	if status != http.StatusSwitchingProtocols {
+		t.Fatalf("login with query string fail,status:%v", status)
+	}
+	conn.Close()
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_JWKS_REFRESH     = 3600
+	JWKS_MIN_REFRESH         = 60
+	DEFAULT_JWKS_TIMEOUT     = 5
+	JWKS_MAX_SIZE            = 1 << 20
+	JWT_MAX_SIZE             = 16384
+	JWT_HEADER_PREFIX_BASE64 = "eyJ"
+)
+
+// isJWT check whether s looks like a compact jws,header.payload.signature with a json header
+func isJWT(s string) bool {
+	return len(s) <= JWT_MAX_SIZE && strings.HasPrefix(s, JWT_HEADER_PREFIX_BASE64) && strings.Count(s, ".") == 2
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(data), nil
+}
+
+func (jwk *jsonWebKey) publicKey() (crypto.PublicKey, error) {
+
+	if jwk.Kty == "RSA" {
+		n, err := decodeBigInt(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(jwk.E)
+		if err != nil || !e.IsInt64() {
+			return nil, errors.New("invalid rsa exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	}
+
+	if jwk.Kty == "EC" {
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, errors.New("unsupported curve " + jwk.Crv)
+		}
+		x, err := decodeBigInt(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("invalid ec point")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+
+	return nil, errors.New("unsupported key type " + jwk.Kty)
+}
+
+// ParseJWKS parse signing keys of a json web key set by kid,keys of unsupported types are skipped
+func ParseJWKS(data []byte) (map[string]crypto.PublicKey, error) {
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+
+	err := json.Unmarshal(data, &set)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("no signing key in jwks")
+	}
+	return keys, nil
+}
+
+// JWKS load keys from a local file or an url,keys are reloaded every refresh,
+// or on an unknown kid at most once a minute
+type JWKS struct {
+	source  string
+	refresh time.Duration
+	keys    map[string]crypto.PublicKey
+	loaded  time.Time
+	now     func() time.Time
+	mutex   *sync.Mutex
+}
+
+func NewJWKS(source string, refresh time.Duration) *JWKS {
+	if refresh <= 0 {
+		refresh = time.Second * DEFAULT_JWKS_REFRESH
+	}
+	return &JWKS{source: source, refresh: refresh, now: time.Now, mutex: &sync.Mutex{}}
+}
+
+func (jwks *JWKS) Source() string {
+	return jwks.source
+}
+
+func (jwks *JWKS) read() ([]byte, error) {
+
+	if !strings.HasPrefix(jwks.source, "http://") && !strings.HasPrefix(jwks.source, "https://") {
+		return os.ReadFile(jwks.source)
+	}
+
+	client := http.Client{Timeout: time.Second * DEFAULT_JWKS_TIMEOUT}
+	resp, err := client.Get(jwks.source)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("fetch jwks fail,status " + resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, JWKS_MAX_SIZE))
+}
+
+// GetKey return the key of kid,an empty kid matches the only key of the set
+func (jwks *JWKS) GetKey(kid string) (crypto.PublicKey, error) {
+
+	jwks.mutex.Lock()
+	defer jwks.mutex.Unlock()
+
+	now := jwks.now()
+	_, found := jwks.keys[kid]
+	if jwks.keys == nil || now.Sub(jwks.loaded) >= jwks.refresh || (!found && now.Sub(jwks.loaded) >= time.Second*JWKS_MIN_REFRESH) {
+		data, err := jwks.read()
+		if err == nil {
+			var keys map[string]crypto.PublicKey
+			keys, err = ParseJWKS(data)
+			if err == nil {
+				jwks.keys = keys
+			}
+		}
+		//keep old keys working when the issuer is unreachable
+		if err != nil && jwks.keys == nil {
+			return nil, err
+		}
+		jwks.loaded = now
+	}
+
+	if key, ok := jwks.keys[kid]; ok {
+		return key, nil
+	}
+	if kid == "" && len(jwks.keys) == 1 {
+		for _, key := range jwks.keys {
+			return key, nil
+		}
+	}
+	return nil, errors.New("jwt key " + kid + " not found")
+}
+
+func jwtHash(alg string) (crypto.Hash, func() hash.Hash) {
+	switch alg[2:] {
+	case "256":
+		return crypto.SHA256, sha256.New
+	case "384":
+		return crypto.SHA384, sha512.New384
+	case "512":
+		return crypto.SHA512, sha512.New
+	}
+	return 0, nil
+}
+
+// VerifyJWT check signature of token with the key getKey return for its kid,and return its claims,
+// only RS*,PS* and ES* algorithms are accepted
+func VerifyJWT(token string, getKey func(kid string) (crypto.PublicKey, error)) (map[string]interface{}, error) {
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("invalid jwt")
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, err
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	err = json.Unmarshal(data, &header)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(header.Alg) != 5 {
+		return nil, errors.New("unsupported jwt alg " + header.Alg)
+	}
+	hashType, newHash := jwtHash(header.Alg)
+	if newHash == nil {
+		return nil, errors.New("unsupported jwt alg " + header.Alg)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := getKey(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	h := newHash()
+	h.Write([]byte(parts[0] + "." + parts[1]))
+	digest := h.Sum(nil)
+
+	switch header.Alg[:2] {
+	case "RS", "PS":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return nil, errors.New("jwt key isn't rsa key")
+		}
+		if header.Alg[0] == 'R' {
+			err = rsa.VerifyPKCS1v15(pub, hashType, digest, sig)
+		} else {
+			err = rsa.VerifyPSS(pub, hashType, digest, sig, nil)
+		}
+	case "ES":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return nil, errors.New("jwt key isn't ec key")
+		}
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(sig) != size*2 {
+			return nil, errors.New("invalid jwt signature")
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			err = errors.New("invalid jwt signature")
+		}
+	default:
+		err = errors.New("unsupported jwt alg " + header.Alg)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	data, err = base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, err
+	}
+
+	claims := make(map[string]interface{})
+	err = json.Unmarshal(data, &claims)
+	if err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
@@ -1,19 +1,19 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
+	"crypto/rand"
 	"errors"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"net/http"
-	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-ldap/ldap/v3"
 	"github.com/polevpn/anyvalue"
+	"github.com/polevpn/elog"
 )
 
 const (
@@ -29,69 +29,89 @@ type User struct {
 }
 
 type LocalLoginChecker struct {
+	credfile *CredentialFile
+	mutex    *sync.Mutex
 }
 
 func NewLocalLoginChecker() *LocalLoginChecker {
-	return &LocalLoginChecker{}
+	return &LocalLoginChecker{mutex: &sync.Mutex{}}
 }
 
-func (llc *LocalLoginChecker) CheckLogin(user string, pwd string, remoteIp string, deviceType string, deviceId string) error {
+func (llc *LocalLoginChecker) CheckLogin(user string, pwd string, remoteIp string, deviceType string, deviceId string) (*UserPolicy, error) {
 
-	var err error
+	var policy *UserPolicy
+	//backends are tried in order until one accepts,so an unconfigured one must not pass
+	err := errors.New("no auth backend configured")
 
-	if Config.Has("auth.file") {
-		err = llc.checkFileLogin(user, pwd)
+	if Config().Has("auth.file") {
+		policy, err = llc.checkFileLogin(user, pwd)
+		metricLogin("file", err)
 	}
 
 	if err == nil {
-		return nil
+		return policy, nil
 	}
 
-	if Config.Has("auth.http") {
-		err = llc.checkHttpLogin(user, pwd, remoteIp, deviceType, deviceId)
+	if Config().Has("auth.http") {
+		policy, err = llc.checkHttpLogin(user, pwd, remoteIp, deviceType, deviceId)
+		metricLogin("http", err)
 	}
 
 	if err == nil {
-		return nil
+		return policy, nil
 	}
 
-	if Config.Has("auth.ldap") {
-		err = llc.checkLDAPLogin(user, pwd)
+	if Config().Has("auth.ldap") {
+		policy, err = llc.checkLDAPLogin(user, pwd)
+		metricLogin("ldap", err)
 	}
 
-	return err
+	if err == nil {
+		return policy, nil
+	}
+
+	if Config().Has("auth.radius") {
+		policy, err = llc.checkRadiusLogin(user, pwd, remoteIp, deviceId)
+		metricLogin("radius", err)
+	}
+
+	return policy, err
 
 }
 
-func (llc *LocalLoginChecker) checkFileLogin(user string, pwd string) error {
+func (llc *LocalLoginChecker) getCredentialFile(filePath string) (*CredentialFile, error) {
 
-	filePath := Config.Get("auth.file.path").AsStr()
+	llc.mutex.Lock()
+	defer llc.mutex.Unlock()
 
-	f, err := os.Open(filePath)
+	if llc.credfile != nil && llc.credfile.Path() == filePath {
+		return llc.credfile, nil
+	}
+
+	credfile, err := NewCredentialFile(filePath)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer f.Close()
 
-	br := bufio.NewReader(f)
-	for {
-		line, _, c := br.ReadLine()
-		if c == io.EOF {
-			break
-		}
-		userPassword := strings.Trim(string(line), "\n\r")
-		userPasswordArr := strings.Split(userPassword, ",")
-		if len(userPasswordArr) != 2 {
-			continue
-		}
-		if userPasswordArr[0] == user && userPasswordArr[1] == pwd {
-			return nil
-		}
+	if llc.credfile != nil {
+		llc.credfile.Close()
+	}
+	llc.credfile = credfile
+	return credfile, nil
+}
+
+func (llc *LocalLoginChecker) checkFileLogin(user string, pwd string) (*UserPolicy, error) {
+
+	credfile, err := llc.getCredentialFile(Config().Get("auth.file.path").AsStr())
+	if err != nil {
+		return nil, err
 	}
-	return errors.New("user or password incorrect")
+
+	return credfile.Verify(user, pwd)
 }
 
-func (llc *LocalLoginChecker) checkHttpLogin(user string, pwd string, remoteIp string, deviceType string, deviceId string) error {
+// checkHttpLogin post user info to auth url,status 200 means success and the body may carry user policy json
+func (llc *LocalLoginChecker) checkHttpLogin(user string, pwd string, remoteIp string, deviceType string, deviceId string) (*UserPolicy, error) {
 
 	req := anyvalue.New()
 
@@ -103,66 +123,158 @@ func (llc *LocalLoginChecker) checkHttpLogin(user string, pwd string, remoteIp s
 
 	data, _ := req.EncodeJson()
 
-	client := http.Client{Timeout: time.Duration(Config.Get("auth.http.timeout").AsInt()) * time.Second}
-	request, err := http.NewRequest(http.MethodPost, Config.Get("auth.http.url").AsStr(), bytes.NewReader(data))
+	client := http.Client{Timeout: time.Duration(Config().Get("auth.http.timeout").AsInt()) * time.Second}
+	request, err := http.NewRequest(http.MethodPost, Config().Get("auth.http.url").AsStr(), bytes.NewReader(data))
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	resp, err := client.Do(request)
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer resp.Body.Close()
 
+	data, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
 	if resp.StatusCode != http.StatusOK {
-		data, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return nil
-		}
-		return errors.New(string(data))
+		return nil, errors.New(string(data))
+	}
+
+	policy, err := NewUserPolicyFromJson(bytes.TrimSpace(data))
+	if err != nil {
+		//keep backends which reply non json body working
+		elog.Warn("parse user policy fail,", err)
+		return &UserPolicy{}, nil
 	}
-	return nil
+	return policy, nil
 }
 
-func (llc *LocalLoginChecker) checkLDAPLogin(user string, pwd string) error {
+// checkLDAPLogin bind as the user,policy is read from the attributes configured in auth.ldap.policy_attrs
+func (llc *LocalLoginChecker) checkLDAPLogin(user string, pwd string) (*UserPolicy, error) {
+
+	//attribute names in the order of up_limit,down_limit,quota,max_sessions,groups
+	names := []string{"up_limit", "down_limit", "quota", "max_sessions", "groups"}
+	policyAttrs := make([]string, len(names))
+	attrs := []string{"dn"}
+	for i, name := range names {
+		policyAttrs[i] = Config().Get("auth.ldap.policy_attrs." + name).AsStr()
+		if policyAttrs[i] != "" {
+			attrs = append(attrs, policyAttrs[i])
+		}
+	}
 
-	l, err := ldap.DialURL(Config.Get("auth.ldap.host").AsStr())
+	l, err := ldap.DialURL(Config().Get("auth.ldap.host").AsStr())
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer l.Close()
 
-	err = l.Bind(Config.Get("auth.ldap.admin_dn").AsStr(), Config.Get("auth.ldap.admin_pwd").AsStr())
+	err = l.Bind(Config().Get("auth.ldap.admin_dn").AsStr(), Config().Get("auth.ldap.admin_pwd").AsStr())
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	searchRequest := ldap.NewSearchRequest(
-		Config.Get("auth.ldap.user_dn").AsStr(),
+		Config().Get("auth.ldap.user_dn").AsStr(),
 		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
 		fmt.Sprintf("(&(objectClass=organizationalPerson)(uid=%s))", user),
-		[]string{"dn"},
+		attrs,
 		nil,
 	)
 
 	sr, err := l.Search(searchRequest)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if len(sr.Entries) != 1 {
-		return errors.New("User does not exist")
+		return nil, errors.New("User does not exist")
+	}
+
+	entry := sr.Entries[0]
+
+	err = l.Bind(entry.DN, pwd)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := make([]string, len(policyAttrs))
+	for i, attr := range policyAttrs {
+		if attr != "" {
+			fields[i] = strings.Join(entry.GetAttributeValues(attr), ";")
+		}
 	}
 
-	userdn := sr.Entries[0].DN
+	return NewUserPolicyFromFields(fields), nil
+}
+
+// checkRadiusLogin send Access-Request with pap or mschapv2 by auth.radius.method,
+// Filter-Id attributes of Access-Accept are used as groups of user
+func (llc *LocalLoginChecker) checkRadiusLogin(user string, pwd string, remoteIp string, deviceId string) (*UserPolicy, error) {
+
+	req := NewRadiusPacket(RADIUS_CODE_ACCESS_REQUEST)
+	req.AddString(RADIUS_ATTR_USER_NAME, user)
+	req.AddUint32(RADIUS_ATTR_SERVICE_TYPE, RADIUS_SERVICE_TYPE_FRAMED)
+	req.AddUint32(RADIUS_ATTR_NAS_PORT_TYPE, RADIUS_NAS_PORT_TYPE_VIRT)
+	req.AddString(RADIUS_ATTR_NAS_IDENTIFIER, Config().Get("auth.radius.nas_identifier").AsStr())
+	req.AddString(RADIUS_ATTR_CALLING_STATION_ID, remoteIp)
+	req.AddString(RADIUS_ATTR_CALLED_STATION_ID, deviceId)
+
+	var authChallenge, peerChallenge, ntResponse []byte
+	var hiddenPwd []byte
+
+	method := Config().Get("auth.radius.method").AsStr()
+	if method == "" || method == "pap" {
+		hiddenPwd = []byte(pwd)
+	} else if method == "mschapv2" {
+		challenge := make([]byte, MSCHAP_CHALLENGE_LEN*2)
+		_, err := rand.Read(challenge)
+		if err != nil {
+			return nil, err
+		}
+		authChallenge, peerChallenge = challenge[:MSCHAP_CHALLENGE_LEN], challenge[MSCHAP_CHALLENGE_LEN:]
+		ntResponse = MSCHAPv2NtResponse(authChallenge, peerChallenge, user, pwd)
+
+		//ident,flags,peer challenge,8 reserved bytes,nt response
+		resp := make([]byte, 0, MSCHAP2_RESPONSE_LEN)
+		resp = append(resp, req.Identifier, 0)
+		resp = append(resp, peerChallenge...)
+		resp = append(resp, make([]byte, 8)...)
+		resp = append(resp, ntResponse...)
+
+		req.AddVendor(RADIUS_VENDOR_MICROSOFT, RADIUS_MS_CHAP_CHALLENGE, authChallenge)
+		req.AddVendor(RADIUS_VENDOR_MICROSOFT, RADIUS_MS_CHAP2_RESPONSE, resp)
+	} else {
+		return nil, errors.New("radius method should be pap or mschapv2")
+	}
 
-	err = l.Bind(userdn, pwd)
+	resp, err := newRadiusClient("auth.radius.servers").Exchange(req, hiddenPwd)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	if resp.Code != RADIUS_CODE_ACCESS_ACCEPT {
+		return nil, errors.New(radiusReplyMessage(resp, "radius access rejected"))
+	}
+
+	if ntResponse != nil {
+		//the server must prove it knows the password too
+		success := resp.GetVendor(RADIUS_VENDOR_MICROSOFT, RADIUS_MS_CHAP2_SUCCESS)
+		expected := MSCHAPv2AuthenticatorResponse(authChallenge, peerChallenge, ntResponse, user, pwd)
+		if len(success) < 1 || !strings.HasPrefix(string(success[1:]), expected) {
+			return nil, errors.New("invalid mschapv2 authenticator response")
+		}
+	}
+
+	var groups []string
+	for _, value := range resp.GetAll(RADIUS_ATTR_FILTER_ID) {
+		groups = append(groups, string(value))
+	}
+	return &UserPolicy{Groups: groups}, nil
 }
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/polevpn/anyvalue"
+)
+
+func TestCheckLoginWithoutAcceptingBackend(t *testing.T) {
+
+	oldConfig := Config()
+	SetConfig(anyvalue.New())
+	defer func() { SetConfig(oldConfig) }()
+
+	llc := NewLocalLoginChecker()
+
+	if _, err := llc.CheckLogin("alice", "123456", "1.1.1.1", "ios", "device1"); err == nil {
+		t.Fatal("login without auth backend should fail")
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		req, _ := anyvalue.NewFromJson(data)
+		if req.Get("pwd").AsStr() != "123456" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("invalid password"))
+			return
+		}
+		w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+
+	//only http backend,no auth.file
+	Config().Set("auth.http.url", server.URL)
+	Config().Set("auth.http.timeout", 5)
+
+	if _, err := llc.CheckLogin("alice", "wrong", "1.1.1.1", "ios", "device1"); err == nil {
+		t.Fatal("login rejected by http backend should fail")
+	}
+
+	if _, err := llc.CheckLogin("alice", "123456", "1.1.1.1", "ios", "device1"); err != nil {
+		t.Fatal(err)
+	}
+}
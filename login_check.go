@@ -1,5 +1,5 @@
 package main
 
 type LoginChecker interface {
-	CheckLogin(user string, pwd string, remoteIp string, deviceType string, deviceId string) error
+	CheckLogin(user string, pwd string, remoteIp string, deviceType string, deviceId string) (*UserPolicy, error)
 }
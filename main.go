@@ -2,20 +2,35 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"os"
 	"os/signal"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/polevpn/anyvalue"
 	"github.com/polevpn/elog"
 )
 
 const (
-	CH_TUNIO_WRITE_SIZE = 200
+	CH_TUNIO_WRITE_SIZE      = 200
+	DEFAULT_SHUTDOWN_TIMEOUT = 10
 )
 
-var Config *anyvalue.AnyValue
+var currentConfig atomic.Pointer[anyvalue.AnyValue]
 var configPath string
+var server *PoleVPNServer
+
+// Config return the config in effect,it is swapped as a whole on reload so callers never see a partial one
+func Config() *anyvalue.AnyValue {
+	return currentConfig.Load()
+}
+
+// SetConfig replace the config in effect
+func SetConfig(config *anyvalue.AnyValue) {
+	currentConfig.Store(config)
+}
 
 func init() {
 	flag.StringVar(&configPath, "config", "./config.json", "config file path")
@@ -23,13 +38,20 @@ func init() {
 
 func signalHandler() {
 
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
 	go func() {
+		shutting := false
 		for s := range c {
 			switch s {
-			case syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT:
-				elog.Fatal("receive exit signal,exit")
+			case syscall.SIGHUP:
+				reloadConfig()
+			case syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT:
+				if shutting {
+					elog.Fatal("receive exit signal again,exit")
+				}
+				shutting = true
+				go shutdown()
 			case syscall.SIGUSR1:
 			case syscall.SIGUSR2:
 			default:
@@ -38,19 +60,69 @@ func signalHandler() {
 	}()
 }
 
+func shutdown() {
+
+	timeout := time.Duration(Config().Get("shutdown_timeout").AsInt(DEFAULT_SHUTDOWN_TIMEOUT)) * time.Second
+	elog.Infof("receive exit signal,shutdown in %v", timeout)
+
+	server.Stop(timeout)
+
+	elog.Info("shutdown ok,exit")
+	elog.Flush()
+	os.Exit(0)
+}
+
+func reloadConfig() {
+
+	elog.Info("receive reload signal,reload config ", configPath)
+
+	config, err := GetConfig(configPath)
+	if err != nil {
+		elog.Error("reload config fail,", err)
+		return
+	}
+
+	err = server.Reload(config)
+	if err != nil {
+		elog.Error("reload config fail,", err)
+		return
+	}
+	elog.Info("reload config ok")
+}
+
 func main() {
 
+	if len(os.Args) > 1 && os.Args[1] == "passwd" {
+		err := PasswdCommand(os.Args[2:])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "totp" {
+		err := TOTPCommand(os.Args[2:])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	flag.Parse()
 	defer elog.Flush()
-	signalHandler()
-
-	var err error
 
-	Config, err = GetConfig(configPath)
+	config, err := GetConfig(configPath)
 	if err != nil {
 		elog.Fatal("load config fail", err)
 	}
-	err = NewPoleVPNServer().Start(Config)
+	SetConfig(config)
+
+	server = NewPoleVPNServer()
+	signalHandler()
+
+	err = server.Start(config)
 	if err != nil {
 		elog.Fatal("start polevpn server fail,", err)
 	}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/polevpn/elog"
+)
+
+const (
+	METRIC_TYPE_COUNTER = "counter"
+	METRIC_TYPE_GAUGE   = "gauge"
+)
+
+var Metrics = NewMetricRegistry()
+
+type MetricCounter struct {
+	value uint64
+}
+
+func (mc *MetricCounter) Add(delta uint64) {
+	atomic.AddUint64(&mc.value, delta)
+}
+
+func (mc *MetricCounter) Inc() {
+	atomic.AddUint64(&mc.value, 1)
+}
+
+func (mc *MetricCounter) Value() uint64 {
+	return atomic.LoadUint64(&mc.value)
+}
+
+type MetricGauge struct {
+	bits uint64
+}
+
+func (mg *MetricGauge) Set(value float64) {
+	atomic.StoreUint64(&mg.bits, math.Float64bits(value))
+}
+
+func (mg *MetricGauge) Value() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&mg.bits))
+}
+
+type metricFamily struct {
+	name     string
+	help     string
+	mtype    string
+	counters map[string]*MetricCounter
+	gauges   map[string]*MetricGauge
+}
+
+// MetricRegistry keep counters and gauges,and write them in prometheus text format
+type MetricRegistry struct {
+	families   map[string]*metricFamily
+	collectors []func()
+	mutex      *sync.Mutex
+}
+
+func NewMetricRegistry() *MetricRegistry {
+	return &MetricRegistry{families: make(map[string]*metricFamily), mutex: &sync.Mutex{}}
+}
+
+func (mr *MetricRegistry) family(name string, help string, mtype string) *metricFamily {
+	mf, ok := mr.families[name]
+	if !ok {
+		mf = &metricFamily{
+			name:     name,
+			help:     help,
+			mtype:    mtype,
+			counters: make(map[string]*MetricCounter),
+			gauges:   make(map[string]*MetricGauge),
+		}
+		mr.families[name] = mf
+	}
+	return mf
+}
+
+// Counter return the counter of name with label pairs,it is created if not exist
+func (mr *MetricRegistry) Counter(name string, help string, labels ...string) *MetricCounter {
+
+	mr.mutex.Lock()
+	defer mr.mutex.Unlock()
+
+	mf := mr.family(name, help, METRIC_TYPE_COUNTER)
+	key := formatMetricLabels(labels)
+	mc, ok := mf.counters[key]
+	if !ok {
+		mc = &MetricCounter{}
+		mf.counters[key] = mc
+	}
+	return mc
+}
+
+// Gauge return the gauge of name with label pairs,it is created if not exist
+func (mr *MetricRegistry) Gauge(name string, help string, labels ...string) *MetricGauge {
+
+	mr.mutex.Lock()
+	defer mr.mutex.Unlock()
+
+	mf := mr.family(name, help, METRIC_TYPE_GAUGE)
+	key := formatMetricLabels(labels)
+	mg, ok := mf.gauges[key]
+	if !ok {
+		mg = &MetricGauge{}
+		mf.gauges[key] = mg
+	}
+	return mg
+}
+
+// ResetGauge remove all label sets of gauge name,collectors use it before setting current values
+func (mr *MetricRegistry) ResetGauge(name string) {
+
+	mr.mutex.Lock()
+	defer mr.mutex.Unlock()
+
+	mf, ok := mr.families[name]
+	if ok {
+		mf.gauges = make(map[string]*MetricGauge)
+	}
+}
+
+// OnCollect register a function called before metrics are written,it is used to update gauges
+func (mr *MetricRegistry) OnCollect(collector func()) {
+
+	mr.mutex.Lock()
+	defer mr.mutex.Unlock()
+
+	mr.collectors = append(mr.collectors, collector)
+}
+
+func (mr *MetricRegistry) WriteTo(w io.Writer) (int64, error) {
+
+	mr.mutex.Lock()
+	collectors := mr.collectors
+	mr.mutex.Unlock()
+
+	for _, collector := range collectors {
+		collector()
+	}
+
+	mr.mutex.Lock()
+	defer mr.mutex.Unlock()
+
+	names := make([]string, 0, len(mr.families))
+	for name := range mr.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	sb := &strings.Builder{}
+
+	for _, name := range names {
+		mf := mr.families[name]
+		fmt.Fprintf(sb, "# HELP %s %s\n", mf.name, mf.help)
+		fmt.Fprintf(sb, "# TYPE %s %s\n", mf.name, mf.mtype)
+
+		values := make(map[string]string)
+		for labels, mc := range mf.counters {
+			values[labels] = strconv.FormatUint(mc.Value(), 10)
+		}
+		for labels, mg := range mf.gauges {
+			values[labels] = strconv.FormatFloat(mg.Value(), 'g', -1, 64)
+		}
+
+		keys := make([]string, 0, len(values))
+		for labels := range values {
+			keys = append(keys, labels)
+		}
+		sort.Strings(keys)
+
+		for _, labels := range keys {
+			fmt.Fprintf(sb, "%s%s %s\n", mf.name, labels, values[labels])
+		}
+	}
+
+	n, err := io.WriteString(w, sb.String())
+	return int64(n), err
+}
+
+func formatMetricLabels(labels []string) string {
+
+	if len(labels) < 2 {
+		return ""
+	}
+
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labels[i+1])
+		pairs = append(pairs, labels[i]+`="`+value+`"`)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (mr *MetricRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	mr.WriteTo(w)
+}
+
+// ListenMetrics serve /metrics at addr
+func ListenMetrics(wg *sync.WaitGroup, addr string) {
+
+	defer wg.Done()
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Metrics)
+	elog.Error(http.ListenAndServe(addr, mux))
+}
+
+var (
+	metricUpBytes        = Metrics.Counter("polevpn_traffic_bytes_total", "Bytes of ip data by direction.", "direction", "up")
+	metricDownBytes      = Metrics.Counter("polevpn_traffic_bytes_total", "Bytes of ip data by direction.", "direction", "down")
+	metricUpPackets      = Metrics.Counter("polevpn_traffic_packets_total", "Packets of ip data by direction.", "direction", "up")
+	metricDownPackets    = Metrics.Counter("polevpn_traffic_packets_total", "Packets of ip data by direction.", "direction", "down")
+	metricTunReadErrs    = Metrics.Counter("polevpn_tun_errors_total", "Tun device read and write errors.", "op", "read")
+	metricTunWriteErrs   = Metrics.Counter("polevpn_tun_errors_total", "Tun device read and write errors.", "op", "write")
+	metricQueueDrops     = Metrics.Counter("polevpn_dropped_packets_total", "Packets dropped by server.", "reason", "queue_full")
+	metricLimitDrops     = Metrics.Counter("polevpn_dropped_packets_total", "Packets dropped by server.", "reason", "traffic_limit")
+	metricACLDrops       = Metrics.Counter("polevpn_dropped_packets_total", "Packets dropped by server.", "reason", "acl")
+	metricIsolationDrops = Metrics.Counter("polevpn_dropped_packets_total", "Packets dropped by server.", "reason", "client_isolation")
+	metricSpoofDrops     = Metrics.Counter("polevpn_dropped_packets_total", "Packets dropped by server.", "reason", "spoofed_source")
+)
+
+func metricLogin(backend string, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	Metrics.Counter("polevpn_logins_total", "Login attempts by auth backend and result.", "backend", backend, "result", result).Inc()
+}
+
+// CollectConnMgrMetrics register the gauges of connections and address pool,they are computed from connmgr
+func CollectConnMgrMetrics(connmgr *ConnMgr) {
+
+	Metrics.OnCollect(func() {
+
+		counts := map[string]int{"ws": 0, "h3": 0}
+		for _, conn := range connmgr.GetConns() {
+			counts[conn.Transport()]++
+		}
+
+		Metrics.ResetGauge("polevpn_connections")
+		for transport, count := range counts {
+			Metrics.Gauge("polevpn_connections", "Active connections by transport.", "transport", transport).Set(float64(count))
+		}
+
+		total, used := connmgr.GetAddressPoolStats()
+		Metrics.Gauge("polevpn_address_pool_addresses", "Addresses of address pool by state.", "state", "used").Set(float64(used))
+		Metrics.Gauge("polevpn_address_pool_addresses", "Addresses of address pool by state.", "state", "free").Set(float64(total - used))
+	})
+}
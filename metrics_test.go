@@ -0,0 +1,37 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMetricRegistryWrite(t *testing.T) {
+
+	mr := NewMetricRegistry()
+	mr.Counter("test_bytes_total", "Test bytes.", "direction", "up").Add(100)
+	mr.Counter("test_bytes_total", "Test bytes.", "direction", "down").Inc()
+	mr.Counter("test_bytes_total", "Test bytes.", "direction", "up").Add(20)
+
+	mr.OnCollect(func() {
+		mr.ResetGauge("test_connections")
+		mr.Gauge("test_connections", "Test connections.", "transport", `w"s`).Set(3)
+	})
+
+	sb := &strings.Builder{}
+	_, err := mr.WriteTo(sb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := "# HELP test_bytes_total Test bytes.\n" +
+		"# TYPE test_bytes_total counter\n" +
+		"test_bytes_total{direction=\"down\"} 1\n" +
+		"test_bytes_total{direction=\"up\"} 120\n" +
+		"# HELP test_connections Test connections.\n" +
+		"# TYPE test_connections gauge\n" +
+		"test_connections{transport=\"w\\\"s\"} 3\n"
+
+	if sb.String() != expect {
+		t.Fatalf("expect:\n%v\ngot:\n%v", expect, sb.String())
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/des"
+	"crypto/sha1"
+	"encoding/hex"
+	"strings"
+	"unicode/utf16"
+
+	"golang.org/x/crypto/md4"
+)
+
+const (
+	MSCHAP_CHALLENGE_LEN   = 16
+	MSCHAP_NT_RESPONSE_LEN = 24
+	MSCHAP2_RESPONSE_LEN   = 50
+)
+
+var (
+	mschapMagic1 = []byte("Magic server to client signing constant")
+	mschapMagic2 = []byte("Pad to make it do more than one iteration")
+)
+
+// mschapNtPasswordHash is md4 of the utf-16le password,rfc 2759 section 8.3
+func mschapNtPasswordHash(pwd string) []byte {
+	h := md4.New()
+	for _, c := range utf16.Encode([]rune(pwd)) {
+		h.Write([]byte{byte(c), byte(c >> 8)})
+	}
+	return h.Sum(nil)
+}
+
+// mschapChallengeHash rfc 2759 section 8.2
+func mschapChallengeHash(peerChallenge []byte, authChallenge []byte, user string) []byte {
+	h := sha1.New()
+	h.Write(peerChallenge)
+	h.Write(authChallenge)
+	h.Write([]byte(user))
+	return h.Sum(nil)[:8]
+}
+
+// mschapDesKey spread 7 bytes to a 8 bytes des key,parity bits are left zero
+func mschapDesKey(key []byte) []byte {
+	return []byte{
+		key[0] & 0xfe,
+		key[0]<<7 | key[1]>>1,
+		key[1]<<6 | key[2]>>2,
+		key[2]<<5 | key[3]>>3,
+		key[3]<<4 | key[4]>>4,
+		key[4]<<3 | key[5]>>5,
+		key[5]<<2 | key[6]>>6,
+		key[6] << 1,
+	}
+}
+
+// mschapChallengeResponse encrypt challenge with the password hash split in three des keys,rfc 2759 section 8.5
+func mschapChallengeResponse(challenge []byte, pwdHash []byte) []byte {
+
+	key := make([]byte, 21)
+	copy(key, pwdHash)
+
+	resp := make([]byte, MSCHAP_NT_RESPONSE_LEN)
+	for i := 0; i < 3; i++ {
+		block, _ := des.NewCipher(mschapDesKey(key[i*7 : i*7+7]))
+		block.Encrypt(resp[i*8:], challenge)
+	}
+	return resp
+}
+
+// MSCHAPv2NtResponse generate the NT-Response of peer,rfc 2759 section 8.1
+func MSCHAPv2NtResponse(authChallenge []byte, peerChallenge []byte, user string, pwd string) []byte {
+	return mschapChallengeResponse(mschapChallengeHash(peerChallenge, authChallenge, user), mschapNtPasswordHash(pwd))
+}
+
+// MSCHAPv2AuthenticatorResponse generate the "S=" string authenticator proves it knows the password,rfc 2759 section 8.7
+func MSCHAPv2AuthenticatorResponse(authChallenge []byte, peerChallenge []byte, ntResponse []byte, user string, pwd string) string {
+
+	hashHash := md4.New()
+	hashHash.Write(mschapNtPasswordHash(pwd))
+
+	h := sha1.New()
+	h.Write(hashHash.Sum(nil))
+	h.Write(ntResponse)
+	h.Write(mschapMagic1)
+	digest := h.Sum(nil)
+
+	h = sha1.New()
+	h.Write(digest)
+	h.Write(mschapChallengeHash(peerChallenge, authChallenge, user))
+	h.Write(mschapMagic2)
+
+	return "S=" + strings.ToUpper(hex.EncodeToString(h.Sum(nil)))
+}
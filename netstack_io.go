@@ -0,0 +1,776 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/polevpn/elog"
+	"github.com/polevpn/netstack/tcpip"
+	"github.com/polevpn/netstack/tcpip/adapters/gonet"
+	"github.com/polevpn/netstack/tcpip/buffer"
+	"github.com/polevpn/netstack/tcpip/header"
+	"github.com/polevpn/netstack/tcpip/link/channel"
+	"github.com/polevpn/netstack/tcpip/network/arp"
+	"github.com/polevpn/netstack/tcpip/network/ipv4"
+	"github.com/polevpn/netstack/tcpip/network/ipv6"
+	"github.com/polevpn/netstack/tcpip/stack"
+	"github.com/polevpn/netstack/tcpip/transport/tcp"
+	"github.com/polevpn/netstack/tcpip/transport/udp"
+	"github.com/polevpn/netstack/waiter"
+	"golang.org/x/net/icmp"
+	xipv4 "golang.org/x/net/ipv4"
+	xipv6 "golang.org/x/net/ipv6"
+)
+
+const (
+	NETSTACK_NIC_ID             = 1
+	NETSTACK_CH_SIZE            = 4096
+	NETSTACK_TCP_MAX_CONNECTING = 1024
+	NETSTACK_UDP_BUFFER_SIZE    = 65535
+	NETSTACK_UDP_IDLE_TIMEOUT   = 60
+	NETSTACK_DIAL_TIMEOUT       = 5
+	NETSTACK_ICMP_TIMEOUT       = 5
+	NETSTACK_ICMP_TTL           = 64
+	NETSTACK_ICMP_MAX_PENDING   = 4096
+)
+
+// NetStackIO terminate tcp and udp flows of clients in a userspace netstack,and re-originate them
+// from sockets of the host,icmp echo is sent through ping sockets,so neither tun device nor nat rules are needed,
+// flows to the host itself are rejected,as the kernel drops them as martian packets in tun mode
+type NetStackIO struct {
+	stack       *stack.Stack
+	ep          *channel.Endpoint
+	handler     *PacketDispatcher
+	localIPs    map[string]bool
+	listenAddrs []string
+	ping4       *pingSocket
+	ping6       *pingSocket
+	closed      atomic.Bool
+	done        chan struct{}
+	mutex       *sync.RWMutex
+}
+
+func NewNetStackIO(mtu int, handler *PacketDispatcher) (*NetStackIO, error) {
+
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocol{ipv4.NewProtocol(), ipv6.NewProtocol(), arp.NewProtocol()},
+		TransportProtocols: []stack.TransportProtocol{tcp.NewProtocol(), udp.NewProtocol()},
+	})
+
+	ep := channel.New(NETSTACK_CH_SIZE, uint32(mtu), "")
+
+	if err := s.CreateNIC(NETSTACK_NIC_ID, ep); err != nil {
+		return nil, errors.New(err.String())
+	}
+
+	if err := s.AddAddress(NETSTACK_NIC_ID, arp.ProtocolNumber, arp.ProtocolAddress); err != nil {
+		return nil, errors.New(err.String())
+	}
+
+	//accept packets to any address,and route all packets back to the nic
+	subnet4, _ := tcpip.NewSubnet(tcpip.Address(make([]byte, net.IPv4len)), tcpip.AddressMask(make([]byte, net.IPv4len)))
+	subnet6, _ := tcpip.NewSubnet(tcpip.Address(make([]byte, net.IPv6len)), tcpip.AddressMask(make([]byte, net.IPv6len)))
+
+	if err := s.AddAddressRange(NETSTACK_NIC_ID, ipv4.ProtocolNumber, subnet4); err != nil {
+		return nil, errors.New(err.String())
+	}
+	if err := s.AddAddressRange(NETSTACK_NIC_ID, ipv6.ProtocolNumber, subnet6); err != nil {
+		return nil, errors.New(err.String())
+	}
+
+	s.SetRouteTable([]tcpip.Route{
+		{Destination: subnet4, NIC: NETSTACK_NIC_ID},
+		{Destination: subnet6, NIC: NETSTACK_NIC_ID},
+	})
+
+	ns := &NetStackIO{
+		stack:    s,
+		ep:       ep,
+		handler:  handler,
+		localIPs: make(map[string]bool),
+		done:     make(chan struct{}),
+		mutex:    &sync.RWMutex{},
+	}
+
+	tf := tcp.NewForwarder(s, 0, NETSTACK_TCP_MAX_CONNECTING, func(r *tcp.ForwarderRequest) {
+		go ns.forwardTCP(r)
+	})
+	s.SetTransportProtocolHandler(tcp.ProtocolNumber, tf.HandlePacket)
+
+	uf := udp.NewForwarder(s, func(r *udp.ForwarderRequest) {
+		go ns.forwardUDP(r)
+	})
+	s.SetTransportProtocolHandler(udp.ProtocolNumber, uf.HandlePacket)
+
+	return ns, nil
+}
+
+func netstackProtocol(ip net.IP) tcpip.NetworkProtocolNumber {
+	if ip.To4() != nil {
+		return ipv4.ProtocolNumber
+	}
+	return ipv6.ProtocolNumber
+}
+
+func netstackAddress(ip net.IP) tcpip.Address {
+	if ip4 := ip.To4(); ip4 != nil {
+		return tcpip.Address(ip4)
+	}
+	return tcpip.Address(ip.To16())
+}
+
+// AddAddress make ip an address of the netstack itself,packets to it aren't forwarded,
+// services listened on it by ListenUDP and ListenTCP,and icmp echo to it is answered by the netstack
+func (ns *NetStackIO) AddAddress(ip string) error {
+
+	nip := net.ParseIP(ip)
+	if nip == nil {
+		return errors.New("invalid ip address " + ip)
+	}
+
+	if err := ns.stack.AddAddress(NETSTACK_NIC_ID, netstackProtocol(nip), netstackAddress(nip)); err != nil {
+		return errors.New(err.String())
+	}
+
+	ns.mutex.Lock()
+	defer ns.mutex.Unlock()
+	ns.localIPs[nip.String()] = true
+	return nil
+}
+
+func (ns *NetStackIO) isLocalIP(ip net.IP) bool {
+	ns.mutex.RLock()
+	defer ns.mutex.RUnlock()
+	return ns.localIPs[ip.String()]
+}
+
+// SetListenAddrs set addresses the server listens on,client flows to them are rejected,
+// an unspecified ip matches every address of the host
+func (ns *NetStackIO) SetListenAddrs(addrs []string) {
+	ns.mutex.Lock()
+	defer ns.mutex.Unlock()
+	ns.listenAddrs = addrs
+}
+
+func isHostIP(ip net.IP) bool {
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		//can't tell,so treat it as the host
+		return true
+	}
+
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// isForbiddenDest check whether a client flow to ip and port would reach the host itself instead of the network,
+// port 0 means no port,such as icmp
+func (ns *NetStackIO) isForbiddenDest(ip net.IP, port int) bool {
+
+	if ip.IsLoopback() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return true
+	}
+
+	if port == 0 {
+		return false
+	}
+
+	ns.mutex.RLock()
+	addrs := ns.listenAddrs
+	ns.mutex.RUnlock()
+
+	for _, addr := range addrs {
+		host, lport, err := net.SplitHostPort(addr)
+		if err != nil || lport != strconv.Itoa(port) {
+			continue
+		}
+		lip := net.ParseIP(host)
+		if lip == nil || lip.IsUnspecified() {
+			if isHostIP(ip) {
+				return true
+			}
+		} else if lip.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (ns *NetStackIO) fullAddress(addr string) (*tcpip.FullAddress, tcpip.NetworkProtocolNumber, error) {
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, 0, errors.New("invalid ip address " + host)
+	}
+
+	nport, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return &tcpip.FullAddress{NIC: NETSTACK_NIC_ID, Addr: netstackAddress(ip), Port: uint16(nport)}, netstackProtocol(ip), nil
+}
+
+// ListenUDP listen udp at addr inside the netstack,the ip should be added by AddAddress
+func (ns *NetStackIO) ListenUDP(addr string) (net.PacketConn, error) {
+	laddr, proto, err := ns.fullAddress(addr)
+	if err != nil {
+		return nil, err
+	}
+	return gonet.DialUDP(ns.stack, laddr, nil, proto)
+}
+
+// ListenTCP listen tcp at addr inside the netstack,the ip should be added by AddAddress
+func (ns *NetStackIO) ListenTCP(addr string) (net.Listener, error) {
+	laddr, proto, err := ns.fullAddress(addr)
+	if err != nil {
+		return nil, err
+	}
+	return gonet.NewListener(ns.stack, *laddr, proto)
+}
+
+// Enqueue inject ip packet of client into the netstack,icmp echo requests are sent through ping sockets
+func (ns *NetStackIO) Enqueue(pkt []byte) error {
+
+	if ns.closed.Load() {
+		return errors.New("netstack closed")
+	}
+
+	if len(pkt) == 0 {
+		return nil
+	}
+
+	var proto tcpip.NetworkProtocolNumber
+	var dst net.IP
+
+	ver := pkt[0] >> 4
+	if ver == IPV4_PROTOCOL {
+		if len(pkt) < header.IPv4MinimumSize {
+			return nil
+		}
+		proto = ipv4.ProtocolNumber
+		dst = net.IP(header.IPv4(pkt).DestinationAddress())
+	} else if ver == IPV6_PROTOCOL {
+		if len(pkt) < header.IPv6MinimumSize {
+			return nil
+		}
+		proto = ipv6.ProtocolNumber
+		dst = net.IP(header.IPv6(pkt).DestinationAddress())
+	} else {
+		return nil
+	}
+
+	if isICMPEchoRequest(pkt) && !ns.isLocalIP(dst) {
+		ns.forwardICMP(pkt)
+		return nil
+	}
+
+	view := buffer.NewViewFromBytes(pkt)
+	ns.ep.InjectInbound(proto, tcpip.PacketBuffer{Data: view.ToVectorisedView()})
+	return nil
+}
+
+func (ns *NetStackIO) read() {
+
+	defer PanicHandler()
+
+	for {
+		info, err := ns.ep.Read()
+		if err != nil {
+			elog.Info("netstack read exit,", err)
+			return
+		}
+		view := buffer.NewVectorisedView(info.Pkt.Header.UsedLength(), []buffer.View{info.Pkt.Header.View()})
+		view.Append(info.Pkt.Data)
+		ns.handler.Dispatch(view.ToView())
+	}
+}
+
+func (ns *NetStackIO) StartProcess() {
+	go ns.read()
+}
+
+func (ns *NetStackIO) Close() error {
+
+	if ns.closed.Swap(true) {
+		return nil
+	}
+
+	close(ns.done)
+	ns.stack.Close()
+	ns.ep.Close()
+
+	ns.mutex.Lock()
+	defer ns.mutex.Unlock()
+	for _, ps := range []*pingSocket{ns.ping4, ns.ping6} {
+		if ps != nil {
+			ps.conn.Close()
+		}
+	}
+	return nil
+}
+
+func (ns *NetStackIO) forwardTCP(r *tcp.ForwarderRequest) {
+
+	defer PanicHandler()
+
+	id := r.ID()
+	raddr := net.JoinHostPort(net.IP(id.LocalAddress).String(), strconv.Itoa(int(id.LocalPort)))
+
+	if ns.isForbiddenDest(net.IP(id.LocalAddress), int(id.LocalPort)) {
+		elog.Debug("netstack tcp ", net.IP(id.RemoteAddress).String(), " to forbidden ", raddr)
+		r.Complete(true)
+		return
+	}
+
+	//dial first,so the client gets a reset if the remote refuses
+	remote, err := net.DialTimeout("tcp", raddr, time.Second*NETSTACK_DIAL_TIMEOUT)
+	if err != nil {
+		elog.Debug("netstack dial tcp ", raddr, " fail,", err)
+		r.Complete(true)
+		return
+	}
+
+	wq := &waiter.Queue{}
+	ep, terr := r.CreateEndpoint(wq)
+	if terr != nil {
+		elog.Error("netstack create tcp endpoint fail,", terr)
+		r.Complete(true)
+		remote.Close()
+		return
+	}
+	r.Complete(false)
+
+	local := gonet.NewConn(wq, ep)
+
+	elog.Debug("netstack tcp ", net.IP(id.RemoteAddress).String(), " connect to ", raddr)
+
+	go ns.pipeTCP(remote, local)
+	ns.pipeTCP(local, remote)
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// pipeTCP copy from src to dst,and half close dst when src reach eof
+func (ns *NetStackIO) pipeTCP(dst net.Conn, src net.Conn) {
+
+	defer PanicHandler()
+
+	_, err := io.Copy(dst, src)
+	if cw, ok := dst.(closeWriter); ok && err == nil {
+		cw.CloseWrite()
+		return
+	}
+	dst.Close()
+	src.Close()
+}
+
+func (ns *NetStackIO) forwardUDP(r *udp.ForwarderRequest) {
+
+	defer PanicHandler()
+
+	id := r.ID()
+	raddr := net.JoinHostPort(net.IP(id.LocalAddress).String(), strconv.Itoa(int(id.LocalPort)))
+
+	if ns.isForbiddenDest(net.IP(id.LocalAddress), int(id.LocalPort)) {
+		elog.Debug("netstack udp ", net.IP(id.RemoteAddress).String(), " to forbidden ", raddr)
+		return
+	}
+
+	wq := &waiter.Queue{}
+	ep, terr := r.CreateEndpoint(wq)
+	if terr != nil {
+		elog.Error("netstack create udp endpoint fail,", terr)
+		return
+	}
+
+	remote, err := net.Dial("udp", raddr)
+	if err != nil {
+		elog.Debug("netstack dial udp ", raddr, " fail,", err)
+		ep.Close()
+		return
+	}
+
+	var lastActive atomic.Int64
+	lastActive.Store(time.Now().UnixNano())
+
+	client := &tcpip.FullAddress{Addr: id.RemoteAddress, Port: id.RemotePort}
+
+	go func() {
+		defer PanicHandler()
+		defer ep.Close()
+		defer remote.Close()
+
+		buf := make([]byte, NETSTACK_UDP_BUFFER_SIZE)
+		for {
+			remote.SetReadDeadline(time.Now().Add(time.Second * NETSTACK_UDP_IDLE_TIMEOUT))
+			n, err := remote.Read(buf)
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() &&
+					time.Since(time.Unix(0, lastActive.Load())) < time.Second*NETSTACK_UDP_IDLE_TIMEOUT {
+					continue
+				}
+				return
+			}
+			lastActive.Store(time.Now().UnixNano())
+			_, _, terr := ep.Write(tcpip.SlicePayload(append([]byte{}, buf[:n]...)), tcpip.WriteOptions{To: client})
+			if terr != nil {
+				return
+			}
+		}
+	}()
+
+	entry, notifyCh := waiter.NewChannelEntry(nil)
+	wq.EventRegister(&entry, waiter.EventIn)
+	defer wq.EventUnregister(&entry)
+	defer remote.Close()
+
+	for {
+		v, _, terr := ep.Read(nil)
+		if terr == tcpip.ErrWouldBlock {
+			select {
+			case <-notifyCh:
+				continue
+			case <-ns.done:
+				ep.Close()
+				return
+			}
+		}
+		if terr != nil {
+			return
+		}
+		lastActive.Store(time.Now().UnixNano())
+		_, err := remote.Write(v)
+		if err != nil {
+			return
+		}
+	}
+}
+
+func isICMPEchoRequest(pkt []byte) bool {
+	protocol, payload := GetIPTransport(pkt)
+	if len(payload) < header.ICMPv4MinimumSize {
+		return false
+	}
+	if protocol == IP_PROTOCOL_ICMP {
+		return header.ICMPv4(payload).Type() == header.ICMPv4Echo
+	}
+	if protocol == IP_PROTOCOL_ICMPV6 {
+		return header.ICMPv6(payload).Type() == header.ICMPv6EchoRequest
+	}
+	return false
+}
+
+// listenICMP open an unprivileged ping socket,and fall back to raw socket
+func listenICMP(v4 bool) (*icmp.PacketConn, error) {
+	if v4 {
+		conn, err := icmp.ListenPacket("udp4", "0.0.0.0")
+		if err == nil {
+			return conn, nil
+		}
+		return icmp.ListenPacket("ip4:icmp", "0.0.0.0")
+	}
+	conn, err := icmp.ListenPacket("udp6", "::")
+	if err == nil {
+		return conn, nil
+	}
+	return icmp.ListenPacket("ip6:ipv6-icmp", "::")
+}
+
+type pingEntry struct {
+	src    net.IP
+	dst    net.IP
+	ident  uint16
+	seq    uint16
+	expire time.Time
+}
+
+// pingSocket is the icmp socket shared by echo requests of all clients of one address family,
+// requests are renumbered by seq,and replies matched back to clients by id and seq
+type pingSocket struct {
+	conn     *icmp.PacketConn
+	protocol int
+	msgType  icmp.Type
+	ident    int
+	seq      uint16
+	pending  map[uint16]*pingEntry
+	swept    time.Time
+	mutex    *sync.Mutex
+}
+
+func newPingSocket(v4 bool) (*pingSocket, error) {
+
+	conn, err := listenICMP(v4)
+	if err != nil {
+		return nil, err
+	}
+
+	ps := &pingSocket{
+		conn:     conn,
+		protocol: IP_PROTOCOL_ICMP,
+		msgType:  xipv4.ICMPTypeEcho,
+		ident:    os.Getpid() & 0xffff,
+		pending:  make(map[uint16]*pingEntry),
+		mutex:    &sync.Mutex{},
+	}
+	if !v4 {
+		ps.protocol = IP_PROTOCOL_ICMPV6
+		ps.msgType = xipv6.ICMPTypeEchoRequest
+	}
+	//ping socket of kernel replaces id with its port
+	if laddr, ok := conn.LocalAddr().(*net.UDPAddr); ok {
+		ps.ident = laddr.Port
+	}
+	return ps, nil
+}
+
+// sweep remove requests which are never answered,at most once a second,caller must hold the mutex
+func (ps *pingSocket) sweep(now time.Time) {
+
+	if now.Sub(ps.swept) < time.Second {
+		return
+	}
+	ps.swept = now
+
+	for seq, entry := range ps.pending {
+		if now.After(entry.expire) {
+			delete(ps.pending, seq)
+		}
+	}
+}
+
+func (ps *pingSocket) send(src net.IP, dst net.IP, ident uint16, seq uint16, data []byte) error {
+
+	now := time.Now()
+
+	ps.mutex.Lock()
+	ps.sweep(now)
+	if len(ps.pending) >= NETSTACK_ICMP_MAX_PENDING {
+		ps.mutex.Unlock()
+		return errors.New("too many pending icmp echo")
+	}
+	ps.seq++
+	out := ps.seq
+	ps.pending[out] = &pingEntry{src: src, dst: dst, ident: ident, seq: seq, expire: now.Add(time.Second * NETSTACK_ICMP_TIMEOUT)}
+	ps.mutex.Unlock()
+
+	msg := icmp.Message{Type: ps.msgType, Code: 0, Body: &icmp.Echo{ID: ps.ident, Seq: int(out), Data: data}}
+	b, err := msg.Marshal(nil)
+	if err == nil {
+		var raddr net.Addr = &net.IPAddr{IP: dst}
+		if _, ok := ps.conn.LocalAddr().(*net.UDPAddr); ok {
+			raddr = &net.UDPAddr{IP: dst}
+		}
+		_, err = ps.conn.WriteTo(b, raddr)
+	}
+
+	if err != nil {
+		ps.mutex.Lock()
+		delete(ps.pending, out)
+		ps.mutex.Unlock()
+	}
+	return err
+}
+
+// take return and remove the request which reply of seq from peer answers
+func (ps *pingSocket) take(seq uint16, peer net.IP) *pingEntry {
+
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	entry, ok := ps.pending[seq]
+	if !ok || peer == nil || !peer.Equal(entry.dst) {
+		return nil
+	}
+	delete(ps.pending, seq)
+
+	if time.Now().After(entry.expire) {
+		return nil
+	}
+	return entry
+}
+
+// getPingSocket return the shared ping socket of the address family,it is opened on first use
+func (ns *NetStackIO) getPingSocket(v4 bool) (*pingSocket, error) {
+
+	ns.mutex.Lock()
+	defer ns.mutex.Unlock()
+
+	if ns.closed.Load() {
+		return nil, errors.New("netstack closed")
+	}
+
+	ps := ns.ping6
+	if v4 {
+		ps = ns.ping4
+	}
+	if ps != nil {
+		return ps, nil
+	}
+
+	ps, err := newPingSocket(v4)
+	if err != nil {
+		return nil, err
+	}
+
+	if v4 {
+		ns.ping4 = ps
+	} else {
+		ns.ping6 = ps
+	}
+	go ns.readPing(ps, v4)
+	return ps, nil
+}
+
+// readPing answer clients with echo replies the ping socket receives,the socket is dropped on error,
+// and opened again by next request
+func (ns *NetStackIO) readPing(ps *pingSocket, v4 bool) {
+
+	defer PanicHandler()
+
+	buf := make([]byte, NETSTACK_UDP_BUFFER_SIZE)
+	for {
+		n, peer, err := ps.conn.ReadFrom(buf)
+		if err != nil {
+			if !ns.closed.Load() {
+				elog.Error("netstack read icmp fail,", err)
+			}
+			ns.mutex.Lock()
+			if ns.ping4 == ps {
+				ns.ping4 = nil
+			} else if ns.ping6 == ps {
+				ns.ping6 = nil
+			}
+			ns.mutex.Unlock()
+			ps.conn.Close()
+			return
+		}
+
+		reply, err := icmp.ParseMessage(ps.protocol, buf[:n])
+		if err != nil {
+			continue
+		}
+
+		body, ok := reply.Body.(*icmp.Echo)
+		if !ok || body.ID != ps.ident || (reply.Type != xipv4.ICMPTypeEchoReply && reply.Type != xipv6.ICMPTypeEchoReply) {
+			continue
+		}
+
+		entry := ps.take(uint16(body.Seq), addrIP(peer))
+		if entry == nil {
+			continue
+		}
+
+		ns.handler.Dispatch(buildEchoReply(entry.dst, entry.src, entry.ident, entry.seq, body.Data))
+	}
+}
+
+// forwardICMP send the echo request from the shared ping socket,reply is answered to the client by readPing
+func (ns *NetStackIO) forwardICMP(pkt []byte) {
+
+	v4 := pkt[0]>>4 == IPV4_PROTOCOL
+
+	//echo is found the way isICMPEchoRequest found it,past any ipv6 extension headers
+	_, echo := GetIPTransport(pkt)
+
+	var src, dst net.IP
+	if v4 {
+		ippkt := header.IPv4(pkt)
+		src, dst = net.IP(ippkt.SourceAddress()), net.IP(ippkt.DestinationAddress())
+	} else {
+		ippkt := header.IPv6(pkt)
+		src, dst = net.IP(ippkt.SourceAddress()), net.IP(ippkt.DestinationAddress())
+	}
+
+	if ns.isForbiddenDest(dst, 0) {
+		elog.Debug("netstack icmp ", src.String(), " to forbidden ", dst.String())
+		return
+	}
+
+	ident := uint16(echo[4])<<8 | uint16(echo[5])
+	seq := uint16(echo[6])<<8 | uint16(echo[7])
+	data := append([]byte{}, echo[header.ICMPv4MinimumSize:]...)
+
+	ps, err := ns.getPingSocket(v4)
+	if err != nil {
+		elog.Debug("netstack listen icmp fail,", err)
+		return
+	}
+
+	err = ps.send(append(net.IP{}, src...), append(net.IP{}, dst...), ident, seq, data)
+	if err != nil {
+		elog.Debug("netstack send icmp echo to ", dst.String(), " fail,", err)
+	}
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.IPAddr:
+		return a.IP
+	}
+	return nil
+}
+
+// buildEchoReply build ip packet of icmp echo reply from src to dst
+func buildEchoReply(src net.IP, dst net.IP, ident uint16, seq uint16, data []byte) []byte {
+
+	if src.To4() != nil {
+		pkt := make([]byte, header.IPv4MinimumSize+header.ICMPv4MinimumSize+len(data))
+		ippkt := header.IPv4(pkt)
+		ippkt.Encode(&header.IPv4Fields{
+			IHL:         header.IPv4MinimumSize,
+			TotalLength: uint16(len(pkt)),
+			TTL:         NETSTACK_ICMP_TTL,
+			Protocol:    IP_PROTOCOL_ICMP,
+			SrcAddr:     tcpip.Address(src.To4()),
+			DstAddr:     tcpip.Address(dst.To4()),
+		})
+		ippkt.SetChecksum(^ippkt.CalculateChecksum())
+
+		icmppkt := header.ICMPv4(ippkt.Payload())
+		icmppkt.SetType(header.ICMPv4EchoReply)
+		icmppkt.SetIdent(ident)
+		icmppkt.SetSequence(seq)
+		copy(icmppkt[header.ICMPv4MinimumSize:], data)
+		icmppkt.SetChecksum(^header.Checksum(icmppkt, 0))
+		return pkt
+	}
+
+	pkt := make([]byte, header.IPv6MinimumSize+header.ICMPv6EchoMinimumSize+len(data))
+	ippkt := header.IPv6(pkt)
+	ippkt.Encode(&header.IPv6Fields{
+		PayloadLength: uint16(len(pkt) - header.IPv6MinimumSize),
+		NextHeader:    IP_PROTOCOL_ICMPV6,
+		HopLimit:      NETSTACK_ICMP_TTL,
+		SrcAddr:       tcpip.Address(src.To16()),
+		DstAddr:       tcpip.Address(dst.To16()),
+	})
+
+	icmppkt := header.ICMPv6(ippkt.Payload())
+	icmppkt.SetType(header.ICMPv6EchoReply)
+	icmppkt[4], icmppkt[5] = byte(ident>>8), byte(ident)
+	icmppkt[6], icmppkt[7] = byte(seq>>8), byte(seq)
+	copy(icmppkt[header.ICMPv6EchoMinimumSize:], data)
+	icmppkt.SetChecksum(header.ICMPv6Checksum(icmppkt, ippkt.SourceAddress(), ippkt.DestinationAddress(), buffer.VectorisedView{}))
+	return pkt
+}
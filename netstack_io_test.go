@@ -0,0 +1,217 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/polevpn/netstack/tcpip"
+	"github.com/polevpn/netstack/tcpip/header"
+)
+
+type chanConn struct {
+	testConn
+	pkts chan []byte
+}
+
+func (cc *chanConn) Send(pkt []byte) { cc.pkts <- pkt }
+
+func buildUDPPacket(src net.IP, srcPort uint16, dst net.IP, dstPort uint16, data []byte) []byte {
+
+	pkt := make([]byte, header.IPv4MinimumSize+header.UDPMinimumSize+len(data))
+
+	ippkt := header.IPv4(pkt)
+	ippkt.Encode(&header.IPv4Fields{
+		IHL:         header.IPv4MinimumSize,
+		TotalLength: uint16(len(pkt)),
+		TTL:         64,
+		Protocol:    IP_PROTOCOL_UDP,
+		SrcAddr:     tcpip.Address(src.To4()),
+		DstAddr:     tcpip.Address(dst.To4()),
+	})
+	ippkt.SetChecksum(^ippkt.CalculateChecksum())
+
+	udppkt := header.UDP(ippkt.Payload())
+	udppkt.Encode(&header.UDPFields{SrcPort: srcPort, DstPort: dstPort, Length: uint16(len(udppkt))})
+	copy(udppkt.Payload(), data)
+	return pkt
+}
+
+// hostIPv4 return a non loopback ipv4 address of the host,clients can't reach loopback through netstack
+func hostIPv4(t *testing.T) net.IP {
+
+	addrs, _ := net.InterfaceAddrs()
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil && !ipnet.IP.IsLoopback() && !ipnet.IP.IsLinkLocalUnicast() {
+			return ipnet.IP.To4()
+		}
+	}
+	t.Skip("no non loopback ipv4 address")
+	return nil
+}
+
+func newTestNetStackIO(t *testing.T) (*NetStackIO, *chanConn) {
+
+	connmgr := NewConnMgr()
+	conn := &chanConn{testConn: testConn{id: "conn1"}, pkts: make(chan []byte, 10)}
+	connmgr.AttachIPAddressToConn("10.8.0.2", conn)
+
+	dispatcher := NewPacketDispatcher()
+	dispatcher.SetConnMgr(connmgr)
+	dispatcher.SetRouterMgr(NewRouterMgr())
+
+	ns, err := NewNetStackIO(TUN_MTU, dispatcher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns.StartProcess()
+	return ns, conn
+}
+
+func udpEchoServer(t *testing.T, ip net.IP) net.PacketConn {
+
+	server, err := net.ListenPacket("udp4", net.JoinHostPort(ip.String(), "0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := server.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			server.WriteTo(append([]byte("echo:"), buf[:n]...), addr)
+		}
+	}()
+	return server
+}
+
+func TestNetStackIOUDP(t *testing.T) {
+
+	server := udpEchoServer(t, hostIPv4(t))
+	defer server.Close()
+
+	ns, conn := newTestNetStackIO(t)
+	defer ns.Close()
+
+	client := net.ParseIP("10.8.0.2")
+	remote := server.LocalAddr().(*net.UDPAddr)
+
+	err := ns.Enqueue(buildUDPPacket(client, 5000, remote.IP, uint16(remote.Port), []byte("hello")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case pkt := <-conn.pkts:
+		ippkt := header.IPv4(PolePacket(pkt).Payload())
+		if !net.IP(ippkt.DestinationAddress()).Equal(client) || !net.IP(ippkt.SourceAddress()).Equal(remote.IP) {
+			t.Fatalf("unexpected addresses %v -> %v", ippkt.SourceAddress(), ippkt.DestinationAddress())
+		}
+		udppkt := header.UDP(ippkt.Payload())
+		if udppkt.SourcePort() != uint16(remote.Port) || udppkt.DestinationPort() != 5000 {
+			t.Fatalf("unexpected ports %v -> %v", udppkt.SourcePort(), udppkt.DestinationPort())
+		}
+		if string(udppkt.Payload()) != "echo:hello" {
+			t.Fatalf("unexpected payload %q", udppkt.Payload())
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("no reply from netstack")
+	}
+}
+
+func TestNetStackIOForbiddenDest(t *testing.T) {
+
+	ns, conn := newTestNetStackIO(t)
+	defer ns.Close()
+
+	hostIP := hostIPv4(t)
+	ns.SetListenAddrs([]string{"0.0.0.0:443", "10.1.1.1:9100"})
+
+	cases := map[string]bool{
+		"127.0.0.1:8443":                         true,
+		"[::1]:9100":                             true,
+		"0.0.0.0:80":                             true,
+		"169.254.1.1:80":                         true,
+		"[fe80::1]:80":                           true,
+		"10.1.1.1:9100":                          true,
+		"10.1.1.1:9101":                          false,
+		"8.8.8.8:443":                            false,
+		net.JoinHostPort(hostIP.String(), "443"): true,
+		net.JoinHostPort(hostIP.String(), "444"): false,
+	}
+	for addr, forbidden := range cases {
+		host, port, _ := net.SplitHostPort(addr)
+		nport, _ := strconv.Atoi(port)
+		if ns.isForbiddenDest(net.ParseIP(host), nport) != forbidden {
+			t.Fatalf("%v forbidden should be %v", addr, forbidden)
+		}
+	}
+
+	//udp to a loopback service of the host gets no answer
+	server := udpEchoServer(t, net.ParseIP("127.0.0.1"))
+	defer server.Close()
+	remote := server.LocalAddr().(*net.UDPAddr)
+
+	ns.Enqueue(buildUDPPacket(net.ParseIP("10.8.0.2"), 5000, remote.IP, uint16(remote.Port), []byte("hello")))
+
+	select {
+	case <-conn.pkts:
+		t.Fatal("udp to loopback should be dropped")
+	case <-time.After(time.Millisecond * 300):
+	}
+}
+
+func TestNetStackIOICMPEcho(t *testing.T) {
+
+	conn, err := listenICMP(true)
+	if err != nil {
+		t.Skip("icmp socket not permitted,", err)
+	}
+	conn.Close()
+
+	ns, client := newTestNetStackIO(t)
+	defer ns.Close()
+
+	hostIP := hostIPv4(t)
+	echoRequest := func(dst net.IP, ident uint16, seq uint16) []byte {
+		pkt := buildEchoReply(net.ParseIP("10.8.0.2"), dst, ident, seq, []byte("ping"))
+		icmppkt := header.ICMPv4(header.IPv4(pkt).Payload())
+		icmppkt.SetType(header.ICMPv4Echo)
+		icmppkt.SetChecksum(0)
+		icmppkt.SetChecksum(^header.Checksum(icmppkt, 0))
+		return pkt
+	}
+
+	//echoes of different clients share one socket,replies carry the id and seq of each request
+	ns.Enqueue(echoRequest(hostIP, 100, 1))
+	ns.Enqueue(echoRequest(hostIP, 200, 1))
+
+	got := map[uint16]bool{}
+	for len(got) < 2 {
+		select {
+		case pkt := <-client.pkts:
+			icmppkt := header.ICMPv4(header.IPv4(PolePacket(pkt).Payload()).Payload())
+			if icmppkt.Type() != header.ICMPv4EchoReply || icmppkt.Sequence() != 1 {
+				t.Fatalf("unexpected icmp type %v,seq %v", icmppkt.Type(), icmppkt.Sequence())
+			}
+			got[icmppkt.Ident()] = true
+		case <-time.After(time.Second * 5):
+			t.Fatalf("echo replies missing,got %v", got)
+		}
+	}
+	if !got[100] || !got[200] {
+		t.Fatalf("unexpected reply idents %v", got)
+	}
+
+	//echo to loopback is dropped
+	ns.Enqueue(echoRequest(net.ParseIP("127.0.0.1"), 300, 1))
+	ns.ping4.mutex.Lock()
+	defer ns.ping4.mutex.Unlock()
+	if len(ns.ping4.pending) != 0 {
+		t.Fatal("echo to loopback should not be sent")
+	}
+}
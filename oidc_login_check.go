@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_OIDC_USER_CLAIM   = "sub"
+	DEFAULT_OIDC_GROUPS_CLAIM = "groups"
+	DEFAULT_OIDC_LEEWAY       = 60
+)
+
+// OIDCLoginChecker accept a jwt issued by the sso as password,the user and groups are mapped from its claims,
+// other passwords are checked by next
+type OIDCLoginChecker struct {
+	next  LoginChecker
+	jwks  *JWKS
+	now   func() time.Time
+	mutex *sync.Mutex
+}
+
+func NewOIDCLoginChecker(next LoginChecker) *OIDCLoginChecker {
+	return &OIDCLoginChecker{next: next, now: time.Now, mutex: &sync.Mutex{}}
+}
+
+func (oc *OIDCLoginChecker) CheckLogin(user string, pwd string, remoteIp string, deviceType string, deviceId string) (*UserPolicy, error) {
+
+	if Config().Has("auth.oidc") && isJWT(pwd) {
+		policy, err := oc.checkToken(user, pwd)
+		metricLogin("oidc", err)
+		return policy, err
+	}
+
+	if oc.next == nil {
+		return nil, errors.New("no auth backend configured")
+	}
+	return oc.next.CheckLogin(user, pwd, remoteIp, deviceType, deviceId)
+}
+
+func (oc *OIDCLoginChecker) getJWKS(source string) *JWKS {
+
+	oc.mutex.Lock()
+	defer oc.mutex.Unlock()
+
+	if oc.jwks == nil || oc.jwks.Source() != source {
+		oc.jwks = NewJWKS(source, time.Duration(Config().Get("auth.oidc.jwks_refresh").AsInt(DEFAULT_JWKS_REFRESH))*time.Second)
+	}
+	return oc.jwks
+}
+
+// checkToken verify signature,issuer,audience and time of token,then map claims to user and groups,
+// the user client claims must be the one in token
+func (oc *OIDCLoginChecker) checkToken(user string, token string) (*UserPolicy, error) {
+
+	source := Config().Get("auth.oidc.jwks").AsStr()
+	if source == "" {
+		return nil, errors.New("oidc jwks not configured")
+	}
+
+	claims, err := VerifyJWT(token, oc.getJWKS(source).GetKey)
+	if err != nil {
+		return nil, err
+	}
+
+	issuer := Config().Get("auth.oidc.issuer").AsStr()
+	if issuer != "" && claims["iss"] != issuer {
+		return nil, fmt.Errorf("unexpected jwt issuer %v", claims["iss"])
+	}
+
+	audience := Config().Get("auth.oidc.audience").AsStr()
+	if audience == "" {
+		return nil, errors.New("oidc audience not configured")
+	}
+	if !containsString(claimStrs(claims["aud"]), audience) {
+		return nil, fmt.Errorf("jwt audience %v doesn't match", claims["aud"])
+	}
+
+	leeway := int64(Config().Get("auth.oidc.leeway").AsInt(DEFAULT_OIDC_LEEWAY))
+	now := oc.now().Unix()
+
+	exp, ok := claims["exp"].(float64)
+	if !ok || now >= int64(exp)+leeway {
+		return nil, errors.New("jwt expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now+leeway < int64(nbf) {
+		return nil, errors.New("jwt not valid yet")
+	}
+
+	userClaim := Config().Get("auth.oidc.user_claim").AsStr()
+	if userClaim == "" {
+		userClaim = DEFAULT_OIDC_USER_CLAIM
+	}
+	mappedUser, _ := claims[userClaim].(string)
+	if mappedUser == "" {
+		return nil, fmt.Errorf("jwt has no %v claim", userClaim)
+	}
+	if user != "" && user != mappedUser {
+		return nil, fmt.Errorf("jwt is issued to %v,not %v", mappedUser, user)
+	}
+
+	groupsClaim := Config().Get("auth.oidc.groups_claim").AsStr()
+	if groupsClaim == "" {
+		groupsClaim = DEFAULT_OIDC_GROUPS_CLAIM
+	}
+
+	return &UserPolicy{User: mappedUser, Groups: claimStrs(claims[groupsClaim])}, nil
+}
+
+// claimStrs return a claim which is a string or an array of strings as string slice,
+// a string is split by spaces or commas
+func claimStrs(claim interface{}) []string {
+
+	var strs []string
+	switch v := claim.(type) {
+	case string:
+		strs = strings.FieldsFunc(v, func(c rune) bool { return c == ' ' || c == ',' })
+	case []interface{}:
+		for _, item := range v {
+			if s, ok := item.(string); ok && s != "" {
+				strs = append(strs, s)
+			}
+		}
+	}
+	return strs
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/polevpn/anyvalue"
+)
+
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// signTestJWT sign claims with RS256 or ES256 by the type of key
+func signTestJWT(t *testing.T, key crypto.Signer, kid string, claims map[string]interface{}) string {
+
+	alg := "RS256"
+	if _, ok := key.(*ecdsa.PrivateKey); ok {
+		alg = "ES256"
+	}
+
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	input := b64(header) + "." + b64(payload)
+	digest := sha256.Sum256([]byte(input))
+
+	var sig []byte
+	var err error
+	if ec, ok := key.(*ecdsa.PrivateKey); ok {
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, ec, digest[:])
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	} else {
+		sig, err = key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return input + "." + b64(sig)
+}
+
+func testJWKS(rsaKey *rsa.PrivateKey, ecKey *ecdsa.PrivateKey) []byte {
+	e := big.NewInt(int64(rsaKey.E)).Bytes()
+	data, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa1", "use": "sig", "n": b64(rsaKey.N.Bytes()), "e": b64(e)},
+		{"kty": "EC", "kid": "ec1", "crv": "P-256", "x": b64(ecKey.X.FillBytes(make([]byte, 32))), "y": b64(ecKey.Y.FillBytes(make([]byte, 32)))},
+	}})
+	return data
+}
+
+func TestOIDCLoginChecker(t *testing.T) {
+
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	err := os.WriteFile(jwksFile, testJWKS(rsaKey, ecKey), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldConfig := Config()
+	SetConfig(anyvalue.New())
+	Config().Set("auth.oidc.issuer", "https://sso.example.com")
+	Config().Set("auth.oidc.audience", "polevpn")
+	Config().Set("auth.oidc.jwks", jwksFile)
+	Config().Set("auth.oidc.user_claim", "email")
+	defer func() { SetConfig(oldConfig) }()
+
+	oc := NewOIDCLoginChecker(&staticLoginChecker{user: "bob", pwd: "123456"})
+
+	claims := func() map[string]interface{} {
+		return map[string]interface{}{
+			"iss":    "https://sso.example.com",
+			"aud":    []string{"polevpn", "other"},
+			"sub":    "00u1",
+			"email":  "alice@example.com",
+			"groups": []string{"dev", "ops"},
+			"exp":    time.Now().Add(time.Hour).Unix(),
+		}
+	}
+
+	for _, key := range []crypto.Signer{rsaKey, ecKey} {
+		kid := "rsa1"
+		if key == crypto.Signer(ecKey) {
+			kid = "ec1"
+		}
+		policy, err := oc.CheckLogin("", signTestJWT(t, key, kid, claims()), "1.1.1.1", "ios", "device1")
+		if err != nil {
+			t.Fatalf("%v login fail,%v", kid, err)
+		}
+		if policy.User != "alice@example.com" || len(policy.Groups) != 2 || policy.Groups[1] != "ops" {
+			t.Fatalf("unexpected policy %+v", policy)
+		}
+	}
+
+	bad := map[string]func(c map[string]interface{}){
+		"audience": func(c map[string]interface{}) { c["aud"] = "other" },
+		"issuer":   func(c map[string]interface{}) { c["iss"] = "https://evil.example.com" },
+		"expired":  func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Hour).Unix() },
+		"no exp":   func(c map[string]interface{}) { delete(c, "exp") },
+		"no user":  func(c map[string]interface{}) { delete(c, "email") },
+	}
+	for name, modify := range bad {
+		c := claims()
+		modify(c)
+		if _, err = oc.CheckLogin("", signTestJWT(t, rsaKey, "rsa1", c), "", "", ""); err == nil {
+			t.Fatalf("jwt with bad %v should fail", name)
+		}
+	}
+
+	if _, err = oc.CheckLogin("", signTestJWT(t, otherKey, "rsa1", claims()), "", "", ""); err == nil {
+		t.Fatal("jwt signed by other key should fail")
+	}
+
+	if _, err = oc.CheckLogin("mallory", signTestJWT(t, rsaKey, "rsa1", claims()), "", "", ""); err == nil {
+		t.Fatal("jwt of other user should fail")
+	}
+
+	//passwords go to next checker
+	if _, err = oc.CheckLogin("bob", "123456", "", "", ""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJWKSFromURL(t *testing.T) {
+
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	fetches := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		w.Write(testJWKS(rsaKey, ecKey))
+	}))
+	defer server.Close()
+
+	jwks := NewJWKS(server.URL, time.Hour)
+	now := time.Now()
+	jwks.now = func() time.Time { return now }
+
+	if _, err := jwks.GetKey("rsa1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := jwks.GetKey("ec1"); err != nil || fetches != 1 {
+		t.Fatalf("keys should be cached,fetches:%v,%v", fetches, err)
+	}
+
+	//unknown kid reloads keys,but not more than once a minute
+	jwks.GetKey("rsa2")
+	now = now.Add(time.Minute)
+	jwks.GetKey("rsa2")
+	if fetches != 2 {
+		t.Fatalf("expected 2 fetches,got %v", fetches)
+	}
+}
+
+func TestCheckUserLoginWithJWT(t *testing.T) {
+
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	os.WriteFile(jwksFile, testJWKS(rsaKey, ecKey), 0600)
+
+	oldConfig := Config()
+	SetConfig(anyvalue.New())
+	Config().Set("auth.oidc.audience", "polevpn")
+	Config().Set("auth.oidc.jwks", jwksFile)
+	defer func() { SetConfig(oldConfig) }()
+
+	addresspool, _ := NewAddressPool("10.8.0.0/24", map[string]string{})
+	connmgr := NewConnMgr()
+	connmgr.SetAddressPool(addresspool)
+	requestHandler := NewRequestHandler()
+	requestHandler.SetConnMgr(connmgr)
+
+	hs := NewHttpServer(0, 0, requestHandler)
+	hs.SetLoginCheckHandler(NewOIDCLoginChecker(nil))
+
+	token := signTestJWT(t, rsaKey, "rsa1", map[string]interface{}{"aud": "polevpn", "sub": "alice", "exp": time.Now().Add(time.Hour).Unix()})
+
+	//user comes from the sub claim when client sends only the bearer token
+	status, user, _ := hs.checkUserLogin(&LoginRequest{Pwd: token, RemoteIp: "1.1.1.1", DeviceType: "ios", DeviceId: "device1"})
+	if status != http.StatusOK || user != "alice" {
+		t.Fatalf("login with jwt fail,status:%v,user:%v", status, user)
+	}
+
+	status, _, _ = hs.checkUserLogin(&LoginRequest{Pwd: "123456", RemoteIp: "1.1.1.1", DeviceType: "ios", DeviceId: "device1"})
+	if status != http.StatusForbidden {
+		t.Fatalf("login without user should fail,status:%v", status)
+	}
+}
@@ -15,6 +15,7 @@ const (
 type PacketDispatcher struct {
 	connmgr   *ConnMgr
 	routermgr *RouterMgr
+	acl       *ACL
 }
 
 func NewPacketDispatcher() *PacketDispatcher {
@@ -30,22 +31,46 @@ func (p *PacketDispatcher) SetRouterMgr(routermgr *RouterMgr) {
 	p.routermgr = routermgr
 }
 
+func (p *PacketDispatcher) SetACL(acl *ACL) {
+	p.acl = acl
+}
+
 func (p *PacketDispatcher) Dispatch(pkt []byte) {
 
-	ver := pkt[0]
-	ver = ver >> 4
-	if ver != IPV4_PROTOCOL {
+	if len(pkt) == 0 {
+		return
+	}
+
+	//tun or netstack may deliver packets before the dispatcher is wired,a panic there exits the process
+	if p.connmgr == nil || p.routermgr == nil {
+		elog.Debug("packet dispatcher not ready,drop pkt")
 		return
 	}
 
-	ipv4pkt := header.IPv4(pkt)
+	var ip net.IP
+	var conn Conn
 
-	ip := ipv4pkt.DestinationAddress().To4()
+	ver := pkt[0]
+	ver = ver >> 4
+	if ver == IPV4_PROTOCOL {
+		if len(pkt) < header.IPv4MinimumSize {
+			return
+		}
+		ip = net.IP(header.IPv4(pkt).DestinationAddress().To4())
+		conn = p.connmgr.GetConnByIP(ip.String())
+	} else if ver == IPV6_PROTOCOL {
+		if len(pkt) < header.IPv6MinimumSize {
+			return
+		}
+		ip = net.IP(header.IPv6(pkt).DestinationAddress())
+		conn = p.connmgr.GetConnByIP6(ip.String())
+	} else {
+		return
+	}
 	ipstr := ip.String()
-	conn := p.connmgr.GetConnByIP(ipstr)
 
 	if conn == nil {
-		gw := p.routermgr.FindRoute(net.IP(ip))
+		gw := p.routermgr.FindRoute(ip)
 		conn = p.connmgr.GetConnByIP(gw)
 	}
 
@@ -53,6 +78,12 @@ func (p *PacketDispatcher) Dispatch(pkt []byte) {
 		elog.Debug("connmgr can't find wsconn for ", ipstr)
 		return
 	}
+
+	if p.acl != nil && !p.acl.Check(p.connmgr.GetConnAttachUser(conn), p.connmgr.GetConnGroups(conn), pkt, true) {
+		elog.Debug("acl deny pkt to ", ipstr)
+		metricACLDrops.Inc()
+		return
+	}
 	buf := make([]byte, len(pkt)+POLE_PACKET_HEADER_LEN)
 	copy(buf[POLE_PACKET_HEADER_LEN:], pkt)
 	resppkt := PolePacket(buf)
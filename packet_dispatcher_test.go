@@ -0,0 +1,20 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/polevpn/netstack/tcpip/header"
+)
+
+func TestDispatchWithoutConnMgr(t *testing.T) {
+
+	pkt := make([]byte, header.IPv6MinimumSize)
+	pkt[0] = IPV6_PROTOCOL << 4
+
+	//must not panic before SetConnMgr and SetRouterMgr
+	NewPacketDispatcher().Dispatch(pkt)
+
+	pkt = make([]byte, header.IPv4MinimumSize)
+	pkt[0] = IPV4_PROTOCOL<<4 | 5
+	NewPacketDispatcher().Dispatch(pkt)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// PasswdCommand implement "polevpn_server passwd [-file path] [-algo bcrypt|argon2id] user",
+// it writes the hashed password of user to the credential file
+func PasswdCommand(args []string) error {
+
+	fs := flag.NewFlagSet("passwd", flag.ContinueOnError)
+	filePath := fs.String("file", "./users.credentials", "credential file path")
+	algo := fs.String("algo", "bcrypt", "password hash algorithm,bcrypt or argon2id")
+
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		return errors.New("usage: polevpn_server passwd [-file path] [-algo bcrypt|argon2id] user")
+	}
+
+	user := fs.Arg(0)
+	if user == "" || strings.ContainsAny(user, ",\r\n") {
+		return errors.New("invalid user name")
+	}
+
+	pwd, err := readNewPassword()
+	if err != nil {
+		return err
+	}
+
+	hash, err := HashPassword(*algo, pwd)
+	if err != nil {
+		return err
+	}
+
+	err = updateCredentialFile(*filePath, user, func(fields []string) []string {
+		if fields == nil {
+			return []string{user, hash}
+		}
+		fields[1] = hash
+		return fields
+	})
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("password of %v updated in %v\n", user, *filePath)
+	return nil
+}
+
+func readNewPassword() (string, error) {
+
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		pwd := strings.Trim(line, "\r\n")
+		if pwd == "" {
+			return "", errors.New("empty password")
+		}
+		return pwd, nil
+	}
+
+	fmt.Print("New password: ")
+	pwd, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Println()
+	if err != nil {
+		return "", err
+	}
+
+	fmt.Print("Retype new password: ")
+	pwd2, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Println()
+	if err != nil {
+		return "", err
+	}
+
+	if string(pwd) != string(pwd2) {
+		return "", errors.New("passwords do not match")
+	}
+
+	if len(pwd) == 0 {
+		return "", errors.New("empty password")
+	}
+
+	return string(pwd), nil
+}
+
+// updateCredentialFile rewrite the line of user with the fields update return,
+// update get nil if user not exist,the file is replaced atomically
+func updateCredentialFile(filePath string, user string, update func(fields []string) []string) error {
+
+	data, err := os.ReadFile(filePath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	lines := make([]string, 0)
+	found := false
+
+	if len(data) > 0 {
+		for _, line := range strings.Split(strings.TrimRight(string(data), "\r\n"), "\n") {
+			line = strings.TrimRight(line, "\r")
+			fields := SplitCredentialLine(line)
+			if len(fields) >= 2 && fields[0] == user {
+				line = strings.Join(update(fields), ",")
+				found = true
+			}
+			lines = append(lines, line)
+		}
+	}
+
+	if !found {
+		lines = append(lines, strings.Join(update(nil), ","))
+	}
+
+	tmpfile, err := os.CreateTemp(filepath.Dir(filePath), ".credentials")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpfile.Name())
+
+	_, err = tmpfile.WriteString(strings.Join(lines, "\n") + "\n")
+	if err != nil {
+		tmpfile.Close()
+		return err
+	}
+
+	err = tmpfile.Chmod(0600)
+	if err != nil {
+		tmpfile.Close()
+		return err
+	}
+
+	err = tmpfile.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpfile.Name(), filePath)
+}
@@ -10,6 +10,8 @@ const (
 	CMD_CLIENT_CLOSED = 0x5
 	CMD_KICK_OUT      = 0x6
 	CMD_USER_AUTH     = 0x7
+	CMD_SERVER_GOAWAY = 0x8
+	CMD_USER_OTP      = 0x9
 )
 
 const (
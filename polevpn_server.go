@@ -1,21 +1,45 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/polevpn/anyvalue"
 	"github.com/polevpn/elog"
 )
 
+const (
+	EGRESS_MODE_TUN       = "tun"
+	EGRESS_MODE_USERSPACE = "userspace"
+)
+
+// config keys which can't be applied without restart
+var restartConfigKeys = []string{"endpoint", "tun", "network_cidr", "network_cidr6", "admin", "metrics", "accounting", "egress_mode", "dns_server.enable", "dns_server.port", "session_token.secret", "session_token.ttl", "auth.radius.acct_servers", "auth.radius.interim_interval", "auth.client_cert.ca", "auth.client_cert.crl", "auth.client_cert.ocsp", "auth.client_cert.required", "auth.client_cert.mode"}
+
 type PoleVPNServer struct {
+	config         *anyvalue.AnyValue
+	connmgr        *ConnMgr
+	routermgr      *RouterMgr
+	httpServer     *HttpServer
+	egress         PacketEgress
+	accounting     *TrafficAccounting
+	radiusAcct     *RadiusAccounting
+	acl            *ACL
+	requestHandler *RequestHandler
+	dnsServer      *DNSServer
+	adminServer    *AdminServer
+	mutex          *sync.Mutex
 }
 
 func NewPoleVPNServer() *PoleVPNServer {
-	return &PoleVPNServer{}
+	return &PoleVPNServer{mutex: &sync.Mutex{}}
 }
 
-func (ps *PoleVPNServer) Start(config *anyvalue.AnyValue) error {
-	var err error
+func getBindIPs(config *anyvalue.AnyValue) map[string]string {
 	bindips := make(map[string]string)
 	bindiparr := config.Get("bind_ips").AsArray()
 	for _, bindip := range bindiparr {
@@ -24,37 +48,34 @@ func (ps *PoleVPNServer) Start(config *anyvalue.AnyValue) error {
 			bindips[bindip["user"].(string)] = bindip["ip"].(string)
 		}
 	}
+	return bindips
+}
 
-	addresspool, err := NewAddressPool(config.Get("network_cidr").AsStr(), bindips)
-
-	if err != nil {
-		elog.Error("new address pool,", err)
-		return err
-	}
-
-	routermgr := NewRouterMgr()
-	routes := config.Get("server_routes").AsArray()
-	for _, route := range routes {
+// getServerRoutes return gateways of server_routes keyed by the cidr in the form RouterMgr keeps it
+func getServerRoutes(config *anyvalue.AnyValue) map[string]string {
+	routes := make(map[string]string)
+	routearr := config.Get("server_routes").AsArray()
+	for _, route := range routearr {
 		route, ok := route.(map[string]interface{})
 		if ok {
-			routermgr.AddRoute(route["cidr"].(string), route["gw"].(string))
+			cidr := route["cidr"].(string)
+			if _, subnet, err := net.ParseCIDR(cidr); err == nil {
+				cidr = subnet.String()
+			}
+			routes[cidr] = route["gw"].(string)
 		}
 	}
+	return routes
+}
 
-	connmgr := NewConnMgr()
-
-	connmgr.SetAddressPool(addresspool)
-
-	packetHandler := NewPacketDispatcher()
-
-	packetHandler.SetConnMgr(connmgr)
-	packetHandler.SetRouterMgr(routermgr)
+// startTunIO create tun device with the gateway ip,client packets to outside are forwarded by kernel
+func startTunIO(config *anyvalue.AnyValue, addresspool *AddressPool, packetHandler *PacketDispatcher) (*TunIO, error) {
 
-	tunio, err := NewTunIO(CH_TUNIO_WRITE_SIZE, packetHandler)
+	tunio, err := NewTunIO(CH_TUNIO_WRITE_SIZE, config.Get("tun.name").AsStr(), config.Get("tun.queues").AsInt(1), packetHandler)
 
 	if err != nil {
 		elog.Error("create tun fail,", err)
-		return err
+		return nil, err
 	}
 
 	gwip := addresspool.GatewayIP()
@@ -63,29 +84,205 @@ func (ps *PoleVPNServer) Start(config *anyvalue.AnyValue) error {
 	err = tunio.SetIPAddress(gwip)
 	if err != nil {
 		elog.Error("set tun ip address fail,", err)
-		return err
+		return nil, err
+	}
+
+	elog.Infof("tun device %v created", tunio.Name())
+
+	err = tunio.SetMTU(config.Get("tun.mtu").AsInt(TUN_MTU))
+	if err != nil {
+		elog.Error("set tun mtu fail,", err)
+		return nil, err
 	}
 
 	elog.Info("enable tun device")
 	err = tunio.Enanble()
 	if err != nil {
 		elog.Error("enable tun fail,", err)
-		return err
+		return nil, err
 	}
 	elog.Infof("add route %v to %v", addresspool.GetNetwork(), gwip)
 	err = tunio.AddRoute(addresspool.GetNetwork(), gwip)
 	if err != nil {
 		elog.Error("set tun route fail,", err)
-		return err
+		return nil, err
+	}
+
+	if addresspool.HasNetwork6() {
+		gwip6 := addresspool.GatewayIP6()
+		elog.Infof("set tun device ipv6 %v,network %v", gwip6, addresspool.GetNetwork6())
+		err = tunio.SetIPv6Address(gwip6, addresspool.GetNetwork6())
+		if err != nil {
+			elog.Error("set tun ipv6 address fail,", err)
+			return nil, err
+		}
 	}
 
 	tunio.StartProcess()
 
+	return tunio, nil
+}
+
+// startNetStackIO create userspace netstack owning the gateway ip,client flows are re-originated from host sockets
+func startNetStackIO(config *anyvalue.AnyValue, addresspool *AddressPool, packetHandler *PacketDispatcher) (*NetStackIO, error) {
+
+	netstackio, err := NewNetStackIO(config.Get("tun.mtu").AsInt(TUN_MTU), packetHandler)
+	if err != nil {
+		elog.Error("create netstack fail,", err)
+		return nil, err
+	}
+
+	gwips := []string{addresspool.GatewayIP()}
+	if addresspool.HasNetwork6() {
+		gwips = append(gwips, addresspool.GatewayIP6())
+	}
+
+	for _, gwip := range gwips {
+		elog.Infof("set netstack ip %v", gwip)
+		err = netstackio.AddAddress(gwip)
+		if err != nil {
+			elog.Error("set netstack ip address fail,", err)
+			netstackio.Close()
+			return nil, err
+		}
+	}
+
+	listenAddrs := []string{}
+	for _, key := range []string{"endpoint.listen", "endpoint.tls_listen", "endpoint.quic_listen", "admin.listen", "metrics.listen"} {
+		if addr := config.Get(key).AsStr(); addr != "" {
+			listenAddrs = append(listenAddrs, addr)
+		}
+	}
+	netstackio.SetListenAddrs(listenAddrs)
+
+	netstackio.StartProcess()
+
+	return netstackio, nil
+}
+
+// serveDNSOnNetStack serve dns at addr inside netstack,since the gateway ip isn't an address of the host
+func serveDNSOnNetStack(dnsServer *DNSServer, netstackio *NetStackIO, addr string) error {
+
+	pc, err := netstackio.ListenUDP(addr)
+	if err != nil {
+		return err
+	}
+
+	listener, err := netstackio.ListenTCP(addr)
+	if err != nil {
+		pc.Close()
+		return err
+	}
+
+	return dnsServer.Serve(pc, listener)
+}
+
+func (ps *PoleVPNServer) Start(config *anyvalue.AnyValue) error {
+	var err error
+	bindips := getBindIPs(config)
+
+	addresspool, err := NewAddressPool(config.Get("network_cidr").AsStr(), bindips)
+
+	if err != nil {
+		elog.Error("new address pool,", err)
+		return err
+	}
+
+	if config.Get("network_cidr6").AsStr() != "" {
+		err = addresspool.SetNetwork6(config.Get("network_cidr6").AsStr())
+		if err != nil {
+			elog.Error("set address pool ipv6 network,", err)
+			return err
+		}
+	}
+
+	routermgr := NewRouterMgr()
+	for cidr, gw := range getServerRoutes(config) {
+		routermgr.AddRoute(cidr, gw)
+	}
+
+	connmgr := NewConnMgr()
+
+	connmgr.SetAddressPool(addresspool)
+
+	acl := NewACL()
+	err = acl.Load(config.Get("acl"))
+	if err != nil {
+		elog.Error("load acl fail,", err)
+		return err
+	}
+
+	packetHandler := NewPacketDispatcher()
+	packetHandler.SetACL(acl)
+
+	packetHandler.SetConnMgr(connmgr)
+	packetHandler.SetRouterMgr(routermgr)
+
+	gwip := addresspool.GatewayIP()
+
+	var egress PacketEgress
+	var netstackio *NetStackIO
+
+	switch config.Get("egress_mode").AsStr() {
+	case "", EGRESS_MODE_TUN:
+		egress, err = startTunIO(config, addresspool, packetHandler)
+	case EGRESS_MODE_USERSPACE:
+		netstackio, err = startNetStackIO(config, addresspool, packetHandler)
+		egress = netstackio
+	default:
+		err = errors.New("egress_mode should be tun or userspace")
+	}
+
+	if err != nil {
+		elog.Error("start egress fail,", err)
+		return err
+	}
+
 	loginchecker := NewLocalLoginChecker()
 	requestHandler := NewRequestHandler()
-	requestHandler.SetTunIO(tunio)
+	requestHandler.SetEgress(egress)
 	requestHandler.SetConnMgr(connmgr)
 	requestHandler.SetRouterMgr(routermgr)
+	requestHandler.SetACL(acl)
+	err = requestHandler.SetClientIsolation(config.Get("client_isolation").AsStr())
+	if err != nil {
+		elog.Error("set client isolation fail,", err)
+		return err
+	}
+	requestHandler.SetAntiSpoofing(config.Get("anti_spoofing.enable").AsBool(true), config.Get("anti_spoofing.kick_threshold").AsInt())
+
+	tokenSigner, err := NewSessionTokenSigner(
+		[]byte(config.Get("session_token.secret").AsStr()),
+		time.Duration(config.Get("session_token.ttl").AsInt(DEFAULT_SESSION_TOKEN_TTL))*time.Second,
+	)
+	if err != nil {
+		elog.Error("create session token signer fail,", err)
+		return err
+	}
+	requestHandler.SetSessionTokenSigner(tokenSigner)
+
+	var dnsServer *DNSServer
+	if config.Get("dns_server.enable").AsBool() {
+		dnsServer = NewDNSServer(connmgr)
+		dnsServer.SetClientFilter(requestHandler.allowClientToClient)
+		err = dnsServer.Load(config)
+		if err != nil {
+			elog.Error("load dns server config fail,", err)
+			return err
+		}
+		addr := net.JoinHostPort(gwip, strconv.Itoa(config.Get("dns_server.port").AsInt(DEFAULT_DNS_PORT)))
+		if netstackio != nil {
+			err = serveDNSOnNetStack(dnsServer, netstackio, addr)
+		} else {
+			err = dnsServer.Listen(addr)
+		}
+		if err != nil {
+			elog.Error("dns server listen fail,", err)
+			return err
+		}
+		requestHandler.SetDNSServer(gwip)
+		elog.Infof("listen dns at %v", addr)
+	}
 
 	upstream := config.Get("up_traffic_limit").AsUint64()
 	downstream := config.Get("down_traffic_limit").AsUint64()
@@ -93,7 +290,73 @@ func (ps *PoleVPNServer) Start(config *anyvalue.AnyValue) error {
 	wg := &sync.WaitGroup{}
 
 	httpServer := NewHttpServer(upstream, downstream, requestHandler)
-	httpServer.SetLoginCheckHandler(loginchecker)
+	httpServer.SetLoginCheckHandler(NewOIDCLoginChecker(loginchecker))
+	httpServer.SetSessionTokenSigner(tokenSigner)
+	httpServer.SetTOTPVerifier(NewTOTPVerifier())
+
+	if config.Get("auth.client_cert.ca").AsStr() != "" {
+		clientCert, err := NewClientCertVerifier(
+			config.Get("auth.client_cert.ca").AsStr(),
+			config.Get("auth.client_cert.crl").AsStrArr(),
+			config.Get("auth.client_cert.ocsp").AsStr(),
+		)
+		if err != nil {
+			elog.Error("load client cert verifier fail,", err)
+			return err
+		}
+		httpServer.SetClientCertVerifier(clientCert)
+	}
+
+	var accounting *TrafficAccounting
+	if config.Get("accounting.path").AsStr() != "" {
+		accounting, err = NewTrafficAccounting(
+			config.Get("accounting.path").AsStr(),
+			config.Get("accounting.period").AsStr(),
+			config.Get("accounting.quota").AsUint64(),
+		)
+		if err != nil {
+			elog.Error("load traffic accounting fail,", err)
+			return err
+		}
+		requestHandler.SetTrafficAccounting(accounting)
+		httpServer.SetTrafficAccounting(accounting)
+		accounting.Start(connmgr, time.Duration(config.Get("accounting.save_interval").AsInt(DEFAULT_ACCOUNTING_SAVE_INTERVAL))*time.Second)
+	}
+
+	var radiusAcct *RadiusAccounting
+	if len(config.Get("auth.radius.acct_servers").AsStrArr()) > 0 {
+		radiusAcct = NewRadiusAccounting(
+			newRadiusClient("auth.radius.acct_servers"),
+			config.Get("auth.radius.nas_identifier").AsStr(),
+			time.Duration(config.Get("auth.radius.interim_interval").AsInt(DEFAULT_RADIUS_INTERIM_INTERVAL))*time.Second,
+		)
+		requestHandler.SetRadiusAccounting(radiusAcct)
+		radiusAcct.Start()
+	}
+
+	var adminServer *AdminServer
+	if config.Get("admin.listen").AsStr() != "" {
+		if config.Get("admin.token").AsStr() == "" && config.Get("admin.client_ca").AsStr() == "" {
+			elog.Error("admin api need token or client_ca,admin api disabled")
+		} else {
+			adminServer = NewAdminServer(connmgr, routermgr, config.Get("admin.token").AsStr())
+		}
+	}
+
+	ps.mutex.Lock()
+	ps.config = config
+	ps.connmgr = connmgr
+	ps.routermgr = routermgr
+	ps.httpServer = httpServer
+	ps.egress = egress
+	ps.accounting = accounting
+	ps.radiusAcct = radiusAcct
+	ps.acl = acl
+	ps.requestHandler = requestHandler
+	ps.dnsServer = dnsServer
+	ps.adminServer = adminServer
+	ps.mutex.Unlock()
+
 	wg.Add(1)
 	go httpServer.ListenTLS(wg,
 		config.Get("endpoint.listen").AsStr(),
@@ -102,7 +365,181 @@ func (ps *PoleVPNServer) Start(config *anyvalue.AnyValue) error {
 	)
 	elog.Infof("listen https at %v", config.Get("endpoint.listen").AsStr())
 
+	if config.Get("endpoint.tls_listen").AsStr() != "" {
+		wg.Add(1)
+		go httpServer.ListenRawTLS(wg,
+			config.Get("endpoint.tls_listen").AsStr(),
+			config.Get("endpoint.cert_file").AsStr(),
+			config.Get("endpoint.key_file").AsStr(),
+		)
+		elog.Infof("listen tls at %v", config.Get("endpoint.tls_listen").AsStr())
+	}
+
+	if config.Get("endpoint.quic_listen").AsStr() != "" {
+		wg.Add(1)
+		go httpServer.ListenQuic(wg,
+			config.Get("endpoint.quic_listen").AsStr(),
+			config.Get("endpoint.cert_file").AsStr(),
+			config.Get("endpoint.key_file").AsStr(),
+		)
+		elog.Infof("listen quic at %v", config.Get("endpoint.quic_listen").AsStr())
+	}
+
+	if config.Get("metrics.listen").AsStr() != "" {
+		CollectConnMgrMetrics(connmgr)
+		wg.Add(1)
+		go ListenMetrics(wg, config.Get("metrics.listen").AsStr())
+		elog.Infof("listen metrics at %v", config.Get("metrics.listen").AsStr())
+	}
+
+	if adminServer != nil {
+		wg.Add(1)
+		go adminServer.Listen(wg,
+			config.Get("admin.listen").AsStr(),
+			config.Get("admin.cert_file").AsStr(),
+			config.Get("admin.key_file").AsStr(),
+			config.Get("admin.client_ca").AsStr(),
+		)
+		elog.Infof("listen admin api at %v", config.Get("admin.listen").AsStr())
+	}
+
 	wg.Wait()
 
 	return nil
 }
+
+// Reload apply the config which can change without dropping sessions,
+// client_routes,dns and auth are read from Config when used
+func (ps *PoleVPNServer) Reload(config *anyvalue.AnyValue) error {
+
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	if ps.config == nil {
+		return errors.New("server haven't started")
+	}
+
+	for _, key := range restartConfigKeys {
+		oldValue, _ := ps.config.Get(key).EncodeJson()
+		newValue, _ := config.Get(key).EncodeJson()
+		if string(oldValue) != string(newValue) {
+			elog.Infof("config %v changed,it need restart to take effect", key)
+		}
+	}
+
+	//changed routes are replaced in place,deleting first would drop their traffic for a moment
+	routes := getServerRoutes(config)
+	for cidr, gw := range ps.routermgr.GetRoutes() {
+		if _, ok := routes[cidr]; !ok {
+			elog.Infof("delete route %v via %v", cidr, gw)
+			ps.routermgr.DelRoute(cidr)
+		}
+	}
+	for cidr, gw := range routes {
+		if ps.routermgr.ReplaceRoute(cidr, gw) {
+			elog.Infof("set route %v via %v", cidr, gw)
+		}
+	}
+
+	ps.connmgr.SetBindIPs(getBindIPs(config))
+
+	err := ps.acl.Load(config.Get("acl"))
+	if err != nil {
+		elog.Error("reload acl fail,keep the old rules,", err)
+	}
+
+	err = ps.requestHandler.SetClientIsolation(config.Get("client_isolation").AsStr())
+	if err != nil {
+		elog.Error("reload client isolation fail,", err)
+	}
+	ps.requestHandler.SetAntiSpoofing(config.Get("anti_spoofing.enable").AsBool(true), config.Get("anti_spoofing.kick_threshold").AsInt())
+
+	if ps.dnsServer != nil {
+		err = ps.dnsServer.Load(config)
+		if err != nil {
+			elog.Error("reload dns server config fail,", err)
+		}
+	}
+
+	upstream := config.Get("up_traffic_limit").AsUint64()
+	downstream := config.Get("down_traffic_limit").AsUint64()
+	ps.httpServer.SetTrafficLimit(upstream, downstream)
+	elog.Infof("traffic limit up:%v,down:%v,it applies to new connections", upstream, downstream)
+
+	ps.config = config
+	SetConfig(config)
+
+	return nil
+}
+
+// Stop stop accepting new connections,notify all clients server going away so they reconnect
+// to another server,flush their write channels and close tun device,it returns before timeout
+func (ps *PoleVPNServer) Stop(timeout time.Duration) {
+
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	if ps.config == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	deadline, _ := ctx.Deadline()
+
+	elog.Info("stop accepting new connections")
+	err := ps.httpServer.Shutdown(ctx)
+	if err != nil {
+		elog.Error("shutdown http server fail,", err)
+	}
+
+	conns := ps.connmgr.GetConns()
+	elog.Infof("notify %v connections server going away", len(conns))
+
+	buf := make([]byte, POLE_PACKET_HEADER_LEN)
+	pkt := PolePacket(buf)
+	pkt.SetLen(POLE_PACKET_HEADER_LEN)
+	pkt.SetCmd(CMD_SERVER_GOAWAY)
+
+	wg := &sync.WaitGroup{}
+	for _, conn := range conns {
+		wg.Add(1)
+		go func(conn Conn) {
+			defer wg.Done()
+			conn.Send(pkt)
+			conn.Shutdown(time.Until(deadline))
+		}(conn)
+	}
+	wg.Wait()
+
+	ps.httpServer.Close()
+
+	if ps.adminServer != nil {
+		err = ps.adminServer.Shutdown(ctx)
+		if err != nil {
+			elog.Error("shutdown admin server fail,", err)
+		}
+	}
+
+	if ps.accounting != nil {
+		for _, conn := range conns {
+			ps.accounting.Account("", conn)
+		}
+		err = ps.accounting.Close()
+		if err != nil {
+			elog.Error("save traffic accounting fail,", err)
+		}
+	}
+
+	if ps.radiusAcct != nil {
+		ps.radiusAcct.Close()
+	}
+
+	if ps.dnsServer != nil {
+		ps.dnsServer.Close()
+	}
+
+	elog.Info("close egress")
+	ps.egress.Close()
+}
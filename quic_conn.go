@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/polevpn/elog"
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	CH_QUICC_READ_SIZE = 100
+	QUIC_ALPN          = "polevpn"
+)
+
+// QuicConn carry ip data in quic datagrams,and other commands on the control stream opened by client,
+// ip packets too large for a datagram fall back to the control stream
+type QuicConn struct {
+	conn   quic.Connection
+	stream quic.Stream
+	rch    chan []byte
+	errch  chan error
+	once   *sync.Once
+}
+
+func NewQuicConn(conn quic.Connection, stream quic.Stream) *QuicConn {
+	return &QuicConn{
+		conn:   conn,
+		stream: stream,
+		rch:    make(chan []byte, CH_QUICC_READ_SIZE),
+		errch:  make(chan error, 2),
+		once:   &sync.Once{},
+	}
+}
+
+// readStream read packets from the control stream
+func (qc *QuicConn) readStream() {
+
+	defer PanicHandler()
+
+	for {
+		pkt, err := ReadPacket(qc.stream)
+		if err != nil {
+			qc.errch <- err
+			return
+		}
+		select {
+		case qc.rch <- pkt:
+		case <-qc.conn.Context().Done():
+			return
+		}
+	}
+}
+
+// readDatagram read ip data from datagrams,each datagram is a whole CMD_C2S_IPDATA packet
+func (qc *QuicConn) readDatagram() {
+
+	defer PanicHandler()
+
+	for {
+		pkt, err := qc.conn.ReceiveDatagram(qc.conn.Context())
+		if err != nil {
+			qc.errch <- err
+			return
+		}
+
+		if len(pkt) < POLE_PACKET_HEADER_LEN || int(PolePacket(pkt).Len()) != len(pkt) || PolePacket(pkt).Cmd() != CMD_C2S_IPDATA {
+			elog.Debug(qc.conn.RemoteAddr().String(), " drop invalid quic datagram")
+			continue
+		}
+
+		select {
+		case qc.rch <- pkt:
+		case <-qc.conn.Context().Done():
+			return
+		}
+	}
+}
+
+func (qc *QuicConn) ReadPacket() ([]byte, error) {
+
+	qc.once.Do(func() {
+		go qc.readStream()
+		go qc.readDatagram()
+	})
+
+	select {
+	case pkt := <-qc.rch:
+		return pkt, nil
+	case err := <-qc.errch:
+		return nil, err
+	}
+}
+
+func (qc *QuicConn) WritePacket(pkt []byte) error {
+
+	if PolePacket(pkt).Cmd() == CMD_S2C_IPDATA {
+		err := qc.conn.SendDatagram(pkt)
+		if !errors.Is(err, &quic.DatagramTooLargeError{}) {
+			return err
+		}
+	}
+
+	_, err := qc.stream.Write(pkt)
+	return err
+}
+
+func (qc *QuicConn) Close() error {
+	return qc.conn.CloseWithError(0, "")
+}
+
+func (qc *QuicConn) LocalAddr() net.Addr {
+	return qc.conn.LocalAddr()
+}
+
+func (qc *QuicConn) RemoteAddr() net.Addr {
+	return qc.conn.RemoteAddr()
+}
+
+func (qc *QuicConn) Name() string {
+	return "quic"
+}
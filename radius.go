@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	RADIUS_CODE_ACCESS_REQUEST      = 1
+	RADIUS_CODE_ACCESS_ACCEPT       = 2
+	RADIUS_CODE_ACCESS_REJECT       = 3
+	RADIUS_CODE_ACCOUNTING_REQUEST  = 4
+	RADIUS_CODE_ACCOUNTING_RESPONSE = 5
+	RADIUS_CODE_ACCESS_CHALLENGE    = 11
+)
+
+const (
+	RADIUS_ATTR_USER_NAME             = 1
+	RADIUS_ATTR_USER_PASSWORD         = 2
+	RADIUS_ATTR_NAS_IP_ADDRESS        = 4
+	RADIUS_ATTR_SERVICE_TYPE          = 6
+	RADIUS_ATTR_FRAMED_IP_ADDRESS     = 8
+	RADIUS_ATTR_FILTER_ID             = 11
+	RADIUS_ATTR_REPLY_MESSAGE         = 18
+	RADIUS_ATTR_VENDOR_SPECIFIC       = 26
+	RADIUS_ATTR_CALLED_STATION_ID     = 30
+	RADIUS_ATTR_CALLING_STATION_ID    = 31
+	RADIUS_ATTR_NAS_IDENTIFIER        = 32
+	RADIUS_ATTR_ACCT_STATUS_TYPE      = 40
+	RADIUS_ATTR_ACCT_INPUT_OCTETS     = 42
+	RADIUS_ATTR_ACCT_OUTPUT_OCTETS    = 43
+	RADIUS_ATTR_ACCT_SESSION_ID       = 44
+	RADIUS_ATTR_ACCT_SESSION_TIME     = 46
+	RADIUS_ATTR_ACCT_TERMINATE_CAUSE  = 49
+	RADIUS_ATTR_ACCT_INPUT_GIGAWORDS  = 52
+	RADIUS_ATTR_ACCT_OUTPUT_GIGAWORDS = 53
+	RADIUS_ATTR_EVENT_TIMESTAMP       = 55
+	RADIUS_ATTR_NAS_PORT_TYPE         = 61
+	RADIUS_ATTR_MESSAGE_AUTHENTICATOR = 80
+)
+
+const (
+	RADIUS_VENDOR_MICROSOFT  = 311
+	RADIUS_MS_CHAP_CHALLENGE = 11
+	RADIUS_MS_CHAP2_RESPONSE = 25
+	RADIUS_MS_CHAP2_SUCCESS  = 26
+)
+
+const (
+	RADIUS_HEADER_LEN          = 20
+	RADIUS_MAX_PACKET_LEN      = 4096
+	RADIUS_AUTHENTICATOR_LEN   = 16
+	RADIUS_MAX_PASSWORD_LEN    = 128
+	RADIUS_SERVICE_TYPE_FRAMED = 2
+	RADIUS_NAS_PORT_TYPE_VIRT  = 5
+	DEFAULT_RADIUS_TIMEOUT     = 3
+	DEFAULT_RADIUS_RETRIES     = 1
+)
+
+type RadiusAttribute struct {
+	Type  byte
+	Value []byte
+}
+
+// RadiusPacket is a rfc 2865/2866 packet,vendor specific attributes are kept raw in Attributes
+type RadiusPacket struct {
+	Code          byte
+	Identifier    byte
+	Authenticator [RADIUS_AUTHENTICATOR_LEN]byte
+	Attributes    []RadiusAttribute
+}
+
+func NewRadiusPacket(code byte) *RadiusPacket {
+	rp := &RadiusPacket{Code: code}
+	var id [1]byte
+	rand.Read(id[:])
+	rp.Identifier = id[0]
+	return rp
+}
+
+func (rp *RadiusPacket) Add(typ byte, value []byte) {
+	rp.Attributes = append(rp.Attributes, RadiusAttribute{Type: typ, Value: value})
+}
+
+func (rp *RadiusPacket) AddString(typ byte, value string) {
+	if value != "" {
+		rp.Add(typ, []byte(value))
+	}
+}
+
+func (rp *RadiusPacket) AddUint32(typ byte, value uint32) {
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, value)
+	rp.Add(typ, buf)
+}
+
+func (rp *RadiusPacket) AddIP(typ byte, ip string) {
+	if v4 := net.ParseIP(ip).To4(); v4 != nil {
+		rp.Add(typ, v4)
+	}
+}
+
+// AddVendor add a vendor specific attribute with one sub attribute
+func (rp *RadiusPacket) AddVendor(vendorId uint32, typ byte, value []byte) {
+	buf := make([]byte, 6+len(value))
+	binary.BigEndian.PutUint32(buf, vendorId)
+	buf[4] = typ
+	buf[5] = byte(2 + len(value))
+	copy(buf[6:], value)
+	rp.Add(RADIUS_ATTR_VENDOR_SPECIFIC, buf)
+}
+
+// Get return value of the first attribute of typ
+func (rp *RadiusPacket) Get(typ byte) []byte {
+	for _, attr := range rp.Attributes {
+		if attr.Type == typ {
+			return attr.Value
+		}
+	}
+	return nil
+}
+
+func (rp *RadiusPacket) GetAll(typ byte) [][]byte {
+	values := make([][]byte, 0)
+	for _, attr := range rp.Attributes {
+		if attr.Type == typ {
+			values = append(values, attr.Value)
+		}
+	}
+	return values
+}
+
+// GetVendor return value of the first vendor specific sub attribute of typ
+func (rp *RadiusPacket) GetVendor(vendorId uint32, typ byte) []byte {
+	for _, value := range rp.GetAll(RADIUS_ATTR_VENDOR_SPECIFIC) {
+		if len(value) < 4 || binary.BigEndian.Uint32(value) != vendorId {
+			continue
+		}
+		for sub := value[4:]; len(sub) >= 2 && int(sub[1]) >= 2 && int(sub[1]) <= len(sub); sub = sub[sub[1]:] {
+			if sub[0] == typ {
+				return sub[2:sub[1]]
+			}
+		}
+	}
+	return nil
+}
+
+func (rp *RadiusPacket) Marshal() ([]byte, error) {
+
+	buf := make([]byte, RADIUS_HEADER_LEN, RADIUS_MAX_PACKET_LEN)
+	buf[0] = rp.Code
+	buf[1] = rp.Identifier
+	copy(buf[4:], rp.Authenticator[:])
+
+	for _, attr := range rp.Attributes {
+		if len(attr.Value) > 253 {
+			return nil, errors.New("radius attribute too long")
+		}
+		buf = append(buf, attr.Type, byte(2+len(attr.Value)))
+		buf = append(buf, attr.Value...)
+	}
+
+	if len(buf) > RADIUS_MAX_PACKET_LEN {
+		return nil, errors.New("radius packet too long")
+	}
+
+	binary.BigEndian.PutUint16(buf[2:], uint16(len(buf)))
+	return buf, nil
+}
+
+func ParseRadiusPacket(data []byte) (*RadiusPacket, error) {
+
+	if len(data) < RADIUS_HEADER_LEN {
+		return nil, errors.New("radius packet too short")
+	}
+
+	length := int(binary.BigEndian.Uint16(data[2:]))
+	if length < RADIUS_HEADER_LEN || length > len(data) {
+		return nil, errors.New("invalid radius packet length")
+	}
+
+	rp := &RadiusPacket{Code: data[0], Identifier: data[1]}
+	copy(rp.Authenticator[:], data[4:RADIUS_HEADER_LEN])
+
+	for attrs := data[RADIUS_HEADER_LEN:length]; len(attrs) > 0; {
+		if len(attrs) < 2 || int(attrs[1]) < 2 || int(attrs[1]) > len(attrs) {
+			return nil, errors.New("invalid radius attribute")
+		}
+		rp.Add(attrs[0], append([]byte{}, attrs[2:attrs[1]]...))
+		attrs = attrs[attrs[1]:]
+	}
+	return rp, nil
+}
+
+// radiusHidePassword hide User-Password by rfc 2865 section 5.2
+func radiusHidePassword(pwd []byte, secret []byte, authenticator []byte) []byte {
+
+	size := (len(pwd) + 15) / 16 * 16
+	if size == 0 {
+		size = 16
+	}
+	hidden := make([]byte, size)
+	copy(hidden, pwd)
+
+	last := authenticator
+	for i := 0; i < size; i += 16 {
+		b := md5.Sum(append(append([]byte{}, secret...), last...))
+		for j := 0; j < 16; j++ {
+			hidden[i+j] ^= b[j]
+		}
+		last = hidden[i : i+16]
+	}
+	return hidden
+}
+
+// EncodeRequest compute authenticators of Access-Request or Accounting-Request and marshal it,
+// password is hidden into User-Password if it isn't nil
+func (rp *RadiusPacket) EncodeRequest(secret []byte, pwd []byte) ([]byte, error) {
+
+	if rp.Code == RADIUS_CODE_ACCOUNTING_REQUEST {
+		rp.Authenticator = [RADIUS_AUTHENTICATOR_LEN]byte{}
+		data, err := rp.Marshal()
+		if err != nil {
+			return nil, err
+		}
+		sum := md5.Sum(append(data, secret...))
+		copy(data[4:], sum[:])
+		copy(rp.Authenticator[:], sum[:])
+		return data, nil
+	}
+
+	_, err := rand.Read(rp.Authenticator[:])
+	if err != nil {
+		return nil, err
+	}
+
+	if pwd != nil {
+		if len(pwd) > RADIUS_MAX_PASSWORD_LEN {
+			return nil, errors.New("radius password too long")
+		}
+		rp.Add(RADIUS_ATTR_USER_PASSWORD, radiusHidePassword(pwd, secret, rp.Authenticator[:]))
+	}
+
+	//message authenticator is required by servers protecting against blast-radius
+	rp.Add(RADIUS_ATTR_MESSAGE_AUTHENTICATOR, make([]byte, md5.Size))
+	data, err := rp.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	mac := hmac.New(md5.New, secret)
+	mac.Write(data)
+	copy(data[len(data)-md5.Size:], mac.Sum(nil))
+	return data, nil
+}
+
+// verifyRadiusResponse check response authenticator and message authenticator of a reply to request authenticator,
+// access replies must carry message authenticator if requireMessageAuth is set
+func verifyRadiusResponse(data []byte, requestAuth []byte, secret []byte, requireMessageAuth bool) error {
+
+	length := int(binary.BigEndian.Uint16(data[2:]))
+	buf := append([]byte{}, data[:length]...)
+	copy(buf[4:], requestAuth)
+
+	sum := md5.Sum(append(append([]byte{}, buf...), secret...))
+	if !hmac.Equal(sum[:], data[4:RADIUS_HEADER_LEN]) {
+		return errors.New("invalid radius response authenticator")
+	}
+
+	found := false
+	for attrs := buf[RADIUS_HEADER_LEN:]; len(attrs) >= 2 && int(attrs[1]) >= 2 && int(attrs[1]) <= len(attrs); attrs = attrs[attrs[1]:] {
+		if attrs[0] != RADIUS_ATTR_MESSAGE_AUTHENTICATOR || attrs[1] != 2+md5.Size {
+			continue
+		}
+		expected := append([]byte{}, attrs[2:2+md5.Size]...)
+		copy(attrs[2:2+md5.Size], make([]byte, md5.Size))
+		mac := hmac.New(md5.New, secret)
+		mac.Write(buf)
+		if !hmac.Equal(mac.Sum(nil), expected) {
+			return errors.New("invalid radius message authenticator")
+		}
+		found = true
+		break
+	}
+
+	switch buf[0] {
+	case RADIUS_CODE_ACCESS_ACCEPT, RADIUS_CODE_ACCESS_REJECT, RADIUS_CODE_ACCESS_CHALLENGE:
+		//a reply without it could be forged by blast-radius
+		if requireMessageAuth && !found {
+			return errors.New("radius message authenticator missing")
+		}
+	}
+	return nil
+}
+
+// RadiusClient send requests to servers in order,a server which doesn't answer in timeout after retries
+// is skipped,and the next request starts from the server answered last time
+type RadiusClient struct {
+	servers []string
+	secret  []byte
+	timeout time.Duration
+	retries int
+	next    atomic.Int32
+}
+
+func NewRadiusClient(servers []string, secret string, timeout time.Duration, retries int) *RadiusClient {
+
+	if timeout <= 0 {
+		timeout = time.Second * DEFAULT_RADIUS_TIMEOUT
+	}
+	if retries < 0 {
+		retries = 0
+	}
+	return &RadiusClient{servers: servers, secret: []byte(secret), timeout: timeout, retries: retries}
+}
+
+// Exchange send request and wait for the reply,pwd is hidden into User-Password if it isn't nil
+func (rc *RadiusClient) Exchange(req *RadiusPacket, pwd []byte) (*RadiusPacket, error) {
+
+	if len(rc.servers) == 0 {
+		return nil, errors.New("no radius server")
+	}
+
+	data, err := req.EncodeRequest(rc.secret, pwd)
+	if err != nil {
+		return nil, err
+	}
+
+	start := int(rc.next.Load())
+	for i := 0; i < len(rc.servers); i++ {
+		index := (start + i) % len(rc.servers)
+		var resp *RadiusPacket
+		resp, err = rc.exchange(rc.servers[index], data, req)
+		if err == nil {
+			rc.next.Store(int32(index))
+			return resp, nil
+		}
+	}
+	return nil, err
+}
+
+func (rc *RadiusClient) exchange(server string, data []byte, req *RadiusPacket) (*RadiusPacket, error) {
+
+	conn, err := net.Dial("udp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	buf := make([]byte, RADIUS_MAX_PACKET_LEN)
+
+	for i := 0; i <= rc.retries; i++ {
+
+		_, err = conn.Write(data)
+		if err != nil {
+			return nil, err
+		}
+
+		conn.SetReadDeadline(time.Now().Add(rc.timeout))
+
+		for {
+			var n int
+			n, err = conn.Read(buf)
+			if err != nil {
+				break
+			}
+
+			var resp *RadiusPacket
+			resp, err = ParseRadiusPacket(buf[:n])
+			if err != nil || resp.Identifier != req.Identifier {
+				continue
+			}
+
+			err = verifyRadiusResponse(buf[:n], req.Authenticator[:], rc.secret, req.Get(RADIUS_ATTR_MESSAGE_AUTHENTICATOR) != nil)
+			if err != nil {
+				continue
+			}
+			return resp, nil
+		}
+
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			return nil, err
+		}
+	}
+	return nil, errors.New("radius server " + server + " timeout")
+}
+
+// newRadiusClient create client of auth.radius config with servers of key
+func newRadiusClient(key string) *RadiusClient {
+	return NewRadiusClient(
+		Config().Get(key).AsStrArr(),
+		Config().Get("auth.radius.secret").AsStr(),
+		time.Duration(Config().Get("auth.radius.timeout").AsInt(DEFAULT_RADIUS_TIMEOUT))*time.Second,
+		Config().Get("auth.radius.retries").AsInt(DEFAULT_RADIUS_RETRIES),
+	)
+}
+
+// radiusReplyMessage return Reply-Message of resp or the default message
+func radiusReplyMessage(resp *RadiusPacket, message string) string {
+	if reply := resp.GetAll(RADIUS_ATTR_REPLY_MESSAGE); len(reply) > 0 {
+		return string(bytes.Join(reply, nil))
+	}
+	return message
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/polevpn/elog"
+)
+
+const (
+	RADIUS_ACCT_STATUS_START          = 1
+	RADIUS_ACCT_STATUS_STOP           = 2
+	RADIUS_ACCT_STATUS_INTERIM        = 3
+	RADIUS_TERMINATE_USER_REQUEST     = 1
+	RADIUS_TERMINATE_LOST_CARRIER     = 2
+	RADIUS_TERMINATE_NAS_REBOOT       = 11
+	DEFAULT_RADIUS_INTERIM_INTERVAL   = 300
+	CH_RADIUS_ACCOUNTING_REQUEST_SIZE = 1000
+)
+
+type radiusSession struct {
+	id    string
+	user  string
+	ip    string
+	conn  Conn
+	start time.Time
+}
+
+// RadiusAccounting send Accounting-Start when a conn gets its ip,Interim-Update every interval,
+// and Accounting-Stop when it closes,octets come from traffic counters of the conn
+type RadiusAccounting struct {
+	client   *RadiusClient
+	nasId    string
+	interval time.Duration
+	sessions map[string]*radiusSession
+	reqs     chan *RadiusPacket
+	done     chan struct{}
+	stopped  chan struct{}
+	now      func() time.Time
+	mutex    *sync.Mutex
+}
+
+func NewRadiusAccounting(client *RadiusClient, nasId string, interval time.Duration) *RadiusAccounting {
+
+	if interval <= 0 {
+		interval = time.Second * DEFAULT_RADIUS_INTERIM_INTERVAL
+	}
+
+	return &RadiusAccounting{
+		client:   client,
+		nasId:    nasId,
+		interval: interval,
+		sessions: make(map[string]*radiusSession),
+		reqs:     make(chan *RadiusPacket, CH_RADIUS_ACCOUNTING_REQUEST_SIZE),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+		now:      time.Now,
+		mutex:    &sync.Mutex{},
+	}
+}
+
+func (ra *RadiusAccounting) newRequest(status uint32, rs *radiusSession) *RadiusPacket {
+
+	req := NewRadiusPacket(RADIUS_CODE_ACCOUNTING_REQUEST)
+	req.AddUint32(RADIUS_ATTR_ACCT_STATUS_TYPE, status)
+	req.AddString(RADIUS_ATTR_ACCT_SESSION_ID, rs.id)
+	req.AddString(RADIUS_ATTR_USER_NAME, rs.user)
+	req.AddIP(RADIUS_ATTR_FRAMED_IP_ADDRESS, rs.ip)
+	req.AddString(RADIUS_ATTR_NAS_IDENTIFIER, ra.nasId)
+	req.AddUint32(RADIUS_ATTR_NAS_PORT_TYPE, RADIUS_NAS_PORT_TYPE_VIRT)
+	req.AddUint32(RADIUS_ATTR_EVENT_TIMESTAMP, uint32(ra.now().Unix()))
+
+	remoteIp, _, _ := net.SplitHostPort(rs.conn.RemoteAddr())
+	req.AddString(RADIUS_ATTR_CALLING_STATION_ID, remoteIp)
+
+	if status != RADIUS_ACCT_STATUS_START {
+		//octets input are what the nas received from user
+		up, down := rs.conn.UpStreamBytes(), rs.conn.DownStreamBytes()
+		req.AddUint32(RADIUS_ATTR_ACCT_INPUT_OCTETS, uint32(up))
+		req.AddUint32(RADIUS_ATTR_ACCT_INPUT_GIGAWORDS, uint32(up>>32))
+		req.AddUint32(RADIUS_ATTR_ACCT_OUTPUT_OCTETS, uint32(down))
+		req.AddUint32(RADIUS_ATTR_ACCT_OUTPUT_GIGAWORDS, uint32(down>>32))
+		req.AddUint32(RADIUS_ATTR_ACCT_SESSION_TIME, uint32(ra.now().Sub(rs.start)/time.Second))
+	}
+	return req
+}
+
+func (ra *RadiusAccounting) enqueue(req *RadiusPacket) {
+	select {
+	case ra.reqs <- req:
+	default:
+		elog.Error("radius accounting queue is full,drop request")
+	}
+}
+
+// OnStart send Accounting-Start of conn,it is ignored if the conn has started
+func (ra *RadiusAccounting) OnStart(user string, ip string, conn Conn) {
+
+	id := make([]byte, 8)
+	rand.Read(id)
+
+	ra.mutex.Lock()
+	if _, ok := ra.sessions[conn.String()]; ok {
+		ra.mutex.Unlock()
+		return
+	}
+	rs := &radiusSession{id: hex.EncodeToString(id), user: user, ip: ip, conn: conn, start: ra.now()}
+	ra.sessions[conn.String()] = rs
+	ra.mutex.Unlock()
+
+	ra.enqueue(ra.newRequest(RADIUS_ACCT_STATUS_START, rs))
+}
+
+// OnClosed send Accounting-Stop of conn with its final octets
+func (ra *RadiusAccounting) OnClosed(conn Conn, proactive bool) {
+
+	ra.mutex.Lock()
+	rs, ok := ra.sessions[conn.String()]
+	if ok && rs.conn == conn {
+		delete(ra.sessions, conn.String())
+	}
+	ra.mutex.Unlock()
+
+	if !ok || rs.conn != conn {
+		return
+	}
+
+	cause := uint32(RADIUS_TERMINATE_LOST_CARRIER)
+	if proactive {
+		cause = RADIUS_TERMINATE_USER_REQUEST
+	}
+
+	req := ra.newRequest(RADIUS_ACCT_STATUS_STOP, rs)
+	req.AddUint32(RADIUS_ATTR_ACCT_TERMINATE_CAUSE, cause)
+	ra.enqueue(req)
+}
+
+func (ra *RadiusAccounting) interim() {
+
+	ra.mutex.Lock()
+	sessions := make([]*radiusSession, 0, len(ra.sessions))
+	for _, rs := range ra.sessions {
+		sessions = append(sessions, rs)
+	}
+	ra.mutex.Unlock()
+
+	for _, rs := range sessions {
+		ra.enqueue(ra.newRequest(RADIUS_ACCT_STATUS_INTERIM, rs))
+	}
+}
+
+func (ra *RadiusAccounting) send(req *RadiusPacket) {
+
+	resp, err := ra.client.Exchange(req, nil)
+	if err == nil && resp.Code != RADIUS_CODE_ACCOUNTING_RESPONSE {
+		err = errors.New("unexpected radius accounting response")
+	}
+	if err != nil {
+		elog.Error("send radius accounting fail,", err)
+	}
+}
+
+// Start send queued requests,and Interim-Update of sessions every interval
+func (ra *RadiusAccounting) Start() {
+
+	go func() {
+		defer close(ra.stopped)
+		for {
+			select {
+			case req := <-ra.reqs:
+				ra.send(req)
+			case <-ra.done:
+				for {
+					select {
+					case req := <-ra.reqs:
+						ra.send(req)
+					default:
+						return
+					}
+				}
+			}
+		}
+	}()
+
+	go func() {
+		ticker := time.NewTicker(ra.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				ra.interim()
+			case <-ra.done:
+				return
+			}
+		}
+	}()
+}
+
+// Close send Accounting-Stop of sessions left,and wait for queued requests sent
+func (ra *RadiusAccounting) Close() {
+
+	ra.mutex.Lock()
+	sessions := ra.sessions
+	ra.sessions = make(map[string]*radiusSession)
+	ra.mutex.Unlock()
+
+	for _, rs := range sessions {
+		req := ra.newRequest(RADIUS_ACCT_STATUS_STOP, rs)
+		req.AddUint32(RADIUS_ATTR_ACCT_TERMINATE_CAUSE, RADIUS_TERMINATE_NAS_REBOOT)
+		ra.enqueue(req)
+	}
+
+	close(ra.done)
+	<-ra.stopped
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/polevpn/anyvalue"
+)
+
+// radiusStandIn is a local radius server accepting one user by pap or mschapv2,
+// accounting requests it receives go to acct,access replies skip message authenticator if noMessageAuth is set
+type radiusStandIn struct {
+	conn          net.PacketConn
+	secret        []byte
+	user          string
+	pwd           string
+	acct          chan *RadiusPacket
+	noMessageAuth atomic.Bool
+}
+
+func newRadiusStandIn(t *testing.T, secret string, user string, pwd string) *radiusStandIn {
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	rs := &radiusStandIn{conn: conn, secret: []byte(secret), user: user, pwd: pwd, acct: make(chan *RadiusPacket, 10)}
+	go rs.serve()
+	return rs
+}
+
+func (rs *radiusStandIn) Addr() string {
+	return rs.conn.LocalAddr().String()
+}
+
+func (rs *radiusStandIn) serve() {
+
+	buf := make([]byte, RADIUS_MAX_PACKET_LEN)
+
+	for {
+		n, addr, err := rs.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		req, err := ParseRadiusPacket(buf[:n])
+		if err != nil {
+			continue
+		}
+
+		var resp *RadiusPacket
+		if req.Code == RADIUS_CODE_ACCOUNTING_REQUEST {
+			data := append([]byte{}, buf[:n]...)
+			copy(data[4:], make([]byte, RADIUS_AUTHENTICATOR_LEN))
+			if sum := md5.Sum(append(data, rs.secret...)); !bytes.Equal(sum[:], req.Authenticator[:]) {
+				continue
+			}
+			rs.acct <- req
+			resp = &RadiusPacket{Code: RADIUS_CODE_ACCOUNTING_RESPONSE}
+		} else {
+			resp = rs.access(req)
+		}
+
+		resp.Identifier = req.Identifier
+		rs.conn.WriteTo(rs.encodeResponse(resp, req.Authenticator[:]), addr)
+	}
+}
+
+func (rs *radiusStandIn) access(req *RadiusPacket) *RadiusPacket {
+
+	reject := &RadiusPacket{Code: RADIUS_CODE_ACCESS_REJECT}
+	reject.AddString(RADIUS_ATTR_REPLY_MESSAGE, "bad credential")
+
+	if string(req.Get(RADIUS_ATTR_USER_NAME)) != rs.user || req.Get(RADIUS_ATTR_MESSAGE_AUTHENTICATOR) == nil {
+		return reject
+	}
+
+	accept := &RadiusPacket{Code: RADIUS_CODE_ACCESS_ACCEPT}
+	accept.AddString(RADIUS_ATTR_FILTER_ID, "dev")
+	accept.AddString(RADIUS_ATTR_FILTER_ID, "ops")
+
+	if hidden := req.Get(RADIUS_ATTR_USER_PASSWORD); hidden != nil {
+		//hiding is xor,so recompute the stream from the hidden blocks
+		pwd := make([]byte, len(hidden))
+		last := req.Authenticator[:]
+		for i := 0; i < len(hidden); i += 16 {
+			b := md5.Sum(append(append([]byte{}, rs.secret...), last...))
+			for j := 0; j < 16; j++ {
+				pwd[i+j] = hidden[i+j] ^ b[j]
+			}
+			last = hidden[i : i+16]
+		}
+		if string(bytes.TrimRight(pwd, "\x00")) != rs.pwd {
+			return reject
+		}
+		return accept
+	}
+
+	challenge := req.GetVendor(RADIUS_VENDOR_MICROSOFT, RADIUS_MS_CHAP_CHALLENGE)
+	response := req.GetVendor(RADIUS_VENDOR_MICROSOFT, RADIUS_MS_CHAP2_RESPONSE)
+	if len(challenge) != MSCHAP_CHALLENGE_LEN || len(response) != MSCHAP2_RESPONSE_LEN {
+		return reject
+	}
+
+	peerChallenge, ntResponse := response[2:18], response[26:]
+	if !bytes.Equal(MSCHAPv2NtResponse(challenge, peerChallenge, rs.user, rs.pwd), ntResponse) {
+		return reject
+	}
+
+	success := MSCHAPv2AuthenticatorResponse(challenge, peerChallenge, ntResponse, rs.user, rs.pwd)
+	accept.AddVendor(RADIUS_VENDOR_MICROSOFT, RADIUS_MS_CHAP2_SUCCESS, append([]byte{response[0]}, success...))
+	return accept
+}
+
+func (rs *radiusStandIn) encodeResponse(resp *RadiusPacket, requestAuth []byte) []byte {
+
+	copy(resp.Authenticator[:], requestAuth)
+	messageAuth := resp.Code != RADIUS_CODE_ACCOUNTING_RESPONSE && !rs.noMessageAuth.Load()
+	if messageAuth {
+		resp.Add(RADIUS_ATTR_MESSAGE_AUTHENTICATOR, make([]byte, md5.Size))
+	}
+	data, _ := resp.Marshal()
+
+	if messageAuth {
+		mac := hmac.New(md5.New, rs.secret)
+		mac.Write(data)
+		copy(data[len(data)-md5.Size:], mac.Sum(nil))
+	}
+
+	sum := md5.Sum(append(append([]byte{}, data...), rs.secret...))
+	copy(data[4:], sum[:])
+	return data
+}
+
+func TestMSCHAPv2(t *testing.T) {
+
+	//rfc 2759 section 9.2
+	authChallenge, _ := hex.DecodeString("5B5D7C7D7B3F2F3E3C2C602132262628")
+	peerChallenge, _ := hex.DecodeString("21402324255E262A28295F2B3A337C7E")
+
+	if hash := hex.EncodeToString(mschapNtPasswordHash("clientPass")); hash != "44ebba8d5312b8d611474411f56989ae" {
+		t.Fatalf("unexpected password hash %v", hash)
+	}
+
+	ntResponse := MSCHAPv2NtResponse(authChallenge, peerChallenge, "User", "clientPass")
+	if hex.EncodeToString(ntResponse) != "82309ecd8d708b5ea08faa3981cd83544233114a3d85d6df" {
+		t.Fatalf("unexpected nt response %x", ntResponse)
+	}
+
+	resp := MSCHAPv2AuthenticatorResponse(authChallenge, peerChallenge, ntResponse, "User", "clientPass")
+	if resp != "S=407A5589115FD0D6209F510FE9C04566932CDA56" {
+		t.Fatalf("unexpected authenticator response %v", resp)
+	}
+}
+
+func TestRadiusLogin(t *testing.T) {
+
+	server := newRadiusStandIn(t, "testing123", "alice", "a-long-password-over-16")
+
+	//nothing listens on the first server,client fails over to the stand-in
+	dead, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadAddr := dead.LocalAddr().String()
+	dead.Close()
+
+	oldConfig := Config()
+	defer func() { SetConfig(oldConfig) }()
+
+	llc := NewLocalLoginChecker()
+
+	for _, method := range []string{"pap", "mschapv2"} {
+
+		SetConfig(anyvalue.New())
+		Config().Set("auth.radius.servers", []interface{}{deadAddr, server.Addr()})
+		Config().Set("auth.radius.secret", "testing123")
+		Config().Set("auth.radius.method", method)
+		Config().Set("auth.radius.timeout", 1)
+
+		policy, err := llc.CheckLogin("alice", "a-long-password-over-16", "1.1.1.1", "ios", "device1")
+		if err != nil {
+			t.Fatalf("%v login fail,%v", method, err)
+		}
+		if len(policy.Groups) != 2 || policy.Groups[0] != "dev" || policy.Groups[1] != "ops" {
+			t.Fatalf("%v unexpected groups %v", method, policy.Groups)
+		}
+
+		_, err = llc.CheckLogin("alice", "wrong", "1.1.1.1", "ios", "device1")
+		if err == nil || err.Error() != "bad credential" {
+			t.Fatalf("%v login with wrong password should be rejected,%v", method, err)
+		}
+	}
+
+	//replies signed with other secret are dropped
+	Config().Set("auth.radius.secret", "other")
+	Config().Set("auth.radius.retries", 0)
+	if _, err = llc.CheckLogin("alice", "a-long-password-over-16", "1.1.1.1", "ios", "device1"); err == nil {
+		t.Fatal("login with wrong secret should fail")
+	}
+}
+
+func TestRadiusMessageAuthenticatorMissing(t *testing.T) {
+
+	rs := &radiusStandIn{secret: []byte("testing123")}
+	requestAuth := bytes.Repeat([]byte{1}, RADIUS_AUTHENTICATOR_LEN)
+
+	for _, code := range []byte{RADIUS_CODE_ACCESS_ACCEPT, RADIUS_CODE_ACCESS_REJECT, RADIUS_CODE_ACCESS_CHALLENGE} {
+
+		rs.noMessageAuth.Store(false)
+		data := rs.encodeResponse(&RadiusPacket{Code: code}, requestAuth)
+		if err := verifyRadiusResponse(data, requestAuth, rs.secret, true); err != nil {
+			t.Fatalf("code %v with message authenticator should pass,%v", code, err)
+		}
+
+		rs.noMessageAuth.Store(true)
+		data = rs.encodeResponse(&RadiusPacket{Code: code}, requestAuth)
+		if err := verifyRadiusResponse(data, requestAuth, rs.secret, true); err == nil {
+			t.Fatalf("code %v without message authenticator should be rejected", code)
+		}
+		if err := verifyRadiusResponse(data, requestAuth, rs.secret, false); err != nil {
+			t.Fatalf("code %v to request without message authenticator should pass,%v", code, err)
+		}
+	}
+
+	//accounting responses never carry it
+	data := rs.encodeResponse(&RadiusPacket{Code: RADIUS_CODE_ACCOUNTING_RESPONSE}, requestAuth)
+	if err := verifyRadiusResponse(data, requestAuth, rs.secret, true); err != nil {
+		t.Fatalf("accounting response should pass,%v", err)
+	}
+
+	//the client drops the reply and times out
+	server := newRadiusStandIn(t, "testing123", "alice", "123456")
+	server.noMessageAuth.Store(true)
+
+	client := NewRadiusClient([]string{server.Addr()}, "testing123", time.Millisecond*500, 0)
+	req := &RadiusPacket{Code: RADIUS_CODE_ACCESS_REQUEST}
+	req.AddString(RADIUS_ATTR_USER_NAME, "alice")
+	if _, err := client.Exchange(req, []byte("123456")); err == nil {
+		t.Fatal("access accept without message authenticator should be dropped")
+	}
+}
+
+func TestRadiusAccounting(t *testing.T) {
+
+	server := newRadiusStandIn(t, "testing123", "alice", "123456")
+
+	ra := NewRadiusAccounting(NewRadiusClient([]string{server.Addr()}, "testing123", time.Second, 0), "polevpn", time.Hour)
+	ra.Start()
+
+	s, mt, _ := newTestSession(0, 0)
+	go s.Read()
+	defer s.Close(false)
+
+	status := func(req *RadiusPacket) uint32 {
+		return binary.BigEndian.Uint32(req.Get(RADIUS_ATTR_ACCT_STATUS_TYPE))
+	}
+	octets := func(req *RadiusPacket, typ byte) uint32 {
+		return binary.BigEndian.Uint32(req.Get(typ))
+	}
+	recv := func() *RadiusPacket {
+		select {
+		case req := <-server.acct:
+			return req
+		case <-time.After(time.Second * 2):
+			t.Fatal("no accounting request received")
+			return nil
+		}
+	}
+
+	ra.OnStart("alice", "10.8.0.2", s)
+	start := recv()
+	if status(start) != RADIUS_ACCT_STATUS_START || string(start.Get(RADIUS_ATTR_USER_NAME)) != "alice" || net.IP(start.Get(RADIUS_ATTR_FRAMED_IP_ADDRESS)).String() != "10.8.0.2" {
+		t.Fatalf("unexpected start %+v", start)
+	}
+
+	mt.in <- newPolePacket(CMD_C2S_IPDATA, make([]byte, 100))
+	for s.UpStreamBytes() != 100 {
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	ra.interim()
+	interim := recv()
+	if status(interim) != RADIUS_ACCT_STATUS_INTERIM || octets(interim, RADIUS_ATTR_ACCT_INPUT_OCTETS) != 100 {
+		t.Fatalf("unexpected interim %+v", interim)
+	}
+
+	ra.OnClosed(s, true)
+	stop := recv()
+	if status(stop) != RADIUS_ACCT_STATUS_STOP || octets(stop, RADIUS_ATTR_ACCT_INPUT_OCTETS) != 100 ||
+		octets(stop, RADIUS_ATTR_ACCT_TERMINATE_CAUSE) != RADIUS_TERMINATE_USER_REQUEST {
+		t.Fatalf("unexpected stop %+v", stop)
+	}
+	if !bytes.Equal(stop.Get(RADIUS_ATTR_ACCT_SESSION_ID), start.Get(RADIUS_ATTR_ACCT_SESSION_ID)) {
+		t.Fatal("session id changed")
+	}
+
+	ra.Close()
+}
+
+func TestRadiusAccountingOnTimeout(t *testing.T) {
+
+	addresspool, _ := NewAddressPool("10.8.0.0/24", map[string]string{})
+	connmgr := NewConnMgr()
+	connmgr.SetAddressPool(addresspool)
+
+	//not started,so requests just stay queued
+	ra := NewRadiusAccounting(nil, "polevpn", time.Hour)
+
+	handler := NewRequestHandler()
+	handler.SetConnMgr(connmgr)
+	handler.SetRadiusAccounting(ra)
+
+	s := NewSession(newMemTransport(), NewRateLimiter(0, 0, time.Second), NewRateLimiter(0, 0, time.Second), handler)
+	go s.Read()
+
+	connmgr.AttachUserToConn("alice", s)
+	ip := connmgr.AllocAddress(s)
+	connmgr.AttachIPAddressToConn(ip, s)
+	ra.OnStart("alice", ip, s)
+
+	connmgr.checkTimeout(time.Now().Add(time.Minute * (CONNECTION_TIMEOUT + 1)))
+
+	sessions := func() int {
+		ra.mutex.Lock()
+		defer ra.mutex.Unlock()
+		return len(ra.sessions)
+	}
+	for i := 0; sessions() != 0 || connmgr.GetConnAttachUser(s) != ""; i++ {
+		if i == 50 {
+			t.Fatal("timed out session should be stopped")
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+
+	<-ra.reqs
+	if stop := <-ra.reqs; binary.BigEndian.Uint32(stop.Get(RADIUS_ATTR_ACCT_STATUS_TYPE)) != RADIUS_ACCT_STATUS_STOP {
+		t.Fatal("accounting stop of timed out session missing")
+	}
+	if connmgr.IsAllocedAddress(ip) {
+		t.Fatal("address of timed out session should be released")
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_TRAFFIC_MAX_DELAY = 100
+	MIN_TRAFFIC_BURST         = 65536
+)
+
+// RateLimiter is a token bucket,rate is bytes per second and burst is the bucket size,
+// packets exceeding the bucket wait for tokens,and are tail dropped if they would wait longer than maxDelay
+type RateLimiter struct {
+	rate     float64
+	burst    float64
+	maxDelay time.Duration
+	tokens   float64
+	last     time.Time
+	now      func() time.Time
+	mutex    *sync.Mutex
+}
+
+// NewRateLimiter create a limiter,rate 0 means unlimited,burst 0 means rate/10 but at least MIN_TRAFFIC_BURST
+func NewRateLimiter(rate uint64, burst uint64, maxDelay time.Duration) *RateLimiter {
+
+	if burst == 0 {
+		burst = rate / 10
+		if burst < MIN_TRAFFIC_BURST {
+			burst = MIN_TRAFFIC_BURST
+		}
+	}
+
+	rl := &RateLimiter{
+		rate:     float64(rate),
+		burst:    float64(burst),
+		maxDelay: maxDelay,
+		tokens:   float64(burst),
+		now:      time.Now,
+		mutex:    &sync.Mutex{},
+	}
+	rl.last = rl.now()
+	return rl
+}
+
+func (rl *RateLimiter) Rate() uint64 {
+	return uint64(rl.rate)
+}
+
+// Take take n bytes of tokens,return how long the caller should wait before sending the packet,
+// false means the packet should be dropped
+func (rl *RateLimiter) Take(n int) (time.Duration, bool) {
+
+	if rl.rate <= 0 {
+		return 0, true
+	}
+
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	now := rl.now()
+	elapsed := now.Sub(rl.last)
+	rl.last = now
+
+	if elapsed > 0 {
+		rl.tokens += elapsed.Seconds() * rl.rate
+		if rl.tokens > rl.burst {
+			rl.tokens = rl.burst
+		}
+	}
+
+	if rl.tokens >= float64(n) {
+		rl.tokens -= float64(n)
+		return 0, true
+	}
+
+	wait := time.Duration((float64(n) - rl.tokens) * float64(time.Second) / rl.rate)
+	if wait > rl.maxDelay {
+		return 0, false
+	}
+
+	rl.tokens -= float64(n)
+	return wait, true
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiterTake(t *testing.T) {
+
+	now := time.Unix(0, 0)
+
+	// 1000 bytes/s,bucket 1000 bytes,wait at most 500ms
+	rl := NewRateLimiter(1000, 1000, 500*time.Millisecond)
+	rl.now = func() time.Time { return now }
+	rl.last = now
+
+	tests := []struct {
+		advance time.Duration
+		bytes   int
+		wait    time.Duration
+		pass    bool
+	}{
+		{0, 600, 0, true},
+		{0, 400, 0, true},
+		{0, 200, 200 * time.Millisecond, true},
+		{0, 200, 400 * time.Millisecond, true},
+		{0, 200, 0, false},
+		{400 * time.Millisecond, 100, 100 * time.Millisecond, true},
+		{10 * time.Second, 1000, 0, true},
+		{0, 1600, 0, false},
+	}
+
+	for i, test := range tests {
+		now = now.Add(test.advance)
+		wait, pass := rl.Take(test.bytes)
+		if wait != test.wait || pass != test.pass {
+			t.Fatalf("step %v,expect wait %v pass %v,got wait %v pass %v", i, test.wait, test.pass, wait, pass)
+		}
+	}
+}
+
+func TestRateLimiterUnlimited(t *testing.T) {
+
+	rl := NewRateLimiter(0, 0, 0)
+	for i := 0; i < 1000; i++ {
+		wait, pass := rl.Take(1500)
+		if wait != 0 || !pass {
+			t.Fatal("unlimited limiter should always pass")
+		}
+	}
+}
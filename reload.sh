@@ -0,0 +1 @@
+kill -HUP `pgrep -f "polevpn_server"`
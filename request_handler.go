@@ -1,26 +1,52 @@
 package main
 
 import (
+	"errors"
 	"net"
+	"sync"
+	"sync/atomic"
 
 	"github.com/polevpn/anyvalue"
 	"github.com/polevpn/elog"
 	"github.com/polevpn/netstack/tcpip/header"
 )
 
+const (
+	CLIENT_ISOLATION_NONE  = ""
+	CLIENT_ISOLATION_ALL   = "all"
+	CLIENT_ISOLATION_GROUP = "group"
+)
+
+// PacketEgress take ip packets of clients to destinations out of the vpn network,
+// it is either a tun device or a userspace netstack
+type PacketEgress interface {
+	Enqueue(pkt []byte) error
+	Close() error
+}
+
 type RequestHandler struct {
-	tunio     *TunIO
-	connmgr   *ConnMgr
-	routermgr *RouterMgr
+	egress      PacketEgress
+	connmgr     *ConnMgr
+	routermgr   *RouterMgr
+	accounting  *TrafficAccounting
+	radiusAcct  *RadiusAccounting
+	acl         *ACL
+	isolation   atomic.Value
+	antiSpoof   atomic.Bool
+	spoofLimit  atomic.Int64
+	spoofs      map[string]int64
+	dnsServer   string
+	tokenSigner *SessionTokenSigner
+	mutex       *sync.Mutex
 }
 
 func NewRequestHandler() *RequestHandler {
 
-	return &RequestHandler{}
+	return &RequestHandler{spoofs: make(map[string]int64), mutex: &sync.Mutex{}}
 }
 
-func (r *RequestHandler) SetTunIO(tunio *TunIO) {
-	r.tunio = tunio
+func (r *RequestHandler) SetEgress(egress PacketEgress) {
+	r.egress = egress
 }
 
 func (r *RequestHandler) SetConnMgr(connmgr *ConnMgr) {
@@ -31,6 +57,121 @@ func (r *RequestHandler) SetRouterMgr(routermgr *RouterMgr) {
 	r.routermgr = routermgr
 }
 
+func (r *RequestHandler) SetTrafficAccounting(accounting *TrafficAccounting) {
+	r.accounting = accounting
+}
+
+// SetSessionTokenSigner make alloc ip address response carry a session token for reconnect
+func (r *RequestHandler) SetSessionTokenSigner(tokenSigner *SessionTokenSigner) {
+	r.tokenSigner = tokenSigner
+}
+
+// SetRadiusAccounting make sessions which get an ip address reported to radius accounting servers
+func (r *RequestHandler) SetRadiusAccounting(radiusAcct *RadiusAccounting) {
+	r.radiusAcct = radiusAcct
+}
+
+func (r *RequestHandler) SetACL(acl *ACL) {
+	r.acl = acl
+}
+
+// SetClientIsolation set whether clients can reach each other,all means never,group means only within the same group,
+// gateways of server_routes are always reachable
+func (r *RequestHandler) SetClientIsolation(mode string) error {
+	if mode != CLIENT_ISOLATION_NONE && mode != CLIENT_ISOLATION_ALL && mode != CLIENT_ISOLATION_GROUP {
+		return errors.New("client isolation should be all or group")
+	}
+	r.isolation.Store(mode)
+	return nil
+}
+
+// SetDNSServer set the dns server returned to clients instead of the dns config value
+func (r *RequestHandler) SetDNSServer(ip string) {
+	r.dnsServer = ip
+}
+
+// SetAntiSpoofing set whether packets whose source isn't the address of conn or a subnet it routes are dropped,
+// conn is kicked out after kickThreshold spoofed packets,0 means never
+func (r *RequestHandler) SetAntiSpoofing(enable bool, kickThreshold int) {
+	r.antiSpoof.Store(enable)
+	r.spoofLimit.Store(int64(kickThreshold))
+}
+
+// checkSourceAddress check src is the address assigned to conn,or in a subnet conn is the gateway of
+func (r *RequestHandler) checkSourceAddress(srcIp net.IP, conn Conn) bool {
+
+	ip := r.connmgr.GeIPByConn(conn)
+	if ip == "" {
+		return false
+	}
+
+	if srcIp.To4() != nil {
+		if srcIp.String() == ip {
+			return true
+		}
+	} else if srcIp.String() == r.connmgr.GetIPv6Address(ip) {
+		return true
+	}
+
+	return r.routermgr.FindRoute(srcIp) == ip
+}
+
+func (r *RequestHandler) onSpoofedPacket(srcIp net.IP, conn Conn) {
+
+	metricSpoofDrops.Inc()
+	elog.Debug("drop spoofed pkt from ", conn.String(), ",src ", srcIp.String())
+
+	limit := r.spoofLimit.Load()
+	if limit <= 0 {
+		return
+	}
+
+	r.mutex.Lock()
+	r.spoofs[conn.String()]++
+	count := r.spoofs[conn.String()]
+	r.mutex.Unlock()
+
+	if count == limit {
+		elog.Infof("user:%v send %v spoofed packets,kick out %v", r.connmgr.GetConnAttachUser(conn), count, conn.String())
+		r.connmgr.KickOut(conn)
+	}
+}
+
+func (r *RequestHandler) allowClientToClient(from Conn, to Conn) bool {
+
+	mode, _ := r.isolation.Load().(string)
+	if mode == CLIENT_ISOLATION_NONE {
+		return true
+	}
+
+	//from is nil for dns queries which don't come from a client
+	if from == nil {
+		return false
+	}
+
+	if r.routermgr.IsGateway(r.connmgr.GeIPByConn(from)) || r.routermgr.IsGateway(r.connmgr.GeIPByConn(to)) {
+		return true
+	}
+
+	if mode == CLIENT_ISOLATION_ALL {
+		return false
+	}
+
+	fromGroups := r.connmgr.GetConnGroups(from)
+	toGroups := r.connmgr.GetConnGroups(to)
+	if r.acl != nil {
+		fromGroups = r.acl.GetUserGroups(r.connmgr.GetConnAttachUser(from), fromGroups)
+		toGroups = r.acl.GetUserGroups(r.connmgr.GetConnAttachUser(to), toGroups)
+	}
+
+	for _, group := range fromGroups {
+		if containsString(toGroups, group) {
+			return true
+		}
+	}
+	return false
+}
+
 func (r *RequestHandler) OnRequest(pkt []byte, conn Conn) {
 
 	ppkt := PolePacket(pkt)
@@ -50,7 +191,7 @@ func (r *RequestHandler) OnRequest(pkt []byte, conn Conn) {
 	}
 }
 
-func (r *RequestHandler) OnConnection(conn Conn, user string, ip string) {
+func (r *RequestHandler) OnConnection(conn Conn, user string, ip string, deviceId string, policy *UserPolicy) {
 	if ip != "" {
 		oldconn := r.connmgr.GetConnByIP(ip)
 		if oldconn != nil {
@@ -61,6 +202,13 @@ func (r *RequestHandler) OnConnection(conn Conn, user string, ip string) {
 
 	}
 	r.connmgr.AttachUserToConn(user, conn)
+	r.connmgr.AttachPolicyToConn(policy, conn)
+	if deviceId != "" {
+		r.connmgr.AttachDeviceToConn(deviceId, conn)
+	}
+	if ip != "" && r.radiusAcct != nil {
+		r.radiusAcct.OnStart(user, ip, conn)
+	}
 
 }
 
@@ -73,10 +221,27 @@ func (r *RequestHandler) handleAllocIPAddress(pkt PolePacket, conn Conn) {
 		elog.Error("ip alloc fail,no more ip address")
 	}
 
-	elog.Infof("alloc ip %v to %v", ip, conn.String())
+	ip6 := r.connmgr.GetIPv6Address(ip)
+
+	elog.Infof("alloc ip %v,ip6 %v to %v", ip, ip6, conn.String())
 	av.Set("ip", ip)
-	av.Set("dns", Config.Get("dns").AsStr())
-	av.Set("route", Config.Get("client_routes").AsStrArr())
+	if ip6 != "" {
+		av.Set("ip6", ip6)
+	}
+	if r.dnsServer != "" {
+		av.Set("dns", r.dnsServer)
+	} else {
+		av.Set("dns", Config().Get("dns").AsStr())
+	}
+	av.Set("route", Config().Get("client_routes").AsStrArr())
+	if ip != "" && r.tokenSigner != nil {
+		token, err := r.tokenSigner.Sign(r.connmgr.GetConnAttachUser(conn), ip, r.connmgr.GetConnDevice(conn), r.connmgr.GetConnPolicy(conn))
+		if err != nil {
+			elog.Error("sign session token fail,", err)
+		} else {
+			av.Set("token", token)
+		}
+	}
 	body, _ := av.MarshalJSON()
 	buf := make([]byte, POLE_PACKET_HEADER_LEN+len(body))
 	copy(buf[POLE_PACKET_HEADER_LEN:], body)
@@ -87,32 +252,80 @@ func (r *RequestHandler) handleAllocIPAddress(pkt PolePacket, conn Conn) {
 	if ip != "" {
 		r.connmgr.AttachIPAddressToConn(ip, conn)
 		r.connmgr.AttachUserToIP(r.connmgr.GetConnAttachUser(conn), ip)
+		if r.radiusAcct != nil {
+			r.radiusAcct.OnStart(r.connmgr.GetConnAttachUser(conn), ip, conn)
+		}
 	}
 }
 
 func (r *RequestHandler) handleC2SIPData(pkt PolePacket, conn Conn) {
 
-	ipv4pkg := header.IPv4(pkt.Payload())
-	dstIp := ipv4pkg.DestinationAddress().To4()
-	dstIpStr := dstIp.String()
+	payload := pkt.Payload()
+	if len(payload) == 0 {
+		return
+	}
+
+	var srcIp, dstIp net.IP
+	var toconn Conn
+
+	ver := payload[0] >> 4
+	if ver == IPV4_PROTOCOL {
+		if len(payload) < header.IPv4MinimumSize {
+			return
+		}
+		srcIp = net.IP(header.IPv4(payload).SourceAddress().To4())
+		dstIp = net.IP(header.IPv4(payload).DestinationAddress().To4())
+		toconn = r.connmgr.GetConnByIP(dstIp.String())
+	} else if ver == IPV6_PROTOCOL {
+		if len(payload) < header.IPv6MinimumSize {
+			return
+		}
+		srcIp = net.IP(header.IPv6(payload).SourceAddress())
+		dstIp = net.IP(header.IPv6(payload).DestinationAddress())
+		toconn = r.connmgr.GetConnByIP6(dstIp.String())
+	} else {
+		elog.Debug("invalid ip version ", ver, " from ", conn.String())
+		return
+	}
 
-	elog.Debug("received pkt to ", dstIpStr)
+	elog.Debug("received pkt to ", dstIp.String())
 
-	toconn := r.connmgr.GetConnByIP(dstIpStr)
+	if r.antiSpoof.Load() && !r.checkSourceAddress(srcIp, conn) {
+		r.onSpoofedPacket(srcIp, conn)
+		return
+	}
+
+	if r.acl != nil && !r.acl.Check(r.connmgr.GetConnAttachUser(conn), r.connmgr.GetConnGroups(conn), payload, false) {
+		elog.Debug("acl deny pkt from ", conn.String(), " to ", dstIp.String())
+		metricACLDrops.Inc()
+		return
+	}
+
+	if toconn != nil && !r.allowClientToClient(conn, toconn) {
+		elog.Debug("client isolation drop pkt from ", conn.String(), " to ", toconn.String())
+		metricIsolationDrops.Inc()
+		return
+	}
 
 	if toconn == nil {
-		gw := r.routermgr.FindRoute(net.IP(dstIp))
+		gw := r.routermgr.FindRoute(dstIp)
 		toconn = r.connmgr.GetConnByIP(gw)
 	}
 
+	if toconn != nil && r.acl != nil && !r.acl.Check(r.connmgr.GetConnAttachUser(toconn), r.connmgr.GetConnGroups(toconn), payload, true) {
+		elog.Debug("acl deny pkt from ", conn.String(), " to ", toconn.String())
+		metricACLDrops.Inc()
+		return
+	}
+
 	if toconn != nil {
 		pkt.SetCmd(CMD_S2C_IPDATA)
 		toconn.Send(pkt)
 	} else {
-		if r.tunio != nil {
-			err := r.tunio.Enqueue(pkt[POLE_PACKET_HEADER_LEN:])
+		if r.egress != nil {
+			err := r.egress.Enqueue(pkt[POLE_PACKET_HEADER_LEN:])
 			if err != nil {
-				elog.Error("tunio enqueue fail,", err)
+				elog.Error("egress enqueue fail,", err)
 			}
 		}
 	}
@@ -136,6 +349,18 @@ func (r *RequestHandler) OnClosed(conn Conn, proactive bool) {
 
 	elog.Info("connection closed event from ", conn.String())
 
+	if r.accounting != nil {
+		r.accounting.OnClosed(r.connmgr.GetConnAttachUser(conn), conn)
+	}
+
+	if r.radiusAcct != nil {
+		r.radiusAcct.OnClosed(conn, proactive)
+	}
+
+	r.mutex.Lock()
+	delete(r.spoofs, conn.String())
+	r.mutex.Unlock()
+
 	r.connmgr.DetachIPAddressFromConn(conn)
 	r.connmgr.DetachUserFromConn(conn)
 	//just process proactive close event
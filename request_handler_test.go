@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestClientIsolation(t *testing.T) {
+
+	connmgr := NewConnMgr()
+	routermgr := NewRouterMgr()
+	routermgr.AddRoute("192.168.10.0/24", "10.8.0.10")
+
+	handler := NewRequestHandler()
+	handler.SetConnMgr(connmgr)
+	handler.SetRouterMgr(routermgr)
+	handler.SetACL(NewACL())
+
+	newConn := func(id string, user string, ip string, groups []string) Conn {
+		conn := &testConn{id: id}
+		connmgr.AttachIPAddressToConn(ip, conn)
+		connmgr.AttachUserToConn(user, conn)
+		connmgr.AttachPolicyToConn(&UserPolicy{Groups: groups}, conn)
+		return conn
+	}
+
+	alice := newConn("alice", "alice", "10.8.0.2", []string{"dev"})
+	bob := newConn("bob", "bob", "10.8.0.3", []string{"dev"})
+	carol := newConn("carol", "carol", "10.8.0.4", []string{"sales"})
+	gateway := newConn("gateway", "office", "10.8.0.10", nil)
+
+	tests := []struct {
+		mode  string
+		from  Conn
+		to    Conn
+		allow bool
+	}{
+		{CLIENT_ISOLATION_NONE, alice, carol, true},
+		{CLIENT_ISOLATION_ALL, alice, bob, false},
+		{CLIENT_ISOLATION_ALL, alice, gateway, true},
+		{CLIENT_ISOLATION_ALL, gateway, carol, true},
+		{CLIENT_ISOLATION_GROUP, alice, bob, true},
+		{CLIENT_ISOLATION_GROUP, alice, carol, false},
+		{CLIENT_ISOLATION_GROUP, carol, gateway, true},
+	}
+
+	for i, test := range tests {
+		err := handler.SetClientIsolation(test.mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if handler.allowClientToClient(test.from, test.to) != test.allow {
+			t.Fatalf("case %v,expect allow %v", i, test.allow)
+		}
+	}
+
+	if handler.SetClientIsolation("bad") == nil {
+		t.Fatal("invalid mode should fail")
+	}
+}
+
+func TestCheckSourceAddress(t *testing.T) {
+
+	connmgr := NewConnMgr()
+	routermgr := NewRouterMgr()
+	routermgr.AddRoute("192.168.10.0/24", "10.8.0.10")
+
+	handler := NewRequestHandler()
+	handler.SetConnMgr(connmgr)
+	handler.SetRouterMgr(routermgr)
+
+	client := &testConn{id: "client"}
+	connmgr.AttachIPAddressToConn("10.8.0.2", client)
+	gateway := &testConn{id: "gateway"}
+	connmgr.AttachIPAddressToConn("10.8.0.10", gateway)
+	unalloc := &testConn{id: "unalloc"}
+
+	tests := []struct {
+		src   string
+		conn  Conn
+		valid bool
+	}{
+		{"10.8.0.2", client, true},
+		{"10.8.0.3", client, false},
+		{"192.168.10.5", client, false},
+		{"192.168.10.5", gateway, true},
+		{"10.8.0.10", gateway, true},
+		{"192.168.11.5", gateway, false},
+		{"10.8.0.2", unalloc, false},
+	}
+
+	for i, test := range tests {
+		if handler.checkSourceAddress(net.ParseIP(test.src), test.conn) != test.valid {
+			t.Fatalf("case %v,expect valid %v", i, test.valid)
+		}
+	}
+}
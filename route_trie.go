@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net"
+)
+
+type routeNode struct {
+	children [2]*routeNode
+	gw       string
+	leaf     bool
+}
+
+// RouteTrie is a binary trie keyed on address bits,lookup return the gateway of the longest matched prefix
+type RouteTrie struct {
+	root4 *routeNode
+	root6 *routeNode
+}
+
+func NewRouteTrie() *RouteTrie {
+	return &RouteTrie{root4: &routeNode{}, root6: &routeNode{}}
+}
+
+func (rt *RouteTrie) root(ip net.IP) (*routeNode, net.IP) {
+	if ipv4 := ip.To4(); ipv4 != nil {
+		return rt.root4, ipv4
+	}
+	if ipv6 := ip.To16(); ipv6 != nil {
+		return rt.root6, ipv6
+	}
+	return nil, nil
+}
+
+// prefix return the root,address and prefix length of subnet,ipv4 mapped ipv6 subnets are ipv4 routes,
+// so their prefix length counts from the ipv4 part
+func (rt *RouteTrie) prefix(subnet *net.IPNet) (*routeNode, net.IP, int) {
+
+	node, ip := rt.root(subnet.IP)
+	if node == nil {
+		return nil, nil, 0
+	}
+
+	ones, bits := subnet.Mask.Size()
+	if len(ip) == net.IPv4len && bits == net.IPv6len*8 {
+		ones -= (net.IPv6len - net.IPv4len) * 8
+	}
+	if ones < 0 || ones > len(ip)*8 {
+		return nil, nil, 0
+	}
+	return node, ip, ones
+}
+
+func addressBit(ip net.IP, i int) int {
+	return int(ip[i/8]>>(7-uint(i%8))) & 1
+}
+
+func (rt *RouteTrie) Insert(subnet *net.IPNet, gw string) {
+
+	node, ip, ones := rt.prefix(subnet)
+	if node == nil {
+		return
+	}
+
+	for i := 0; i < ones; i++ {
+		bit := addressBit(ip, i)
+		if node.children[bit] == nil {
+			node.children[bit] = &routeNode{}
+		}
+		node = node.children[bit]
+	}
+
+	node.gw = gw
+	node.leaf = true
+}
+
+func (rt *RouteTrie) Delete(subnet *net.IPNet) {
+
+	node, ip, ones := rt.prefix(subnet)
+	if node == nil {
+		return
+	}
+
+	path := make([]*routeNode, 0, ones+1)
+	path = append(path, node)
+
+	for i := 0; i < ones; i++ {
+		node = node.children[addressBit(ip, i)]
+		if node == nil {
+			return
+		}
+		path = append(path, node)
+	}
+
+	node.gw = ""
+	node.leaf = false
+
+	//prune the nodes which no longer lead to any route
+	for i := len(path) - 1; i > 0; i-- {
+		node := path[i]
+		if node.leaf || node.children[0] != nil || node.children[1] != nil {
+			break
+		}
+		path[i-1].children[addressBit(ip, i-1)] = nil
+	}
+}
+
+func (rt *RouteTrie) Lookup(destIP net.IP) string {
+
+	node, ip := rt.root(destIP)
+	if node == nil {
+		return ""
+	}
+
+	gw := ""
+	if node.leaf {
+		gw = node.gw
+	}
+
+	for i := 0; i < len(ip)*8; i++ {
+		node = node.children[addressBit(ip, i)]
+		if node == nil {
+			break
+		}
+		if node.leaf {
+			gw = node.gw
+		}
+	}
+	return gw
+}
@@ -2,103 +2,126 @@ package main
 
 import (
 	"net"
-	"sort"
 	"sync"
 )
 
 type RouterMgr struct {
-	routetable  map[string]string
-	nettable    map[string]*net.IPNet
-	mutex       *sync.RWMutex
-	sortedtable []string
+	routetable map[string]string
+	trie       *RouteTrie
+	mutex      *sync.RWMutex
 }
 
 func NewRouterMgr() *RouterMgr {
 	rm := &RouterMgr{
-		routetable:  make(map[string]string),
-		mutex:       &sync.RWMutex{},
-		sortedtable: make([]string, 0),
-		nettable:    make(map[string]*net.IPNet),
+		routetable: make(map[string]string),
+		mutex:      &sync.RWMutex{},
+		trie:       NewRouteTrie(),
 	}
 	return rm
 }
 
 func (rm *RouterMgr) AddRoute(cidr string, gw string) bool {
 
+	_, subnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return false
+	}
+
 	rm.mutex.Lock()
 	defer rm.mutex.Unlock()
 
-	_, ok := rm.routetable[cidr]
+	_, ok := rm.routetable[subnet.String()]
 	if ok {
 		return false
 	}
 
-	rm.routetable[cidr] = gw
+	rm.routetable[subnet.String()] = gw
+	rm.trie.Insert(subnet, gw)
 
-	var sortedtable []string
-	for route := range rm.routetable {
-		sortedtable = append(sortedtable, route)
-		_, subnet, err := net.ParseCIDR(route)
-		if err != nil {
-			continue
-		}
-		rm.nettable[route] = subnet
+	return true
+}
+
+// ReplaceRoute add route or change its gateway in place,so the prefix is never without a route,
+// return false if the route already goes via gw
+func (rm *RouterMgr) ReplaceRoute(cidr string, gw string) bool {
+
+	_, subnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return false
 	}
 
-	sort.Strings(sortedtable)
-	rm.sortedtable = sortedtable
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+
+	if ogw, ok := rm.routetable[subnet.String()]; ok && ogw == gw {
+		return false
+	}
+
+	rm.routetable[subnet.String()] = gw
+	rm.trie.Insert(subnet, gw)
 
 	return true
 }
 
 func (rm *RouterMgr) GetRoute(cidr string) string {
 
+	_, subnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return ""
+	}
+
 	rm.mutex.RLock()
 	defer rm.mutex.RUnlock()
 
-	return rm.routetable[cidr]
+	return rm.routetable[subnet.String()]
 
 }
 
 func (rm *RouterMgr) DelRoute(cidr string) {
+
+	_, subnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return
+	}
+
 	rm.mutex.Lock()
 	defer rm.mutex.Unlock()
 
-	delete(rm.routetable, cidr)
+	delete(rm.routetable, subnet.String())
+	rm.trie.Delete(subnet)
+
+}
+
+// IsGateway check whether ip is the gateway of any route
+func (rm *RouterMgr) IsGateway(ip string) bool {
 
-	var sortedtable []string
-	for route := range rm.routetable {
-		sortedtable = append(sortedtable, route)
-		_, subnet, err := net.ParseCIDR(route)
-		if err != nil {
-			continue
+	rm.mutex.RLock()
+	defer rm.mutex.RUnlock()
+
+	for _, gw := range rm.routetable {
+		if gw == ip {
+			return true
 		}
-		rm.nettable[route] = subnet
 	}
+	return false
+}
 
-	sort.Strings(sortedtable)
-	rm.sortedtable = sortedtable
+func (rm *RouterMgr) GetRoutes() map[string]string {
 
+	rm.mutex.RLock()
+	defer rm.mutex.RUnlock()
+
+	routes := make(map[string]string, len(rm.routetable))
+	for cidr, gw := range rm.routetable {
+		routes[cidr] = gw
+	}
+	return routes
 }
 
 func (rm *RouterMgr) FindRoute(destIP net.IP) string {
 
 	rm.mutex.RLock()
 	defer rm.mutex.RUnlock()
-	slen := len(rm.sortedtable)
 
-	for i := slen - 1; i > -1; i-- {
-
-		route := rm.sortedtable[i]
-		subnet := rm.nettable[route]
-		if subnet == nil {
-			continue
-		}
-		gw := rm.routetable[route]
-		find := subnet.Contains(net.IP(destIP))
-		if find {
-			return gw
-		}
-	}
-	return ""
+	return rm.trie.Lookup(destIP)
 }
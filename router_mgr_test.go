@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestRouterMgrFindRoute(t *testing.T) {
+
+	routes := map[string]string{
+		"0.0.0.0/0":      "10.8.0.2",
+		"10.0.0.0/8":     "10.8.0.3",
+		"10.1.0.0/16":    "10.8.0.4",
+		"10.1.2.0/24":    "10.8.0.5",
+		"10.1.2.128/25":  "10.8.0.6",
+		"192.168.1.1/32": "10.8.0.7",
+		"fd00::/16":      "10.8.0.8",
+		"fd00:1::/32":    "10.8.0.9",
+		//ipv4 mapped prefix is an ipv4 route of 172.16.0.0/12
+		"::ffff:172.16.0.0/108": "10.8.0.10",
+	}
+
+	rm := NewRouterMgr()
+	for cidr, gw := range routes {
+		if !rm.AddRoute(cidr, gw) {
+			t.Fatal("add route ", cidr, " fail")
+		}
+	}
+
+	tests := []struct {
+		ip string
+		gw string
+	}{
+		{"8.8.8.8", "10.8.0.2"},
+		{"10.2.3.4", "10.8.0.3"},
+		{"10.1.3.4", "10.8.0.4"},
+		{"10.1.2.3", "10.8.0.5"},
+		{"10.1.2.200", "10.8.0.6"},
+		{"192.168.1.1", "10.8.0.7"},
+		{"192.168.1.2", "10.8.0.2"},
+		{"fd00:2::1", "10.8.0.8"},
+		{"fd00:1::1", "10.8.0.9"},
+		{"fe80::1", ""},
+		{"172.20.1.1", "10.8.0.10"},
+		{"172.32.1.1", "10.8.0.2"},
+	}
+
+	for _, test := range tests {
+		gw := rm.FindRoute(net.ParseIP(test.ip))
+		if gw != test.gw {
+			t.Errorf("find route %v,expect %v,got %v", test.ip, test.gw, gw)
+		}
+	}
+}
+
+func TestRouterMgrDelRoute(t *testing.T) {
+
+	rm := NewRouterMgr()
+	rm.AddRoute("10.0.0.0/8", "10.8.0.3")
+	rm.AddRoute("10.1.0.0/16", "10.8.0.4")
+
+	if rm.AddRoute("10.1.0.1/16", "10.8.0.5") {
+		t.Fatal("duplicate route should not be added")
+	}
+
+	tests := []struct {
+		del string
+		ip  string
+		gw  string
+	}{
+		{"", "10.1.2.3", "10.8.0.4"},
+		{"10.1.0.0/16", "10.1.2.3", "10.8.0.3"},
+		{"10.0.0.0/8", "10.1.2.3", ""},
+	}
+
+	for _, test := range tests {
+		if test.del != "" {
+			rm.DelRoute(test.del)
+		}
+		gw := rm.FindRoute(net.ParseIP(test.ip))
+		if gw != test.gw {
+			t.Errorf("after delete %v,find route %v,expect %v,got %v", test.del, test.ip, test.gw, gw)
+		}
+	}
+
+	if rm.GetRoute("10.1.0.0/16") != "" {
+		t.Fatal("deleted route still exist")
+	}
+
+	rm.AddRoute("::ffff:172.16.0.0/108", "10.8.0.10")
+	rm.DelRoute("::ffff:172.16.0.0/108")
+	if gw := rm.FindRoute(net.ParseIP("172.16.1.1")); gw != "" {
+		t.Fatalf("deleted ipv4 mapped route still found,%v", gw)
+	}
+}
+
+func TestRouterMgrReplaceRoute(t *testing.T) {
+
+	rm := NewRouterMgr()
+	rm.AddRoute("10.1.0.0/16", "10.8.0.4")
+
+	if rm.ReplaceRoute("10.1.0.0/16", "10.8.0.4") {
+		t.Fatal("route with the same gateway should not be replaced")
+	}
+	if !rm.ReplaceRoute("10.1.0.1/16", "10.8.0.5") {
+		t.Fatal("replace route fail")
+	}
+	if gw := rm.FindRoute(net.ParseIP("10.1.2.3")); gw != "10.8.0.5" || rm.GetRoute("10.1.0.0/16") != "10.8.0.5" {
+		t.Fatalf("route should go via new gateway,got %v", gw)
+	}
+	if !rm.ReplaceRoute("10.2.0.0/16", "10.8.0.6") || rm.FindRoute(net.ParseIP("10.2.0.1")) != "10.8.0.6" {
+		t.Fatal("replace should add missing route")
+	}
+}
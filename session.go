@@ -0,0 +1,248 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/polevpn/elog"
+)
+
+const (
+	CH_SESSION_WRITE_SIZE = 100
+)
+
+// PacketTransport read and write whole pole packets,ReadPacket and WritePacket are each called from a single goroutine,
+// Close should unblock both of them
+type PacketTransport interface {
+	ReadPacket() ([]byte, error)
+	WritePacket(pkt []byte) error
+	Close() error
+	LocalAddr() net.Addr
+	RemoteAddr() net.Addr
+	Name() string
+}
+
+// SessionHandler receive packets and close event of sessions
+type SessionHandler interface {
+	OnRequest(pkt []byte, conn Conn)
+	OnClosed(conn Conn, proactive bool)
+}
+
+// Session implement Conn on a PacketTransport,it queues packets to send,limits rate and counts traffic of ip data,
+// and tells handler when the transport fails,packets over the rate are delayed by a DelayQueue so Read and Write never sleep
+type Session struct {
+	transport    PacketTransport
+	name         string
+	wch          chan []byte
+	closed       bool
+	handler      SessionHandler
+	downlimiter  *RateLimiter
+	uplimiter    *RateLimiter
+	tcDownStream *TrafficCounter
+	tcUpStream   *TrafficCounter
+	connectTime  time.Time
+	writeDone    chan struct{}
+	mutex        *sync.Mutex
+}
+
+func NewSession(transport PacketTransport, downlimiter *RateLimiter, uplimiter *RateLimiter, handler SessionHandler) *Session {
+	return &Session{
+		transport:    transport,
+		name:         transport.RemoteAddr().String() + "->" + transport.LocalAddr().String(),
+		wch:          make(chan []byte, CH_SESSION_WRITE_SIZE),
+		handler:      handler,
+		downlimiter:  downlimiter,
+		uplimiter:    uplimiter,
+		tcDownStream: NewTrafficCounter().WithMetric(metricDownBytes, metricDownPackets),
+		tcUpStream:   NewTrafficCounter().WithMetric(metricUpBytes, metricUpPackets),
+		connectTime:  time.Now(),
+		writeDone:    make(chan struct{}),
+		mutex:        &sync.Mutex{},
+	}
+}
+
+// markClosed stop accepting packets to send,return false if session has been closed
+func (s *Session) markClosed() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return false
+	}
+	s.closed = true
+	close(s.wch)
+	return true
+}
+
+// Close close the transport at once,flag means notify handler
+func (s *Session) Close(flag bool) error {
+	if !s.markClosed() {
+		return nil
+	}
+	err := s.transport.Close()
+	if flag {
+		go s.handler.OnClosed(s, false)
+	}
+	return err
+}
+
+// Shutdown stop sending new packets,wait queued packets written until timeout and close the connection
+func (s *Session) Shutdown(timeout time.Duration) error {
+	if !s.markClosed() {
+		return nil
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-s.writeDone:
+	case <-timer.C:
+	}
+
+	return s.transport.Close()
+}
+
+func (s *Session) String() string {
+	return s.name
+}
+
+func (s *Session) IsClosed() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.closed
+}
+
+func (s *Session) Transport() string {
+	return s.transport.Name()
+}
+
+func (s *Session) RemoteAddr() string {
+	return s.transport.RemoteAddr().String()
+}
+
+func (s *Session) ConnectTime() time.Time {
+	return s.connectTime
+}
+
+func (s *Session) UpStreamBytes() uint64 {
+	return s.tcUpStream.StreamTotalBytes()
+}
+
+func (s *Session) DownStreamBytes() uint64 {
+	return s.tcDownStream.StreamTotalBytes()
+}
+
+// checkStreamLimit count the packet and return how long to wait before forwarding it,false means drop it
+func (s *Session) checkStreamLimit(pkt []byte, tfcounter *TrafficCounter, limiter *RateLimiter) (time.Duration, bool) {
+	wait, pass := limiter.Take(len(pkt))
+	if !pass {
+		metricLimitDrops.Inc()
+		return 0, false
+	}
+	tfcounter.StreamCount(uint64(len(pkt)))
+	return wait, true
+}
+
+func (s *Session) Read() {
+
+	defer func() {
+		s.Close(true)
+	}()
+
+	defer PanicHandler()
+
+	queue := NewDelayQueue(CH_SESSION_WRITE_SIZE, func(pkt []byte) {
+		s.handler.OnRequest(pkt, s)
+	})
+	go queue.Run()
+	defer queue.Close()
+
+	for {
+
+		pkt, err := s.transport.ReadPacket()
+		if err != nil {
+			elog.Info(s.String(), " read ", s.transport.Name(), " end,status=", err)
+			return
+		}
+
+		if len(pkt) < POLE_PACKET_HEADER_LEN {
+			elog.Error(s.String(), " invalid pkt len=", len(pkt))
+			continue
+		}
+
+		var wait time.Duration
+		ppkt := PolePacket(pkt)
+		if ppkt.Cmd() == CMD_C2S_IPDATA {
+			//traffic limit
+			var pass bool
+			wait, pass = s.checkStreamLimit(ppkt.Payload(), s.tcUpStream, s.uplimiter)
+			if !pass {
+				continue
+			}
+		}
+		if !queue.Push(pkt, wait) {
+			metricLimitDrops.Inc()
+		}
+	}
+}
+
+func (s *Session) Write() {
+
+	defer PanicHandler()
+	defer close(s.writeDone)
+
+	failed := false
+	queue := NewDelayQueue(CH_SESSION_WRITE_SIZE, func(pkt []byte) {
+		if failed {
+			return
+		}
+		err := s.transport.WritePacket(pkt)
+		if err != nil {
+			elog.Error(s.String(), " write ", s.transport.Name(), " end,status=", err)
+			failed = true
+			s.Close(true)
+		}
+	})
+	go queue.Run()
+
+	for pkt := range s.wch {
+
+		var wait time.Duration
+		ppkt := PolePacket(pkt)
+		if ppkt.Cmd() == CMD_S2C_IPDATA {
+			//traffic limit
+			var pass bool
+			wait, pass = s.checkStreamLimit(ppkt.Payload(), s.tcDownStream, s.downlimiter)
+			if !pass {
+				continue
+			}
+		}
+		if !queue.Push(pkt, wait) {
+			metricLimitDrops.Inc()
+		}
+	}
+
+	//wait delayed packets written,Shutdown relies on it to flush the session
+	queue.Close()
+	<-queue.Done()
+
+	elog.Info(s.String(), " exit write process")
+}
+
+func (s *Session) Send(pkt []byte) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return
+	}
+
+	select {
+	case s.wch <- pkt:
+	default:
+		elog.Error(s.String(), " wch is full")
+		metricQueueDrops.Inc()
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memTransport is an in-memory transport,packets written to in are read by session,
+// packets written by session go to out
+type memTransport struct {
+	in       chan []byte
+	out      chan []byte
+	writeErr error
+	done     chan struct{}
+	once     *sync.Once
+}
+
+func newMemTransport() *memTransport {
+	return &memTransport{in: make(chan []byte, 10), out: make(chan []byte, 10), done: make(chan struct{}), once: &sync.Once{}}
+}
+
+func (mt *memTransport) ReadPacket() ([]byte, error) {
+	select {
+	case pkt := <-mt.in:
+		return pkt, nil
+	case <-mt.done:
+		return nil, io.EOF
+	}
+}
+
+func (mt *memTransport) WritePacket(pkt []byte) error {
+	if mt.writeErr != nil {
+		return mt.writeErr
+	}
+	select {
+	case mt.out <- pkt:
+		return nil
+	case <-mt.done:
+		return io.ErrClosedPipe
+	}
+}
+
+func (mt *memTransport) Close() error {
+	mt.once.Do(func() { close(mt.done) })
+	return nil
+}
+
+func (mt *memTransport) LocalAddr() net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 443}
+}
+
+func (mt *memTransport) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP("127.0.0.2"), Port: 5000}
+}
+
+func (mt *memTransport) Name() string {
+	return "mem"
+}
+
+type recordHandler struct {
+	requests chan []byte
+	closed   chan Conn
+}
+
+func newRecordHandler() *recordHandler {
+	return &recordHandler{requests: make(chan []byte, 10), closed: make(chan Conn, 10)}
+}
+
+func (rh *recordHandler) OnRequest(pkt []byte, conn Conn) {
+	rh.requests <- pkt
+}
+
+func (rh *recordHandler) OnClosed(conn Conn, proactive bool) {
+	rh.closed <- conn
+}
+
+func newTestSession(rate uint64, burst uint64) (*Session, *memTransport, *recordHandler) {
+	mt := newMemTransport()
+	rh := newRecordHandler()
+	limiter := func() *RateLimiter { return NewRateLimiter(rate, burst, time.Second) }
+	return NewSession(mt, limiter(), limiter(), rh), mt, rh
+}
+
+func receive(t *testing.T, ch chan []byte) []byte {
+	select {
+	case pkt := <-ch:
+		return pkt
+	case <-time.After(time.Second * 2):
+		t.Fatal("no packet received")
+		return nil
+	}
+}
+
+func TestSessionReadWrite(t *testing.T) {
+
+	s, mt, rh := newTestSession(0, 0)
+	go s.Read()
+	go s.Write()
+	defer s.Close(false)
+
+	if s.String() != "127.0.0.2:5000->127.0.0.1:443" || s.Transport() != "mem" || s.RemoteAddr() != "127.0.0.2:5000" {
+		t.Fatalf("unexpected session %v,%v,%v", s.String(), s.Transport(), s.RemoteAddr())
+	}
+
+	up := newPolePacket(CMD_C2S_IPDATA, make([]byte, 100))
+	mt.in <- up
+	if pkt := receive(t, rh.requests); len(pkt) != len(up) {
+		t.Fatalf("unexpected request %v", pkt)
+	}
+
+	mt.in <- newPolePacket(CMD_HEART_BEAT, nil)
+	receive(t, rh.requests)
+
+	down := newPolePacket(CMD_S2C_IPDATA, make([]byte, 200))
+	s.Send(down)
+	if pkt := receive(t, mt.out); len(pkt) != len(down) {
+		t.Fatalf("unexpected packet %v", pkt)
+	}
+
+	if s.UpStreamBytes() != 100 || s.DownStreamBytes() != 200 {
+		t.Fatalf("unexpected traffic up:%v,down:%v", s.UpStreamBytes(), s.DownStreamBytes())
+	}
+}
+
+func TestSessionRateLimit(t *testing.T) {
+
+	s, mt, _ := newTestSession(1000, 100)
+	go s.Write()
+	defer s.Close(false)
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		s.Send(newPolePacket(CMD_S2C_IPDATA, make([]byte, 100)))
+	}
+	for i := 0; i < 3; i++ {
+		receive(t, mt.out)
+	}
+
+	//the first packet uses up the burst,the others wait for tokens
+	if time.Since(start) < time.Millisecond*150 {
+		t.Fatalf("packets aren't limited,took %v", time.Since(start))
+	}
+}
+
+func TestSessionRateLimitRead(t *testing.T) {
+
+	s, mt, rh := newTestSession(1000, 100)
+	go s.Read()
+	defer s.Close(false)
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		mt.in <- newPolePacket(CMD_C2S_IPDATA, append([]byte{byte(i)}, make([]byte, 99)...))
+	}
+
+	//packets over the rate are held by the delay queue,reading goes on
+	for len(mt.in) > 0 {
+		if time.Since(start) > time.Millisecond*200 {
+			t.Fatal("read is blocked by rate limit")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	for i := 0; i < 5; i++ {
+		pkt := receive(t, rh.requests)
+		if PolePacket(pkt).Payload()[0] != byte(i) {
+			t.Fatalf("packet %v out of order", i)
+		}
+	}
+	if time.Since(start) < time.Millisecond*350 {
+		t.Fatalf("packets aren't limited,took %v", time.Since(start))
+	}
+}
+
+func TestSessionClose(t *testing.T) {
+
+	s, mt, rh := newTestSession(0, 0)
+	go s.Read()
+	go s.Write()
+
+	//transport fails,handler is notified once
+	mt.Close()
+
+	select {
+	case conn := <-rh.closed:
+		if conn != s {
+			t.Fatal("unexpected closed conn")
+		}
+	case <-time.After(time.Second * 2):
+		t.Fatal("handler isn't notified")
+	}
+
+	if !s.IsClosed() {
+		t.Fatal("session should be closed")
+	}
+
+	//sending to a closed session is ignored
+	s.Send(newPolePacket(CMD_HEART_BEAT, nil))
+	s.Close(true)
+
+	select {
+	case <-rh.closed:
+		t.Fatal("handler is notified twice")
+	case <-time.After(time.Millisecond * 100):
+	}
+}
+
+func TestSessionWriteFail(t *testing.T) {
+
+	s, mt, rh := newTestSession(0, 0)
+	mt.writeErr = io.ErrClosedPipe
+	go s.Write()
+
+	s.Send(newPolePacket(CMD_HEART_BEAT, nil))
+
+	select {
+	case <-rh.closed:
+	case <-time.After(time.Second * 2):
+		t.Fatal("handler isn't notified")
+	}
+}
+
+func TestSessionShutdown(t *testing.T) {
+
+	s, mt, rh := newTestSession(0, 0)
+
+	for i := 0; i < 3; i++ {
+		s.Send(newPolePacket(CMD_HEART_BEAT, nil))
+	}
+	go s.Write()
+
+	err := s.Shutdown(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//queued packets are flushed before the transport is closed
+	if len(mt.out) != 3 {
+		t.Fatalf("expected 3 packets flushed,got %v", len(mt.out))
+	}
+
+	select {
+	case <-mt.done:
+	default:
+		t.Fatal("transport should be closed")
+	}
+
+	select {
+	case <-rh.closed:
+		t.Fatal("shutdown shouldn't notify handler")
+	default:
+	}
+}
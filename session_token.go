@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+const (
+	DEFAULT_SESSION_TOKEN_TTL = 86400
+	SESSION_TOKEN_KEY_SIZE    = 32
+)
+
+// SessionToken binds user,ip and device id of a session,and carries the policy user got at login
+type SessionToken struct {
+	User     string      `json:"user"`
+	IP       string      `json:"ip"`
+	DeviceId string      `json:"device_id"`
+	Expire   int64       `json:"expire"`
+	Policy   *UserPolicy `json:"policy,omitempty"`
+}
+
+// SessionTokenSigner sign and verify session tokens with hmac-sha256,
+// token is base64url(json) "." base64url(mac)
+type SessionTokenSigner struct {
+	key []byte
+	ttl time.Duration
+	now func() time.Time
+}
+
+// NewSessionTokenSigner create signer with key,a random key is used if key is empty,
+// then tokens are invalid after restart
+func NewSessionTokenSigner(key []byte, ttl time.Duration) (*SessionTokenSigner, error) {
+
+	if len(key) == 0 {
+		key = make([]byte, SESSION_TOKEN_KEY_SIZE)
+		_, err := rand.Read(key)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if ttl <= 0 {
+		ttl = time.Second * DEFAULT_SESSION_TOKEN_TTL
+	}
+
+	return &SessionTokenSigner{key: key, ttl: ttl, now: time.Now}, nil
+}
+
+func (sts *SessionTokenSigner) mac(data string) []byte {
+	h := hmac.New(sha256.New, sts.key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// Sign issue a token expiring after ttl
+func (sts *SessionTokenSigner) Sign(user string, ip string, deviceId string, policy *UserPolicy) (string, error) {
+
+	data, err := json.Marshal(&SessionToken{
+		User:     user,
+		IP:       ip,
+		DeviceId: deviceId,
+		Expire:   sts.now().Add(sts.ttl).Unix(),
+		Policy:   policy,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(sts.mac(payload)), nil
+}
+
+// Verify check signature and expiry of token
+func (sts *SessionTokenSigner) Verify(token string) (*SessionToken, error) {
+
+	payload, sig, found := strings.Cut(token, ".")
+	if !found {
+		return nil, errors.New("invalid session token")
+	}
+
+	mac, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(mac, sts.mac(payload)) {
+		return nil, errors.New("invalid session token signature")
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	st := &SessionToken{}
+	err = json.Unmarshal(data, st)
+	if err != nil {
+		return nil, err
+	}
+
+	if sts.now().Unix() >= st.Expire {
+		return nil, errors.New("session token expired")
+	}
+	return st, nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/polevpn/anyvalue"
+)
+
+func TestSessionTokenSigner(t *testing.T) {
+
+	signer, err := NewSessionTokenSigner([]byte("secret"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	policy := &UserPolicy{UpLimit: 100, Groups: []string{"dev"}}
+	token, err := signer.Sign("alice", "10.8.0.2", "device1", policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st, err := signer.Verify(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.User != "alice" || st.IP != "10.8.0.2" || st.DeviceId != "device1" || !reflect.DeepEqual(st.Policy, policy) {
+		t.Fatalf("unexpected token %+v", st)
+	}
+
+	other, _ := NewSessionTokenSigner([]byte("other"), time.Hour)
+	if _, err = other.Verify(token); err == nil {
+		t.Fatal("token signed by other key should be invalid")
+	}
+
+	if _, err = signer.Verify("x" + token); err == nil {
+		t.Fatal("tampered token should be invalid")
+	}
+
+	signer.now = func() time.Time { return time.Now().Add(time.Hour * 2) }
+	if _, err = signer.Verify(token); err == nil {
+		t.Fatal("expired token should be invalid")
+	}
+}
+
+type countLoginChecker struct {
+	staticLoginChecker
+	count int
+}
+
+func (lc *countLoginChecker) CheckLogin(user string, pwd string, remoteIp string, deviceType string, deviceId string) (*UserPolicy, error) {
+	lc.count++
+	return lc.staticLoginChecker.CheckLogin(user, pwd, remoteIp, deviceType, deviceId)
+}
+
+func TestCheckUserLoginWithSessionToken(t *testing.T) {
+
+	oldConfig := Config()
+	config, _ := anyvalue.NewFromJson([]byte(`{"session_token":{"required":true}}`))
+	SetConfig(config)
+	defer func() { SetConfig(oldConfig) }()
+
+	addresspool, err := NewAddressPool("10.8.0.0/24", map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	connmgr := NewConnMgr()
+	connmgr.SetAddressPool(addresspool)
+	requestHandler := NewRequestHandler()
+	requestHandler.SetConnMgr(connmgr)
+
+	signer, _ := NewSessionTokenSigner(nil, time.Hour)
+	loginchecker := &countLoginChecker{staticLoginChecker: staticLoginChecker{user: "alice", pwd: "123456"}}
+
+	hs := NewHttpServer(0, 0, requestHandler)
+	hs.SetLoginCheckHandler(loginchecker)
+	hs.SetSessionTokenSigner(signer)
+
+	token, _ := signer.Sign("alice", "10.8.0.5", "device1", &UserPolicy{DownLimit: 1000})
+
+	status, user, policy := hs.checkUserLogin(&LoginRequest{Token: token, IP: "10.8.0.5", RemoteIp: "1.1.1.1", DeviceType: "ios", DeviceId: "device1"})
+	if status != http.StatusOK || user != "alice" || policy.DownLimit != 1000 {
+		t.Fatalf("reconnect with token fail,status:%v,user:%v", status, user)
+	}
+	if loginchecker.count != 0 {
+		t.Fatal("reconnect with token shouldn't call login backend")
+	}
+
+	//token is bound to ip and device
+	status, _, _ = hs.checkUserLogin(&LoginRequest{Token: token, IP: "10.8.0.6", RemoteIp: "1.1.1.1", DeviceType: "ios", DeviceId: "device1"})
+	if status == http.StatusOK {
+		t.Fatal("token used for other ip should fail")
+	}
+	status, _, _ = hs.checkUserLogin(&LoginRequest{Token: token, IP: "10.8.0.5", RemoteIp: "1.1.1.1", DeviceType: "ios", DeviceId: "device2"})
+	if status == http.StatusOK {
+		t.Fatal("token used by other device should fail")
+	}
+
+	//claiming an ip needs token when it is required
+	status, _, _ = hs.checkUserLogin(&LoginRequest{User: "alice", Pwd: "123456", IP: "10.8.0.7", RemoteIp: "1.1.1.1", DeviceType: "ios", DeviceId: "device1"})
+	if status != http.StatusBadRequest {
+		t.Fatalf("reconnect without token should fail,status:%v", status)
+	}
+
+	//ip attached to other user can't be taken
+	connmgr.AttachUserToIP("bob", "10.8.0.8")
+	token, _ = signer.Sign("alice", "10.8.0.8", "device1", nil)
+	status, _, _ = hs.checkUserLogin(&LoginRequest{Token: token, IP: "10.8.0.8", RemoteIp: "1.1.1.1", DeviceType: "ios", DeviceId: "device1"})
+	if status != http.StatusBadRequest {
+		t.Fatalf("take ip of other user should fail,status:%v", status)
+	}
+
+	//new connection still uses password
+	status, user, _ = hs.checkUserLogin(&LoginRequest{User: "alice", Pwd: "123456", RemoteIp: "1.1.1.1", DeviceType: "ios", DeviceId: "device1"})
+	if status != http.StatusOK || user != "alice" || loginchecker.count != 1 {
+		t.Fatalf("login with password fail,status:%v", status)
+	}
+}
+
+func TestCheckUserLoginReclaimIP(t *testing.T) {
+
+	oldConfig := Config()
+	SetConfig(anyvalue.New())
+	defer func() { SetConfig(oldConfig) }()
+
+	addresspool, _ := NewAddressPool("10.8.0.0/24", map[string]string{"carol": "10.8.0.9"})
+	connmgr := NewConnMgr()
+	connmgr.SetAddressPool(addresspool)
+	requestHandler := NewRequestHandler()
+	requestHandler.SetConnMgr(connmgr)
+
+	hs := NewHttpServer(0, 0, requestHandler)
+	hs.SetLoginCheckHandler(&staticLoginChecker{user: "alice", pwd: "123456"})
+
+	login := func(ip string) int {
+		status, _, _ := hs.checkUserLogin(&LoginRequest{User: "alice", Pwd: "123456", IP: ip, RemoteIp: "1.1.1.1", DeviceType: "ios", DeviceId: "device1"})
+		return status
+	}
+
+	//without token a free address or one of other users can't be picked
+	if status := login("10.8.0.5"); status != http.StatusBadRequest {
+		t.Fatalf("claim free ip should fail,status:%v", status)
+	}
+	connmgr.AttachUserToIP("bob", "10.8.0.6")
+	if status := login("10.8.0.6"); status != http.StatusBadRequest {
+		t.Fatalf("claim ip of other user should fail,status:%v", status)
+	}
+	if status := login("10.8.0.9"); status != http.StatusBadRequest {
+		t.Fatalf("claim ip bound to other user should fail,status:%v", status)
+	}
+
+	//the address held before is reclaimed
+	connmgr.AttachUserToIP("alice", "10.8.0.7")
+	if status := login("10.8.0.7"); status != http.StatusOK {
+		t.Fatalf("reclaim ip fail,status:%v", status)
+	}
+}
+
+func TestNewLoginRequestToken(t *testing.T) {
+
+	hs, _, _, _ := newTestHttpServer(t)
+
+	r := httptest.NewRequest("GET", "/ws?token=qtoken&otp=111111&ip=10.8.0.5", nil)
+	req, hasCredential := hs.newLoginRequest(r)
+	if hasCredential || req.Token != "" || req.OTP != "" {
+		t.Fatalf("token and otp in query string should be ignored,%+v", req)
+	}
+
+	r.Header.Set(SESSION_TOKEN_HEADER, "htoken")
+	r.Header.Set(OTP_HEADER, "222222")
+	req, hasCredential = hs.newLoginRequest(r)
+	if !hasCredential || req.Token != "htoken" || req.OTP != "222222" || req.IP != "10.8.0.5" {
+		t.Fatalf("token and otp should come from header,%+v", req)
+	}
+
+	//legacy clients put them in query string
+	Config().Set("endpoint.allow_query_auth", true)
+	req, _ = hs.newLoginRequest(httptest.NewRequest("GET", "/ws?token=qtoken&otp=111111", nil))
+	if req.Token != "qtoken" || req.OTP != "111111" {
+		t.Fatalf("token and otp should come from query string,%+v", req)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net"
+)
+
+// TLSConn carry length prefixed pole packets on a tls connection
+type TLSConn struct {
+	conn net.Conn
+}
+
+func NewTLSConn(conn net.Conn) *TLSConn {
+	return &TLSConn{conn: conn}
+}
+
+func (tlsc *TLSConn) ReadPacket() ([]byte, error) {
+	return ReadPacket(tlsc.conn)
+}
+
+func (tlsc *TLSConn) WritePacket(pkt []byte) error {
+	_, err := tlsc.conn.Write(pkt)
+	return err
+}
+
+func (tlsc *TLSConn) Close() error {
+	return tlsc.conn.Close()
+}
+
+func (tlsc *TLSConn) LocalAddr() net.Addr {
+	return tlsc.conn.LocalAddr()
+}
+
+func (tlsc *TLSConn) RemoteAddr() net.Addr {
+	return tlsc.conn.RemoteAddr()
+}
+
+func (tlsc *TLSConn) Name() string {
+	return "tls"
+}
@@ -1,4 +1,6 @@
 echo 1 > /proc/sys/net/ipv4/ip_forward
+echo 1 > /proc/sys/net/ipv6/conf/all/forwarding
 sudo sysctl -w net.core.rmem_max=6500000
 iptables -t nat -A POSTROUTING -s 10.8.0.0/16 -j MASQUERADE
+ip6tables -t nat -A POSTROUTING -s fd00:10:8::/64 -j MASQUERADE
 ufw disable
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	TOTP_PERIOD         = 30
+	TOTP_DIGITS         = 6
+	TOTP_SECRET_SIZE    = 20
+	DEFAULT_TOTP_SKEW   = 1
+	DEFAULT_TOTP_ISSUER = "PoleVPN"
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateTOTPSecret return a random base32 secret
+func GenerateTOTPSecret() (string, error) {
+	key := make([]byte, TOTP_SECRET_SIZE)
+	_, err := rand.Read(key)
+	if err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(key), nil
+}
+
+// TOTPURI build the otpauth uri authenticator apps scan
+func TOTPURI(issuer string, user string, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", issuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(TOTP_DIGITS))
+	v.Set("period", fmt.Sprint(TOTP_PERIOD))
+	return "otpauth://totp/" + url.PathEscape(issuer+":"+user) + "?" + v.Encode()
+}
+
+func decodeTOTPSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(secret), " ", ""))
+	return totpEncoding.DecodeString(strings.TrimRight(secret, "="))
+}
+
+// hotp compute the code of counter by rfc 4226
+func hotp(key []byte, counter uint64) string {
+
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, counter)
+
+	h := hmac.New(sha1.New, key)
+	h.Write(msg)
+	sum := h.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0xf
+	code := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", TOTP_DIGITS, code%1000000)
+}
+
+// TOTPVerifier verify rfc 6238 codes,secrets come from the user policy the auth backend returned,
+// or the secret file of auth.totp.file,a code can't be used twice
+type TOTPVerifier struct {
+	secrets *CredentialFile
+	used    map[string]uint64
+	now     func() time.Time
+	mutex   *sync.Mutex
+}
+
+func NewTOTPVerifier() *TOTPVerifier {
+	return &TOTPVerifier{used: make(map[string]uint64), now: time.Now, mutex: &sync.Mutex{}}
+}
+
+func (tv *TOTPVerifier) getSecretFile(filePath string) (*CredentialFile, error) {
+
+	tv.mutex.Lock()
+	defer tv.mutex.Unlock()
+
+	if tv.secrets != nil && tv.secrets.Path() == filePath {
+		return tv.secrets, nil
+	}
+
+	secrets, err := NewSecretFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	if tv.secrets != nil {
+		tv.secrets.Close()
+	}
+	tv.secrets = secrets
+	return secrets, nil
+}
+
+// GetSecret return the secret of user,empty means user hasn't enrolled
+func (tv *TOTPVerifier) GetSecret(user string, policy *UserPolicy) (string, error) {
+
+	if policy != nil && policy.TOTPSecret != "" {
+		return policy.TOTPSecret, nil
+	}
+
+	filePath := Config().Get("auth.totp.file").AsStr()
+	if filePath == "" {
+		return "", nil
+	}
+
+	secrets, err := tv.getSecretFile(filePath)
+	if err != nil {
+		return "", err
+	}
+	return secrets.Lookup(user), nil
+}
+
+// Verify check code of user in the time window of skew periods,the code and earlier ones are invalid afterwards
+func (tv *TOTPVerifier) Verify(user string, secret string, code string) error {
+
+	key, err := decodeTOTPSecret(secret)
+	if err != nil {
+		return errors.New("invalid totp secret")
+	}
+
+	skew := int64(Config().Get("auth.totp.skew").AsInt(DEFAULT_TOTP_SKEW))
+	counter := tv.now().Unix() / TOTP_PERIOD
+
+	tv.mutex.Lock()
+	defer tv.mutex.Unlock()
+
+	for i := -skew; i <= skew; i++ {
+		c := uint64(counter + i)
+		if subtle.ConstantTimeCompare([]byte(hotp(key, c)), []byte(code)) != 1 {
+			continue
+		}
+		if last, ok := tv.used[user]; ok && c <= last {
+			return errors.New("totp code has been used")
+		}
+		tv.used[user] = c
+		return nil
+	}
+	return errors.New("totp code incorrect")
+}
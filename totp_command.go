@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// TOTPCommand implement "polevpn_server totp [-file path] [-issuer name] user",
+// it writes a new totp secret of user to the secret file and prints the otpauth uri to enroll
+func TOTPCommand(args []string) error {
+
+	fs := flag.NewFlagSet("totp", flag.ContinueOnError)
+	filePath := fs.String("file", "./users.totp", "totp secret file path")
+	issuer := fs.String("issuer", DEFAULT_TOTP_ISSUER, "issuer shown in authenticator apps")
+
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		return errors.New("usage: polevpn_server totp [-file path] [-issuer name] user")
+	}
+
+	user := fs.Arg(0)
+	if user == "" || strings.ContainsAny(user, ",\r\n") {
+		return errors.New("invalid user name")
+	}
+
+	secret, err := GenerateTOTPSecret()
+	if err != nil {
+		return err
+	}
+
+	err = updateCredentialFile(*filePath, user, func(fields []string) []string {
+		if fields == nil {
+			return []string{user, secret}
+		}
+		fields[1] = secret
+		return fields
+	})
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("totp secret of %v updated in %v\n", user, *filePath)
+	fmt.Println(TOTPURI(*issuer, user, secret))
+	return nil
+}
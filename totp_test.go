@@ -0,0 +1,190 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/polevpn/anyvalue"
+)
+
+func TestTOTPVerifier(t *testing.T) {
+
+	oldConfig := Config()
+	config, _ := anyvalue.NewFromJson([]byte(`{"auth":{"totp":{"skew":1}}}`))
+	SetConfig(config)
+	defer func() { SetConfig(oldConfig) }()
+
+	//rfc 6238 test secret,code of T=59 is 94287082 in 8 digits
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	if code := hotp([]byte("12345678901234567890"), 1); code != "287082" {
+		t.Fatalf("unexpected hotp %v", code)
+	}
+
+	tv := NewTOTPVerifier()
+	tv.now = func() time.Time { return time.Unix(59, 0) }
+
+	if err := tv.Verify("alice", secret, "000000"); err == nil {
+		t.Fatal("wrong code should fail")
+	}
+
+	err := tv.Verify("alice", secret, "287082")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = tv.Verify("alice", secret, "287082"); err == nil {
+		t.Fatal("used code should fail")
+	}
+
+	//code of previous period is accepted in skew
+	tv.now = func() time.Time { return time.Unix(89, 0) }
+	if err = tv.Verify("bob", secret, "287082"); err != nil {
+		t.Fatal(err)
+	}
+	tv.now = func() time.Time { return time.Unix(119, 0) }
+	if err = tv.Verify("carol", secret, "287082"); err == nil {
+		t.Fatal("code out of skew should fail")
+	}
+}
+
+func TestTOTPCommand(t *testing.T) {
+
+	dir := t.TempDir()
+	filePath := filepath.Join(dir, "users.totp")
+
+	err := TOTPCommand([]string{"-file", filePath, "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secrets, err := NewSecretFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer secrets.Close()
+
+	secret := secrets.Lookup("alice")
+	if _, err = decodeTOTPSecret(secret); err != nil || secret == "" {
+		t.Fatalf("invalid secret %v", secret)
+	}
+
+	if _, err = os.Stat(filePath); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInBandTOTPChallenge(t *testing.T) {
+
+	secret, _ := GenerateTOTPSecret()
+	key, _ := decodeTOTPSecret(secret)
+
+	filePath := filepath.Join(t.TempDir(), "users.totp")
+	err := os.WriteFile(filePath, []byte("alice,"+secret+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldConfig := Config()
+	SetConfig(anyvalue.New())
+	Config().Set("auth.totp.enable", true)
+	Config().Set("auth.totp.file", filePath)
+	defer func() { SetConfig(oldConfig) }()
+
+	addresspool, _ := NewAddressPool("10.8.0.0/24", map[string]string{})
+	connmgr := NewConnMgr()
+	connmgr.SetAddressPool(addresspool)
+	requestHandler := NewRequestHandler()
+	requestHandler.SetConnMgr(connmgr)
+
+	hs := NewHttpServer(0, 0, requestHandler)
+	hs.SetLoginCheckHandler(&staticLoginChecker{user: "alice", pwd: "123456"})
+	hs.SetTOTPVerifier(NewTOTPVerifier())
+
+	//enrolled user is challenged for the code
+	status, _, _ := hs.checkUserLogin(&LoginRequest{User: "alice", Pwd: "123456", RemoteIp: "1.1.1.1", DeviceType: "ios", DeviceId: "device1"})
+	if status != http.StatusUnauthorized {
+		t.Fatalf("login without code should be challenged,status:%v", status)
+	}
+
+	mt := newMemTransport()
+	auth, _ := anyvalue.NewFromJson([]byte(`{"user":"alice","pwd":"123456"}`))
+	req := &LoginRequest{RemoteIp: "1.1.1.1", DeviceType: "ios", DeviceId: "device1"}
+	req.setCredential(auth)
+
+	type result struct {
+		user string
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		user, _, err := hs.checkInBandLogin(mt, req)
+		done <- result{user, err}
+	}()
+
+	pkt := receive(t, mt.out)
+	if PolePacket(pkt).Cmd() != CMD_USER_OTP {
+		t.Fatalf("expect otp challenge,got cmd %v", PolePacket(pkt).Cmd())
+	}
+
+	code := hotp(key, uint64(time.Now().Unix()/TOTP_PERIOD))
+	mt.in <- newPolePacket(CMD_USER_OTP, []byte(`{"otp":"`+code+`"}`))
+
+	checkAuthResp(t, receive(t, mt.out), http.StatusOK)
+	if r := <-done; r.err != nil || r.user != "alice" {
+		t.Fatalf("in band login fail,%v", r.err)
+	}
+}
+
+func TestClientCertLoginTOTP(t *testing.T) {
+
+	secret, _ := GenerateTOTPSecret()
+	key, _ := decodeTOTPSecret(secret)
+	filePath := filepath.Join(t.TempDir(), "users.totp")
+	os.WriteFile(filePath, []byte("alice,"+secret+"\n"), 0600)
+
+	hs, _, _, _ := newTestHttpServer(t)
+	Config().Set("auth.totp.enable", true)
+	Config().Set("auth.totp.file", filePath)
+	hs.SetTOTPVerifier(NewTOTPVerifier())
+
+	//certificate alone doesn't skip the second factor
+	status, _, _ := hs.checkUserLogin(&LoginRequest{CertUser: "alice", CertPolicy: &UserPolicy{}, DeviceId: "device1"})
+	if status != http.StatusUnauthorized {
+		t.Fatalf("certificate login without code should be challenged,status:%v", status)
+	}
+
+	code := hotp(key, uint64(time.Now().Unix()/TOTP_PERIOD))
+	status, user, _ := hs.checkUserLogin(&LoginRequest{CertUser: "alice", CertPolicy: &UserPolicy{}, OTP: code, DeviceId: "device1"})
+	if status != http.StatusOK || user != "alice" {
+		t.Fatalf("certificate login with code fail,status:%v", status)
+	}
+
+	Config().Set("auth.totp.required", true)
+	status, _, _ = hs.checkUserLogin(&LoginRequest{CertUser: "bob", CertPolicy: &UserPolicy{}, DeviceId: "device1"})
+	if status != http.StatusForbidden {
+		t.Fatalf("certificate user not enrolled should be rejected,status:%v", status)
+	}
+
+	//tunnel transports challenge in band,a new verifier forgets the code used above
+	hs.SetTOTPVerifier(NewTOTPVerifier())
+	mt := newMemTransport()
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := hs.checkInBandLogin(mt, &LoginRequest{CertUser: "alice", CertPolicy: &UserPolicy{}, DeviceId: "device1"})
+		done <- err
+	}()
+
+	pkt := receive(t, mt.out)
+	if PolePacket(pkt).Cmd() != CMD_USER_OTP {
+		t.Fatalf("expect otp challenge,got cmd %v", PolePacket(pkt).Cmd())
+	}
+	mt.in <- newPolePacket(CMD_USER_OTP, []byte(`{"otp":"`+code+`"}`))
+
+	checkAuthResp(t, receive(t, mt.out), http.StatusOK)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/polevpn/elog"
+)
+
+const (
+	ACCOUNTING_CHECK_INTERVAL        = 5
+	DEFAULT_ACCOUNTING_SAVE_INTERVAL = 60
+	ACCOUNTING_PERIOD_DAILY          = "daily"
+	ACCOUNTING_PERIOD_MONTHLY        = "monthly"
+)
+
+// UserTraffic is the traffic of a user,UpBytes and DownBytes are reset when a new period begins
+type UserTraffic struct {
+	Period         string `json:"period"`
+	UpBytes        uint64 `json:"up_bytes"`
+	DownBytes      uint64 `json:"down_bytes"`
+	TotalUpBytes   uint64 `json:"total_up_bytes"`
+	TotalDownBytes uint64 `json:"total_down_bytes"`
+}
+
+type connTraffic struct {
+	user      string
+	upBytes   uint64
+	downBytes uint64
+}
+
+// TrafficAccounting sum up traffic of users across sessions and reconnects,persist it to a json file,
+// and kick out users whose traffic of current period reach their quota
+type TrafficAccounting struct {
+	path   string
+	period string
+	quota  uint64
+	users  map[string]*UserTraffic
+	conns  map[string]*connTraffic
+	dirty  bool
+	now    func() time.Time
+	done   chan struct{}
+	mutex  *sync.Mutex
+}
+
+// NewTrafficAccounting load traffic from path if it exists,period is daily or monthly,
+// quota is used for users whose policy has no quota,0 means unlimited
+func NewTrafficAccounting(path string, period string, quota uint64) (*TrafficAccounting, error) {
+
+	if period == "" {
+		period = ACCOUNTING_PERIOD_MONTHLY
+	}
+
+	if period != ACCOUNTING_PERIOD_DAILY && period != ACCOUNTING_PERIOD_MONTHLY {
+		return nil, errors.New("accounting period should be daily or monthly")
+	}
+
+	ta := &TrafficAccounting{
+		path:   path,
+		period: period,
+		quota:  quota,
+		users:  make(map[string]*UserTraffic),
+		conns:  make(map[string]*connTraffic),
+		now:    time.Now,
+		done:   make(chan struct{}),
+		mutex:  &sync.Mutex{},
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if len(data) > 0 {
+		err = json.Unmarshal(data, &ta.users)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return ta, nil
+}
+
+func (ta *TrafficAccounting) periodOf(t time.Time) string {
+	if ta.period == ACCOUNTING_PERIOD_DAILY {
+		return t.Format("2006-01-02")
+	}
+	return t.Format("2006-01")
+}
+
+// getUser return traffic of user,and reset it if a new period begins,caller must hold the mutex
+func (ta *TrafficAccounting) getUser(user string) *UserTraffic {
+
+	period := ta.periodOf(ta.now())
+
+	ut, ok := ta.users[user]
+	if !ok {
+		ut = &UserTraffic{Period: period}
+		ta.users[user] = ut
+	}
+
+	if ut.Period != period {
+		ut.Period = period
+		ut.UpBytes = 0
+		ut.DownBytes = 0
+		ta.dirty = true
+	}
+	return ut
+}
+
+// Account add the traffic conn made since last time to user,user may be empty if conn has been accounted before
+func (ta *TrafficAccounting) Account(user string, conn Conn) {
+
+	ta.mutex.Lock()
+	defer ta.mutex.Unlock()
+
+	ct, ok := ta.conns[conn.String()]
+	if !ok {
+		if user == "" {
+			return
+		}
+		ct = &connTraffic{user: user}
+		ta.conns[conn.String()] = ct
+	}
+
+	up := conn.UpStreamBytes()
+	down := conn.DownStreamBytes()
+
+	if up == ct.upBytes && down == ct.downBytes {
+		return
+	}
+
+	ut := ta.getUser(ct.user)
+	ut.UpBytes += up - ct.upBytes
+	ut.DownBytes += down - ct.downBytes
+	ut.TotalUpBytes += up - ct.upBytes
+	ut.TotalDownBytes += down - ct.downBytes
+
+	ct.upBytes = up
+	ct.downBytes = down
+	ta.dirty = true
+}
+
+// OnClosed account the last traffic of conn and forget it
+func (ta *TrafficAccounting) OnClosed(user string, conn Conn) {
+
+	ta.Account(user, conn)
+
+	ta.mutex.Lock()
+	defer ta.mutex.Unlock()
+	delete(ta.conns, conn.String())
+}
+
+// Quota return quota of the policy,or the default quota if policy has none
+func (ta *TrafficAccounting) Quota(policy *UserPolicy) uint64 {
+	if policy != nil && policy.Quota > 0 {
+		return policy.Quota
+	}
+	return ta.quota
+}
+
+// Exceeded check whether traffic of user in current period reach quota
+func (ta *TrafficAccounting) Exceeded(user string, quota uint64) bool {
+
+	if quota == 0 {
+		return false
+	}
+
+	ta.mutex.Lock()
+	defer ta.mutex.Unlock()
+
+	ut := ta.getUser(user)
+	return ut.UpBytes+ut.DownBytes >= quota
+}
+
+// GetUserTraffic return a copy of traffic of user
+func (ta *TrafficAccounting) GetUserTraffic(user string) UserTraffic {
+	ta.mutex.Lock()
+	defer ta.mutex.Unlock()
+	return *ta.getUser(user)
+}
+
+// Save write traffic to file if it changed,the file is replaced atomically
+func (ta *TrafficAccounting) Save() error {
+
+	ta.mutex.Lock()
+	if !ta.dirty {
+		ta.mutex.Unlock()
+		return nil
+	}
+	data, err := json.MarshalIndent(ta.users, "", "  ")
+	ta.dirty = false
+	ta.mutex.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	err = ta.writeFile(data)
+	if err != nil {
+		ta.mutex.Lock()
+		ta.dirty = true
+		ta.mutex.Unlock()
+	}
+	return err
+}
+
+func (ta *TrafficAccounting) writeFile(data []byte) error {
+
+	tmp, err := os.CreateTemp(filepath.Dir(ta.path), filepath.Base(ta.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), ta.path)
+}
+
+func (ta *TrafficAccounting) check(connmgr *ConnMgr) {
+
+	for _, conn := range connmgr.GetConns() {
+		user := connmgr.GetConnAttachUser(conn)
+		if user == "" {
+			continue
+		}
+
+		ta.Account(user, conn)
+
+		quota := ta.Quota(connmgr.GetConnPolicy(conn))
+		if ta.Exceeded(user, quota) {
+			elog.Infof("user:%v reach traffic quota %v,kick out %v", user, quota, conn.String())
+			connmgr.KickOut(conn)
+		}
+	}
+}
+
+// Start account traffic of connections in connmgr periodically,and save it every saveInterval
+func (ta *TrafficAccounting) Start(connmgr *ConnMgr, saveInterval time.Duration) {
+
+	if saveInterval <= 0 {
+		saveInterval = time.Second * DEFAULT_ACCOUNTING_SAVE_INTERVAL
+	}
+
+	go func() {
+		checkTicker := time.NewTicker(time.Second * ACCOUNTING_CHECK_INTERVAL)
+		defer checkTicker.Stop()
+		saveTicker := time.NewTicker(saveInterval)
+		defer saveTicker.Stop()
+
+		for {
+			select {
+			case <-ta.done:
+				return
+			case <-checkTicker.C:
+				ta.check(connmgr)
+			case <-saveTicker.C:
+				err := ta.Save()
+				if err != nil {
+					elog.Error("save traffic accounting fail,", err)
+				}
+			}
+		}
+	}()
+}
+
+// Close stop the accounting process and save traffic
+func (ta *TrafficAccounting) Close() error {
+	close(ta.done)
+	return ta.Save()
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testConn struct {
+	id   string
+	up   uint64
+	down uint64
+}
+
+func (tc *testConn) Read()                                {}
+func (tc *testConn) Write()                               {}
+func (tc *testConn) Send(pkt []byte)                      {}
+func (tc *testConn) Close(flag bool) error                { return nil }
+func (tc *testConn) Shutdown(timeout time.Duration) error { return nil }
+func (tc *testConn) IsClosed() bool                       { return false }
+func (tc *testConn) String() string                       { return tc.id }
+func (tc *testConn) Transport() string                    { return "test" }
+func (tc *testConn) RemoteAddr() string                   { return tc.id }
+func (tc *testConn) ConnectTime() time.Time               { return time.Time{} }
+func (tc *testConn) UpStreamBytes() uint64                { return tc.up }
+func (tc *testConn) DownStreamBytes() uint64              { return tc.down }
+
+func TestTrafficAccounting(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "traffic.json")
+
+	ta, err := NewTrafficAccounting(path, ACCOUNTING_PERIOD_DAILY, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	ta.now = func() time.Time { return now }
+
+	conn1 := &testConn{id: "conn1"}
+	conn2 := &testConn{id: "conn2"}
+
+	conn1.up, conn1.down = 100, 200
+	ta.Account("alice", conn1)
+	conn1.up, conn1.down = 150, 300
+	ta.Account("alice", conn1)
+
+	//reconnect,the closed conn is accounted without user
+	ta.OnClosed("", conn1)
+	conn2.up, conn2.down = 50, 100
+	ta.Account("alice", conn2)
+
+	ut := ta.GetUserTraffic("alice")
+	if ut.UpBytes != 200 || ut.DownBytes != 400 {
+		t.Fatalf("expect up 200 down 400,got up %v down %v", ut.UpBytes, ut.DownBytes)
+	}
+
+	if ta.Exceeded("alice", ta.Quota(nil)) {
+		t.Fatal("600 bytes shouldn't exceed default quota 1000")
+	}
+	if !ta.Exceeded("alice", ta.Quota(&UserPolicy{Quota: 500})) {
+		t.Fatal("600 bytes should exceed user quota 500")
+	}
+
+	err = ta.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := NewTrafficAccounting(path, ACCOUNTING_PERIOD_DAILY, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded.now = func() time.Time { return now }
+
+	ut = loaded.GetUserTraffic("alice")
+	if ut.UpBytes != 200 || ut.DownBytes != 400 || ut.TotalUpBytes != 200 {
+		t.Fatal("unexpected loaded traffic", ut)
+	}
+
+	now = now.Add(24 * time.Hour)
+	ut = loaded.GetUserTraffic("alice")
+	if ut.UpBytes != 0 || ut.DownBytes != 0 || ut.TotalUpBytes != 200 || ut.TotalDownBytes != 400 {
+		t.Fatal("period traffic should be reset on a new day", ut)
+	}
+}
+
+func TestTrafficAccountingOnKickOut(t *testing.T) {
+
+	ta, err := NewTrafficAccounting(filepath.Join(t.TempDir(), "traffic.json"), ACCOUNTING_PERIOD_DAILY, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	connmgr := NewConnMgr()
+	handler := NewRequestHandler()
+	handler.SetConnMgr(connmgr)
+	handler.SetTrafficAccounting(ta)
+
+	s := NewSession(newMemTransport(), NewRateLimiter(0, 0, time.Second), NewRateLimiter(0, 0, time.Second), handler)
+	connmgr.AttachUserToConn("alice", s)
+	handler.mutex.Lock()
+	handler.spoofs[s.String()] = 1
+	handler.mutex.Unlock()
+
+	s.tcUpStream.StreamCount(200)
+	ta.check(connmgr)
+
+	//traffic made before the kicked conn is closed still counts
+	s.tcUpStream.StreamCount(50)
+
+	accounted := func() bool {
+		ta.mutex.Lock()
+		defer ta.mutex.Unlock()
+		_, ok := ta.conns[s.String()]
+		return ok
+	}
+	for i := 0; accounted() || connmgr.GetConnAttachUser(s) != ""; i++ {
+		if i == 150 {
+			t.Fatal("kicked conn should be flushed and forgotten")
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+
+	if ut := ta.GetUserTraffic("alice"); ut.UpBytes != 250 {
+		t.Fatalf("expect up 250,got %v", ut.UpBytes)
+	}
+
+	handler.mutex.Lock()
+	defer handler.mutex.Unlock()
+	if _, ok := handler.spoofs[s.String()]; ok {
+		t.Fatal("spoof count of kicked conn should be removed")
+	}
+}
+
+func TestTrafficAccountingStartInvalidInterval(t *testing.T) {
+
+	ta, err := NewTrafficAccounting(filepath.Join(t.TempDir(), "traffic.json"), ACCOUNTING_PERIOD_DAILY, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//non positive save interval falls back to default instead of panic in ticker
+	ta.Start(NewConnMgr(), 0)
+	ta.Start(NewConnMgr(), -time.Second)
+	time.Sleep(time.Millisecond * 50)
+
+	err = ta.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
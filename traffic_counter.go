@@ -1,45 +1,45 @@
 package main
 
 import (
-	"time"
+	"sync/atomic"
 )
 
 type TrafficCounter struct {
-	IPbytes         uint64
-	IPbytesTotal    uint64
-	IPLastTime      time.Time
-	IPCountInterval time.Duration
+	IPbytesTotal   uint64
+	IPpacketsTotal uint64
+	bytesMetric    *MetricCounter
+	packetsMetric  *MetricCounter
 }
 
-func NewTrafficCounter(interval time.Duration) *TrafficCounter {
-	return &TrafficCounter{
-		IPbytes:         0,
-		IPLastTime:      time.Now(),
-		IPbytesTotal:    0,
-		IPCountInterval: interval,
-	}
+func NewTrafficCounter() *TrafficCounter {
+	return &TrafficCounter{}
 }
 
-func (tl *TrafficCounter) StreamCount(bytes uint64) (uint64, time.Time) {
+// WithMetric make the counter also count into the global bytes and packets metrics
+func (tl *TrafficCounter) WithMetric(bytesMetric *MetricCounter, packetsMetric *MetricCounter) *TrafficCounter {
+	tl.bytesMetric = bytesMetric
+	tl.packetsMetric = packetsMetric
+	return tl
+}
 
-	now := time.Now()
+func (tl *TrafficCounter) StreamCount(bytes uint64) {
 
-	if now.Sub(tl.IPLastTime) > tl.IPCountInterval {
-		tl.IPbytes = 0
-		tl.IPLastTime = time.Now()
+	atomic.AddUint64(&tl.IPbytesTotal, bytes)
+	atomic.AddUint64(&tl.IPpacketsTotal, 1)
+	if tl.bytesMetric != nil {
+		tl.bytesMetric.Add(bytes)
+	}
+	if tl.packetsMetric != nil {
+		tl.packetsMetric.Inc()
 	}
-
-	tl.IPbytes += bytes
-	tl.IPbytesTotal += bytes
-	return tl.IPbytes, tl.IPLastTime
 }
 
 func (tl *TrafficCounter) StreamTotalBytes() uint64 {
 
-	return tl.IPbytesTotal
+	return atomic.LoadUint64(&tl.IPbytesTotal)
 }
 
-func (tl *TrafficCounter) StreamCountInterval() time.Duration {
+func (tl *TrafficCounter) StreamTotalPackets() uint64 {
 
-	return tl.IPCountInterval
+	return atomic.LoadUint64(&tl.IPpacketsTotal)
 }
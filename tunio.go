@@ -2,86 +2,270 @@ package main
 
 import (
 	"errors"
+	"hash/fnv"
 	"io"
-	"os/exec"
+	"net"
+	"strconv"
+	"sync"
 
 	"github.com/polevpn/elog"
+	"github.com/polevpn/netstack/tcpip/header"
 	"github.com/polevpn/water"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
 )
 
+const (
+	TUN_MTU = 1500
+)
+
+// TunIO read and write the tun device,every queue of a multi queue device has its own reader and writer
 type TunIO struct {
-	ifce    *water.Interface
-	wch     chan []byte
+	ifces   []*water.Interface
+	wchs    []chan []byte
+	name    string
 	mtu     int
 	handler *PacketDispatcher
 	closed  bool
+	done    chan struct{}
+	routes  []*netlink.Route
+	mutex   *sync.Mutex
 }
 
-func NewTunIO(size int, handler *PacketDispatcher) (*TunIO, error) {
+// NewTunIO create tun device name with queues queues,the name is chosen by kernel if it is empty
+func NewTunIO(size int, name string, queues int, handler *PacketDispatcher) (*TunIO, error) {
 
-	config := water.Config{
-		DeviceType: water.TUN,
+	if queues < 1 {
+		queues = 1
 	}
-	ifce, err := water.New(config)
-	if err != nil {
-		return nil, err
+
+	ifces := make([]*water.Interface, 0, queues)
+	wchs := make([]chan []byte, 0, queues)
+
+	for i := 0; i < queues; i++ {
+		config := water.Config{
+			DeviceType: water.TUN,
+		}
+		config.Name = name
+		config.MultiQueue = queues > 1
+
+		ifce, err := water.New(config)
+		if err != nil {
+			for _, ifce := range ifces {
+				ifce.Close()
+			}
+			return nil, err
+		}
+		name = ifce.Name()
+		ifces = append(ifces, ifce)
+		wchs = append(wchs, make(chan []byte, size))
 	}
+
 	return &TunIO{
-		ifce:    ifce,
-		wch:     make(chan []byte, size),
-		mtu:     1500,
+		ifces:   ifces,
+		wchs:    wchs,
+		name:    name,
+		mtu:     TUN_MTU,
 		handler: handler,
 		closed:  false,
+		done:    make(chan struct{}),
+		mutex:   &sync.Mutex{},
 	}, nil
 }
 
-// ip addr add dev tun0 local 10.8.0.1 peer 10.8.0.1
-// ip route add 10.8.0.0/24 via 10.8.0.1
+func (t *TunIO) Name() string {
+	return t.name
+}
+
+func (t *TunIO) link() (netlink.Link, error) {
+	link, err := netlink.LinkByName(t.name)
+	if err != nil {
+		return nil, errors.New("find link " + t.name + " fail," + err.Error())
+	}
+	return link, nil
+}
+
+// same as ip addr add dev tun0 local 10.8.0.1 peer 10.8.0.1
 func (t *TunIO) SetIPAddress(ip1 string) error {
 
-	out, err := exec.Command("bash", "-c", "ip addr add dev "+t.ifce.Name()+" local "+ip1+" peer "+ip1).CombinedOutput()
+	ip := net.ParseIP(ip1).To4()
+	if ip == nil {
+		return errors.New("invalid ipv4 address " + ip1)
+	}
+
+	link, err := t.link()
+	if err != nil {
+		return err
+	}
+
+	addr := &netlink.Addr{
+		IPNet: &net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)},
+		Peer:  &net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)},
+	}
+
+	err = netlink.AddrReplace(link, addr)
+	if err != nil {
+		return errors.New("set address " + ip1 + " fail," + err.Error())
+	}
+	return nil
+}
+
+// same as ip -6 addr add dev tun0 fd00:10:8::1/64 nodad
+func (t *TunIO) SetIPv6Address(ip6 string, network string) error {
 
+	_, ipnet, err := net.ParseCIDR(network)
 	if err != nil {
-		return errors.New(err.Error() + "," + string(out))
+		return err
 	}
+
+	ip := net.ParseIP(ip6)
+	if ip == nil || ip.To4() != nil {
+		return errors.New("invalid ipv6 address " + ip6)
+	}
+
+	link, err := t.link()
+	if err != nil {
+		return err
+	}
+
+	addr := &netlink.Addr{
+		IPNet: &net.IPNet{IP: ip, Mask: ipnet.Mask},
+		Flags: unix.IFA_F_NODAD,
+	}
+
+	err = netlink.AddrReplace(link, addr)
+	if err != nil {
+		return errors.New("set address " + ip6 + " fail," + err.Error())
+	}
+	return nil
+}
+
+func (t *TunIO) SetMTU(mtu int) error {
+
+	link, err := t.link()
+	if err != nil {
+		return err
+	}
+
+	err = netlink.LinkSetMTU(link, mtu)
+	if err != nil {
+		return errors.New("set mtu " + strconv.Itoa(mtu) + " fail," + err.Error())
+	}
+	t.mtu = mtu
 	return nil
 }
 
 func (t *TunIO) Enanble() error {
 
-	out, err := exec.Command("bash", "-c", "ip link set "+t.ifce.Name()+" up").CombinedOutput()
+	link, err := t.link()
+	if err != nil {
+		return err
+	}
 
+	err = netlink.LinkSetUp(link)
 	if err != nil {
-		return errors.New(err.Error() + "," + string(out))
+		return errors.New("set link up fail," + err.Error())
 	}
 	return nil
 }
 
+// AddRoute same as ip route replace cidr via gw,routes added are removed when tun closed
 func (t *TunIO) AddRoute(cidr string, gw string) error {
-	out, err := exec.Command("bash", "-c", "ip route add "+cidr+" via "+gw).CombinedOutput()
 
+	_, dst, err := net.ParseCIDR(cidr)
 	if err != nil {
-		return errors.New(err.Error() + "," + string(out))
+		return err
 	}
 
-	return err
+	gwip := net.ParseIP(gw)
+	if gwip == nil {
+		return errors.New("invalid gateway " + gw)
+	}
+
+	link, err := t.link()
+	if err != nil {
+		return err
+	}
+
+	route := &netlink.Route{LinkIndex: link.Attrs().Index, Dst: dst, Gw: gwip}
+
+	err = netlink.RouteReplace(route)
+	if err != nil {
+		return errors.New("add route " + cidr + " via " + gw + " fail," + err.Error())
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for _, r := range t.routes {
+		if r.Dst.String() == dst.String() {
+			return nil
+		}
+	}
+	t.routes = append(t.routes, route)
+	return nil
+}
+
+func (t *TunIO) DelRoute(cidr string) error {
+
+	_, dst, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for i, route := range t.routes {
+		if route.Dst.String() == dst.String() {
+			t.routes = append(t.routes[:i], t.routes[i+1:]...)
+			err = netlink.RouteDel(route)
+			if err != nil && !errors.Is(err, unix.ESRCH) {
+				return errors.New("delete route " + cidr + " fail," + err.Error())
+			}
+			return nil
+		}
+	}
+	return nil
+}
 
+func (t *TunIO) delRoutes() {
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for _, route := range t.routes {
+		err := netlink.RouteDel(route)
+		if err != nil && !errors.Is(err, unix.ESRCH) {
+			elog.Error("delete route ", route.Dst.String(), " fail,", err)
+		}
+	}
+	t.routes = nil
 }
 
+// Close stop writers and close the device,write channels are left open so Enqueue never sends on a closed channel
 func (t *TunIO) Close() error {
+	t.mutex.Lock()
 	if t.closed {
+		t.mutex.Unlock()
 		return nil
 	}
+	t.closed = true
+	close(t.done)
+	t.mutex.Unlock()
+
+	t.delRoutes()
 
-	if t.wch != nil {
-		t.wch <- nil
-		close(t.wch)
+	var err error
+	for _, ifce := range t.ifces {
+		cerr := ifce.Close()
+		if cerr != nil && err == nil {
+			err = cerr
+		}
 	}
-	t.closed = true
-	return t.ifce.Close()
+	return err
 }
 
-func (t *TunIO) read() {
+func (t *TunIO) read(ifce *water.Interface) {
 	defer func() {
 		t.Close()
 	}()
@@ -91,8 +275,9 @@ func (t *TunIO) read() {
 	for {
 
 		pkt := make([]byte, t.mtu)
-		n, err := t.ifce.Read(pkt)
+		n, err := ifce.Read(pkt)
 		if err != nil {
+			metricTunReadErrs.Inc()
 			elog.Error("read pkg from tun fail", err)
 			return
 		}
@@ -103,22 +288,21 @@ func (t *TunIO) read() {
 
 }
 
-func (t *TunIO) write() {
+func (t *TunIO) write(ifce *water.Interface, wch chan []byte) {
 	defer PanicHandlerExit()
 
 	for {
-		pkt, ok := <-t.wch
-		if !ok {
-			elog.Error("get pkt from write channel fail,maybe channel closed")
-			return
-		}
-		if pkt == nil {
+		var pkt []byte
+		select {
+		case pkt = <-wch:
+		case <-t.done:
 			elog.Info("exit write process")
 			return
 		}
 
-		_, err := t.ifce.Write(pkt)
+		_, err := ifce.Write(pkt)
 		if err != nil {
+			metricTunWriteErrs.Inc()
 			if err == io.EOF {
 				elog.Info("tun may be closed")
 			} else {
@@ -130,15 +314,49 @@ func (t *TunIO) write() {
 	}
 }
 
+// flowQueue choose queue by source and destination address,so packets of a flow keep in order
+func (t *TunIO) flowQueue(pkt []byte) int {
+
+	if len(t.wchs) == 1 || len(pkt) == 0 {
+		return 0
+	}
+
+	var addrs []byte
+	ver := pkt[0] >> 4
+	if ver == IPV4_PROTOCOL && len(pkt) >= header.IPv4MinimumSize {
+		addrs = pkt[12:20]
+	} else if ver == IPV6_PROTOCOL && len(pkt) >= header.IPv6MinimumSize {
+		addrs = pkt[8:40]
+	}
+
+	h := fnv.New32a()
+	h.Write(addrs)
+	return int(h.Sum32() % uint32(len(t.wchs)))
+}
+
+// Enqueue queue pkt to write,it waits if the queue is full,and fails once tun is closed
 func (t *TunIO) Enqueue(pkt []byte) error {
-	if t.wch == nil {
+	if len(t.wchs) == 0 {
 		return errors.New("write channel is nil")
 	}
-	t.wch <- pkt
-	return nil
+
+	select {
+	case <-t.done:
+		return errors.New("tun is closed")
+	default:
+	}
+
+	select {
+	case t.wchs[t.flowQueue(pkt)] <- pkt:
+		return nil
+	case <-t.done:
+		return errors.New("tun is closed")
+	}
 }
 
 func (t *TunIO) StartProcess() {
-	go t.read()
-	go t.write()
+	for i, ifce := range t.ifces {
+		go t.read(ifce)
+		go t.write(ifce, t.wchs[i])
+	}
 }
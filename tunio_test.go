@@ -0,0 +1,39 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTunIOCloseEnqueue(t *testing.T) {
+
+	tun := &TunIO{wchs: []chan []byte{make(chan []byte, 1)}, done: make(chan struct{}), mutex: &sync.Mutex{}}
+
+	err := tun.Enqueue([]byte{0x45})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//the queue is full,Enqueue waits until tun is closed
+	result := make(chan error, 1)
+	go func() {
+		result <- tun.Enqueue([]byte{0x45})
+	}()
+
+	time.Sleep(time.Millisecond * 50)
+	tun.Close()
+
+	select {
+	case err = <-result:
+		if err == nil {
+			t.Fatal("enqueue to a closed tun should fail")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("enqueue is blocked after close")
+	}
+
+	if tun.Enqueue([]byte{0x45}) == nil {
+		t.Fatal("enqueue to a closed tun should fail")
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/polevpn/elog"
+	"github.com/quic-go/quic-go"
+)
+
+func (hs *HttpServer) addListener(listener io.Closer) {
+	hs.mutex.Lock()
+	defer hs.mutex.Unlock()
+	hs.listeners = append(hs.listeners, listener)
+}
+
+// authTunnelConn read CMD_USER_AUTH with user,pwd,otp,token,ip,deviceType,deviceId from a conn without http upgrade,
+// and answer the check result,return user,ip,deviceId and policy if it pass,state is the tls state of the conn
+func (hs *HttpServer) authTunnelConn(transport PacketTransport, state *tls.ConnectionState) (string, string, string, *UserPolicy, error) {
+
+	auth, err := hs.readUserAuth(transport)
+	if err != nil {
+		return "", "", "", nil, err
+	}
+
+	req := &LoginRequest{
+		IP:         auth.Get("ip").AsStr(),
+		DeviceType: auth.Get("deviceType").AsStr(),
+		DeviceId:   auth.Get("deviceId").AsStr(),
+	}
+	req.setCredential(auth)
+	req.CertUser, req.CertPolicy = hs.getClientCertUser(state)
+	remoteAddr := transport.RemoteAddr().String()
+	req.RemoteIp, _, _ = net.SplitHostPort(remoteAddr)
+
+	elog.Infof("user:%v,ip:%v,deviceType:%v,deviceId:%v,remoteip:%v connect", req.User, req.IP, req.DeviceType, req.DeviceId, remoteAddr)
+
+	if hs.draining.Load() {
+		transport.WritePacket(hs.userAuthResp(http.StatusServiceUnavailable))
+		return "", "", "", nil, errors.New("server is draining")
+	}
+
+	user, policy, err := hs.checkInBandLogin(transport, req)
+	if err != nil {
+		return "", "", "", nil, err
+	}
+	return user, req.IP, req.DeviceId, policy, nil
+}
+
+// ListenRawTLS accept tls connections carrying length prefixed pole packets,
+// the first packet from client must be CMD_USER_AUTH
+func (hs *HttpServer) ListenRawTLS(wg *sync.WaitGroup, addr string, certFile string, keyFile string) {
+
+	defer wg.Done()
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		elog.Error("load tls key pair fail,", err)
+		return
+	}
+
+	listener, err := tls.Listen("tcp", addr, hs.serverTLSConfig(cert))
+	if err != nil {
+		elog.Error("listen tls fail,", err)
+		return
+	}
+	hs.addListener(listener)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				elog.Error("accept tls conn fail,", err)
+			}
+			return
+		}
+		go hs.tlsHandler(conn)
+	}
+}
+
+func (hs *HttpServer) tlsHandler(conn net.Conn) {
+
+	defer PanicHandler()
+
+	if tcpConn, ok := conn.(*tls.Conn).NetConn().(*net.TCPConn); ok {
+		tcpConn.SetReadBuffer(TCP_READ_BUFFER_SIZE)
+		tcpConn.SetWriteBuffer(TCP_WRITE_BUFFER_SIZE)
+	}
+
+	//handshake first,so the client certificate is known before auth
+	conn.SetDeadline(time.Now().Add(time.Second * USER_AUTH_TIMEOUT))
+	err := conn.(*tls.Conn).Handshake()
+	conn.SetDeadline(time.Time{})
+	if err != nil {
+		elog.Error(conn.RemoteAddr().String(), " tls handshake fail,", err)
+		conn.Close()
+		return
+	}
+	state := conn.(*tls.Conn).ConnectionState()
+
+	tlsconn := NewTLSConn(conn)
+
+	user, ip, deviceId, policy, err := hs.authTunnelConn(tlsconn, &state)
+
+	if err != nil {
+		elog.Error(conn.RemoteAddr().String(), " tls conn auth fail,", err)
+		conn.Close()
+		return
+	}
+
+	elog.Info("accpet new tls conn from ", user, " ", conn.RemoteAddr().String())
+
+	session := NewSession(tlsconn, hs.newRateLimiter(hs.downlimit.Load(), policy.DownLimit), hs.newRateLimiter(hs.uplimit.Load(), policy.UpLimit), hs.requestHandler)
+	hs.requestHandler.OnConnection(session, user, ip, deviceId, policy)
+	go session.Read()
+	go session.Write()
+}
+
+// ListenQuic accept quic connections,ip data is carried in datagrams,
+// the first stream opened by client is the control stream and begins with CMD_USER_AUTH
+func (hs *HttpServer) ListenQuic(wg *sync.WaitGroup, addr string, certFile string, keyFile string) {
+
+	defer wg.Done()
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		elog.Error("load tls key pair fail,", err)
+		return
+	}
+
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		elog.Error("resolve udp addr fail,", err)
+		return
+	}
+
+	udpConn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		elog.Error("listen udp fail,", err)
+		return
+	}
+
+	//closing a listener of transport keeps established connections,they are closed with the transport
+	transport := &quic.Transport{Conn: udpConn}
+	defer transport.Close()
+
+	tlsConfig := hs.serverTLSConfig(cert)
+	tlsConfig.NextProtos = []string{QUIC_ALPN}
+
+	listener, err := transport.Listen(tlsConfig, &quic.Config{EnableDatagrams: true})
+	if err != nil {
+		elog.Error("listen quic fail,", err)
+		return
+	}
+	hs.addListener(listener)
+
+	hs.mutex.Lock()
+	hs.transports = append(hs.transports, transport)
+	hs.mutex.Unlock()
+
+	for {
+		conn, err := listener.Accept(context.Background())
+		if err != nil {
+			if !errors.Is(err, quic.ErrServerClosed) {
+				elog.Error("accept quic conn fail,", err)
+			}
+			return
+		}
+		go hs.quicHandler(conn)
+	}
+}
+
+func (hs *HttpServer) quicHandler(conn quic.Connection) {
+
+	defer PanicHandler()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*USER_AUTH_TIMEOUT)
+	stream, err := conn.AcceptStream(ctx)
+	cancel()
+	if err != nil {
+		elog.Error(conn.RemoteAddr().String(), " accept quic control stream fail,", err)
+		conn.CloseWithError(0, "")
+		return
+	}
+
+	quicconn := NewQuicConn(conn, stream)
+	state := conn.ConnectionState().TLS
+
+	user, ip, deviceId, policy, err := hs.authTunnelConn(quicconn, &state)
+
+	if err != nil {
+		elog.Error(conn.RemoteAddr().String(), " quic conn auth fail,", err)
+		conn.CloseWithError(0, "")
+		return
+	}
+
+	elog.Info("accpet new quic conn from ", user, " ", conn.RemoteAddr().String())
+
+	session := NewSession(quicconn, hs.newRateLimiter(hs.downlimit.Load(), policy.DownLimit), hs.newRateLimiter(hs.uplimit.Load(), policy.UpLimit), hs.requestHandler)
+	hs.requestHandler.OnConnection(session, user, ip, deviceId, policy)
+	go session.Read()
+	go session.Write()
+}
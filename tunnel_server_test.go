@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/polevpn/anyvalue"
+	"github.com/quic-go/quic-go"
+)
+
+type staticLoginChecker struct {
+	user string
+	pwd  string
+}
+
+func (lc *staticLoginChecker) CheckLogin(user string, pwd string, remoteIp string, deviceType string, deviceId string) (*UserPolicy, error) {
+	if user != lc.user || pwd != lc.pwd {
+		return nil, errors.New("invalid user or password")
+	}
+	return &UserPolicy{}, nil
+}
+
+// writeTestCert write a self signed certificate for 127.0.0.1 and its key to dir
+func writeTestCert(t *testing.T, dir string) (string, string) {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, "server.crt")
+	keyFile := filepath.Join(dir, "server.key")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return certFile, keyFile
+}
+
+func freeAddr(t *testing.T, network string) string {
+	if network == "udp" {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return conn.LocalAddr().String()
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+func newTestHttpServer(t *testing.T) (*HttpServer, *ConnMgr, string, string) {
+
+	oldConfig := Config()
+	SetConfig(anyvalue.New())
+	t.Cleanup(func() { SetConfig(oldConfig) })
+
+	connmgr := NewConnMgr()
+	requestHandler := NewRequestHandler()
+	requestHandler.SetConnMgr(connmgr)
+	requestHandler.SetRouterMgr(NewRouterMgr())
+
+	hs := NewHttpServer(0, 0, requestHandler)
+	hs.SetLoginCheckHandler(&staticLoginChecker{user: "alice", pwd: "123456"})
+
+	certFile, keyFile := writeTestCert(t, t.TempDir())
+	return hs, connmgr, certFile, keyFile
+}
+
+func newPolePacket(cmd uint16, payload []byte) []byte {
+	buf := make([]byte, POLE_PACKET_HEADER_LEN+len(payload))
+	copy(buf[POLE_PACKET_HEADER_LEN:], payload)
+	pkt := PolePacket(buf)
+	pkt.SetLen(uint16(len(buf)))
+	pkt.SetCmd(cmd)
+	return pkt
+}
+
+func authPacket(user string, pwd string) []byte {
+	av := anyvalue.New()
+	av.Set("user", user)
+	av.Set("pwd", pwd)
+	av.Set("deviceId", "device1")
+	body, _ := av.MarshalJSON()
+	return newPolePacket(CMD_USER_AUTH, body)
+}
+
+func checkAuthResp(t *testing.T, pkt []byte, ret int) {
+	if PolePacket(pkt).Cmd() != CMD_USER_AUTH {
+		t.Fatalf("unexpected cmd %v", PolePacket(pkt).Cmd())
+	}
+	av, err := anyvalue.NewFromJson(PolePacket(pkt).Payload())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if av.Get("ret").AsInt() != ret {
+		t.Fatalf("expected ret %v,got %v", ret, av.Get("ret").AsInt())
+	}
+}
+
+func TestRawTLSTransport(t *testing.T) {
+
+	hs, connmgr, certFile, keyFile := newTestHttpServer(t)
+	addr := freeAddr(t, "tcp")
+
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go hs.ListenRawTLS(wg, addr, certFile, keyFile)
+	defer func() {
+		hs.Shutdown(context.Background())
+		wg.Wait()
+	}()
+
+	dial := func() *tls.Conn {
+		for i := 0; i < 50; i++ {
+			conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+			if err == nil {
+				return conn
+			}
+			time.Sleep(time.Millisecond * 20)
+		}
+		t.Fatal("dial tls fail")
+		return nil
+	}
+
+	conn := dial()
+	conn.Write(authPacket("alice", "bad"))
+	pkt, err := ReadPacket(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkAuthResp(t, pkt, 403)
+	conn.Close()
+
+	conn = dial()
+	defer conn.Close()
+	conn.Write(authPacket("alice", "123456"))
+	pkt, err = ReadPacket(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkAuthResp(t, pkt, 200)
+
+	conn.Write(newPolePacket(CMD_HEART_BEAT, nil))
+	pkt, err = ReadPacket(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if PolePacket(pkt).Cmd() != CMD_HEART_BEAT {
+		t.Fatalf("expected heart beat,got %v", PolePacket(pkt).Cmd())
+	}
+
+	conns := connmgr.GetConns()
+	if len(conns) != 1 || conns[0].Transport() != "tls" || connmgr.GetConnDevice(conns[0]) != "device1" {
+		t.Fatalf("unexpected conns %v", conns)
+	}
+}
+
+func TestQuicTransport(t *testing.T) {
+
+	hs, connmgr, certFile, keyFile := newTestHttpServer(t)
+	addr := freeAddr(t, "udp")
+
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go hs.ListenQuic(wg, addr, certFile, keyFile)
+	defer func() {
+		hs.Shutdown(context.Background())
+		hs.Close()
+		wg.Wait()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	var conn quic.Connection
+	var err error
+	for i := 0; i < 50; i++ {
+		conn, err = quic.DialAddr(ctx, addr,
+			&tls.Config{InsecureSkipVerify: true, NextProtos: []string{QUIC_ALPN}},
+			&quic.Config{EnableDatagrams: true},
+		)
+		if err == nil {
+			break
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.CloseWithError(0, "")
+
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stream.Write(authPacket("alice", "123456"))
+	pkt, err := ReadPacket(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkAuthResp(t, pkt, 200)
+
+	conns := connmgr.GetConns()
+	if len(conns) != 1 || conns[0].Transport() != "quic" {
+		t.Fatalf("unexpected conns %v", conns)
+	}
+
+	ippkt := newPolePacket(CMD_S2C_IPDATA, []byte{0x45, 0, 0, 20})
+	conns[0].Send(ippkt)
+
+	dgram, err := conn.ReceiveDatagram(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(dgram) != string(ippkt) {
+		t.Fatalf("unexpected datagram %v", dgram)
+	}
+
+	stream.Write(newPolePacket(CMD_HEART_BEAT, nil))
+	pkt, err = ReadPacket(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if PolePacket(pkt).Cmd() != CMD_HEART_BEAT {
+		t.Fatalf("expected heart beat,got %v", PolePacket(pkt).Cmd())
+	}
+}
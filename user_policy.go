@@ -0,0 +1,72 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/polevpn/anyvalue"
+)
+
+// UserPolicy is returned by auth backend on login,zero value fields mean no per user setting,
+// User is set by backends which map the login to a user name,e.g. claims of a jwt,
+// User and TOTPSecret aren't marshaled so they never go into session tokens
+type UserPolicy struct {
+	UpLimit     uint64   `json:"up_limit,omitempty"`
+	DownLimit   uint64   `json:"down_limit,omitempty"`
+	Quota       uint64   `json:"quota,omitempty"`
+	MaxSessions int      `json:"max_sessions,omitempty"`
+	Groups      []string `json:"groups,omitempty"`
+	User        string   `json:"-"`
+	TOTPSecret  string   `json:"-"`
+}
+
+// NewUserPolicyFromJson parse {"up_limit":..,"down_limit":..,"quota":..,"max_sessions":..,"groups":[..],"totp_secret":..}
+func NewUserPolicyFromJson(data []byte) (*UserPolicy, error) {
+
+	if len(data) == 0 {
+		return &UserPolicy{}, nil
+	}
+
+	av, err := anyvalue.NewFromJson(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &UserPolicy{
+		UpLimit:     av.Get("up_limit").AsUint64(),
+		DownLimit:   av.Get("down_limit").AsUint64(),
+		Quota:       av.Get("quota").AsUint64(),
+		MaxSessions: av.Get("max_sessions").AsInt(),
+		Groups:      av.Get("groups").AsStrArr(),
+		TOTPSecret:  av.Get("totp_secret").AsStr(),
+	}, nil
+}
+
+// NewUserPolicyFromFields parse up_limit,down_limit,quota,max_sessions,groups columns,groups are separated by ';',
+// missing or empty column means not set
+func NewUserPolicyFromFields(fields []string) *UserPolicy {
+
+	var groups []string
+	if len(fields) > 4 {
+		for _, group := range strings.Split(fields[4], ";") {
+			if group = strings.TrimSpace(group); group != "" {
+				groups = append(groups, group)
+			}
+		}
+	}
+
+	values := make([]uint64, 4)
+	for i := range values {
+		if i < len(fields) && fields[i] != "" {
+			values[i], _ = strconv.ParseUint(fields[i], 10, 64)
+		}
+	}
+
+	return &UserPolicy{
+		UpLimit:     values[0],
+		DownLimit:   values[1],
+		Quota:       values[2],
+		MaxSessions: int(values[3]),
+		Groups:      groups,
+	}
+}
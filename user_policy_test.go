@@ -0,0 +1,27 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNewUserPolicy(t *testing.T) {
+
+	policy, err := NewUserPolicyFromJson([]byte(`{"up_limit":1000,"down_limit":2000,"quota":1073741824,"max_sessions":2,"groups":["dev","ops"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(*policy, UserPolicy{UpLimit: 1000, DownLimit: 2000, Quota: 1073741824, MaxSessions: 2, Groups: []string{"dev", "ops"}}) {
+		t.Fatal("unexpected json policy", *policy)
+	}
+
+	policy, err = NewUserPolicyFromJson(nil)
+	if err != nil || !reflect.DeepEqual(*policy, UserPolicy{}) {
+		t.Fatal("empty body should be empty policy")
+	}
+
+	policy = NewUserPolicyFromFields([]string{"", "2000", "", "3", "dev;ops"})
+	if !reflect.DeepEqual(*policy, UserPolicy{DownLimit: 2000, MaxSessions: 3, Groups: []string{"dev", "ops"}}) {
+		t.Fatal("unexpected fields policy", *policy)
+	}
+}
@@ -13,6 +13,14 @@ import (
 
 	"github.com/polevpn/anyvalue"
 	"github.com/polevpn/elog"
+	"github.com/polevpn/netstack/tcpip/header"
+)
+
+const (
+	IPV6_EXT_HOP_BY_HOP = 0
+	IPV6_EXT_ROUTING    = 43
+	IPV6_EXT_AUTH       = 51
+	IPV6_EXT_DEST_OPTS  = 60
 )
 
 var ServerAesKey = []byte{0x75, 0xf3, 0xfe, 0x63, 0x18, 0x1f, 0x5c, 0x27, 0xab, 0x7c, 0xad, 0x4d, 0x7b, 0xf2, 0x59, 0xd0}
@@ -88,6 +96,73 @@ func ReadPacket(conn io.Reader) ([]byte, error) {
 	return pkt, nil
 }
 
+// GetIPTransport return the transport protocol and the transport header with payload,
+// payload is nil if pkt is invalid or a non-first fragment
+func GetIPTransport(pkt []byte) (uint8, []byte) {
+	protocol, payload, ok := ParseIPTransport(pkt)
+	if !ok {
+		return 0, nil
+	}
+	return protocol, payload
+}
+
+// ParseIPTransport is like GetIPTransport,ipv6 extension headers are skipped to reach the transport header,
+// false means pkt is invalid,non-first fragments carry no transport header so their payload is nil
+func ParseIPTransport(pkt []byte) (uint8, []byte, bool) {
+
+	if len(pkt) == 0 {
+		return 0, nil, false
+	}
+
+	ver := pkt[0] >> 4
+
+	if ver == IPV4_PROTOCOL {
+		ipv4pkt := header.IPv4(pkt)
+		if !ipv4pkt.IsValid(len(pkt)) {
+			return 0, nil, false
+		}
+		if ipv4pkt.FragmentOffset() != 0 {
+			return ipv4pkt.Protocol(), nil, true
+		}
+		return ipv4pkt.Protocol(), ipv4pkt.Payload(), true
+	} else if ver == IPV6_PROTOCOL {
+		ipv6pkt := header.IPv6(pkt)
+		if !ipv6pkt.IsValid(len(pkt)) {
+			return 0, nil, false
+		}
+		//every extension header is at least 8 bytes,so the loop ends
+		next, payload := ipv6pkt.NextHeader(), ipv6pkt.Payload()
+		for {
+			switch next {
+			case IPV6_EXT_HOP_BY_HOP, IPV6_EXT_ROUTING, IPV6_EXT_DEST_OPTS, IPV6_EXT_AUTH:
+				if len(payload) < 8 {
+					return 0, nil, false
+				}
+				size := (int(payload[1]) + 1) * 8
+				if next == IPV6_EXT_AUTH {
+					size = (int(payload[1]) + 2) * 4
+				}
+				if len(payload) < size {
+					return 0, nil, false
+				}
+				next, payload = payload[0], payload[size:]
+			case header.IPv6FragmentHeader:
+				frag := header.IPv6Fragment(payload)
+				if !frag.IsValid() {
+					return 0, nil, false
+				}
+				next, payload = frag.NextHeader(), payload[header.IPv6FragmentHeaderSize:]
+				if frag.FragmentOffset() != 0 {
+					return next, nil, true
+				}
+			default:
+				return next, payload, true
+			}
+		}
+	}
+	return 0, nil, false
+}
+
 func GetConfig(configfile string) (*anyvalue.AnyValue, error) {
 
 	f, err := os.Open(configfile)